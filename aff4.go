@@ -0,0 +1,475 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AFF4 volume is a zip container with RDF metadata in information.turtle.
+// Media data is stored in image streams split into bevies of compressed
+// chunks. A map stream lays out ranges of image streams and symbolic
+// streams (zeros, patterns) to build the logical image.
+
+const (
+	aff4Namespace         = "http://aff4.org/Schema#"
+	aff4TypeImage         = aff4Namespace + "Image"
+	aff4TypeImageStream   = aff4Namespace + "ImageStream"
+	aff4TypeMap           = aff4Namespace + "Map"
+	aff4Size              = aff4Namespace + "size"
+	aff4ChunkSize         = aff4Namespace + "chunkSize"
+	aff4ChunksInSegment   = aff4Namespace + "chunksInSegment"
+	aff4CompressionMethod = aff4Namespace + "compressionMethod"
+	aff4DataStream        = aff4Namespace + "dataStream"
+	aff4MapGapDefault     = aff4Namespace + "mapGapDefaultStream"
+	aff4Hash              = aff4Namespace + "hash"
+	aff4Zero              = aff4Namespace + "Zero"
+	aff4UnknownData       = aff4Namespace + "UnknownData"
+	aff4UnreadableData    = aff4Namespace + "UnreadableData"
+	aff4SymbolicStream    = aff4Namespace + "SymbolicStream"
+
+	aff4InformationTurtle = "information.turtle"
+	aff4Description       = "container.description"
+	aff4MapEntrySize      = 28
+	aff4IndexEntrySize    = 12
+)
+
+type aff4Volume struct {
+	file    *os.File
+	urn     string
+	members map[string]*zip.File
+	graph   rdfGraph
+}
+
+func openAFF4(f *os.File) (inputFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	volume := &aff4Volume{file: f, urn: strings.TrimSpace(zipReader.Comment), members: map[string]*zip.File{}}
+	var information *zip.File
+	for _, member := range zipReader.File {
+		if member.Name == aff4InformationTurtle {
+			information = member
+		} else if member.Name == aff4Description && volume.urn == "" {
+			description, err := readZipMember(member)
+			if err != nil {
+				return nil, err
+			}
+			volume.urn = strings.TrimSpace(string(description))
+		}
+	}
+	if information == nil {
+		// Regular zip file is read as raw
+		return nil, nil
+	}
+	turtle, err := readZipMember(information)
+	if err != nil {
+		return nil, err
+	}
+	if volume.graph, err = parseTurtle(string(turtle)); err != nil {
+		return nil, err
+	}
+	for _, member := range zipReader.File {
+		volume.members[volume.memberURN(member.Name)] = member
+	}
+
+	imageURN := volume.imageURN()
+	if imageURN == "" {
+		return nil, errors.New("AFF4 volume has no image")
+	}
+	reader, size, err := volume.openStream(imageURN, 0)
+	if err != nil {
+		return nil, fmt.Errorf("AFF4 image %s: %v", imageURN, err)
+	}
+	if imageSize, ok := volume.intValue(imageURN, aff4Size); ok {
+		size = imageSize
+	}
+
+	return &imageFile{reader: reader, size: size, file: f, format: "AFF4", hashes: volume.hashes(imageURN)}, nil
+}
+
+// memberURN converts a zip member name to the URN of the object it stores.
+// Names are either escaped URNs or paths relative to the volume URN.
+func (v *aff4Volume) memberURN(name string) string {
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	if strings.HasPrefix(name, "aff4://") {
+		return name
+	}
+	return v.urn + "/" + name
+}
+
+// imageURN chooses the logical image of the volume
+func (v *aff4Volume) imageURN() string {
+	var images, streams []string
+	for subject := range v.graph {
+		if v.graph.hasType(subject, aff4TypeImage) {
+			images = append(images, subject)
+		} else if v.graph.hasType(subject, aff4TypeImageStream) {
+			streams = append(streams, subject)
+		}
+	}
+	sort.Strings(images)
+	sort.Strings(streams)
+	if len(images) > 0 {
+		return images[0]
+	}
+	if len(streams) > 0 {
+		return streams[0]
+	}
+	return ""
+}
+
+func (v *aff4Volume) intValue(subject, predicate string) (int64, bool) {
+	term, ok := v.graph.object(subject, predicate)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(term.value, 10, 64)
+	return value, err == nil
+}
+
+func (v *aff4Volume) hashes(subject string) map[string][]byte {
+	hashes := map[string][]byte{}
+	for _, term := range v.graph.objects(subject, aff4Hash) {
+		name := strings.ToLower(strings.TrimPrefix(term.datatype, aff4Namespace))
+		value, err := hex.DecodeString(term.value)
+		if err == nil && (name == md5Name || name == sha1Name || name == sha256Name || name == sha512Name) {
+			hashes[name] = value
+		}
+	}
+	return hashes
+}
+
+// openStream opens an image, map, image stream or symbolic stream by URN
+func (v *aff4Volume) openStream(urn string, depth int) (io.ReaderAt, int64, error) {
+	if depth > 8 {
+		return nil, 0, errors.New("too deep stream references")
+	}
+	if pattern := aff4SymbolicPattern(urn); pattern != nil {
+		return patternReader(pattern), 0, nil
+	}
+	if v.graph.hasType(urn, aff4TypeMap) {
+		return v.openMap(urn, depth)
+	}
+	if v.graph.hasType(urn, aff4TypeImageStream) {
+		return v.openImageStream(urn)
+	}
+	if dataStream, ok := v.graph.object(urn, aff4DataStream); ok {
+		return v.openStream(dataStream.value, depth+1)
+	}
+	return nil, 0, fmt.Errorf("unknown stream %s", urn)
+}
+
+func aff4SymbolicPattern(urn string) []byte {
+	switch {
+	case urn == aff4Zero:
+		return []byte{0}
+	case urn == aff4UnknownData:
+		return []byte("UNKNOWN")
+	case urn == aff4UnreadableData:
+		return []byte("UNREADABLEDATA")
+	case strings.HasPrefix(urn, aff4SymbolicStream):
+		value, err := strconv.ParseUint(strings.TrimPrefix(urn, aff4SymbolicStream), 16, 8)
+		if err == nil {
+			return []byte{byte(value)}
+		}
+	}
+	return nil
+}
+
+// patternReader reads repeated pattern as if it filled the whole stream
+type patternReader []byte
+
+func (p patternReader) ReadAt(b []byte, off int64) (int, error) {
+	for i := range b {
+		b[i] = p[(off+int64(i))%int64(len(p))]
+	}
+	return len(b), nil
+}
+
+type aff4MapEntry struct {
+	mapOffset    int64
+	length       int64
+	targetOffset int64
+	target       int
+}
+
+type aff4MapStream struct {
+	entries []aff4MapEntry
+	targets []io.ReaderAt
+	gap     io.ReaderAt
+}
+
+func (v *aff4Volume) openMap(urn string, depth int) (io.ReaderAt, int64, error) {
+	idx, err := v.readMember(urn + "/idx")
+	if err != nil {
+		return nil, 0, err
+	}
+	mapData, err := v.readMember(urn + "/map")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m := &aff4MapStream{gap: patternReader{0}}
+	if gap, ok := v.graph.object(urn, aff4MapGapDefault); ok {
+		if m.gap, _, err = v.openStream(gap.value, depth+1); err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, targetURN := range strings.Split(strings.TrimSpace(string(idx)), "\n") {
+		target, _, err := v.openStream(strings.TrimSpace(targetURN), depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		m.targets = append(m.targets, target)
+	}
+
+	var size int64
+	for i := 0; i+aff4MapEntrySize <= len(mapData); i += aff4MapEntrySize {
+		entry := aff4MapEntry{
+			mapOffset:    int64(binary.LittleEndian.Uint64(mapData[i:])),
+			length:       int64(binary.LittleEndian.Uint64(mapData[i+8:])),
+			targetOffset: int64(binary.LittleEndian.Uint64(mapData[i+16:])),
+			target:       int(binary.LittleEndian.Uint32(mapData[i+24:])),
+		}
+		if entry.target >= len(m.targets) {
+			return nil, 0, fmt.Errorf("map entry refers to unknown target %d", entry.target)
+		}
+		m.entries = append(m.entries, entry)
+		if end := entry.mapOffset + entry.length; end > size {
+			size = end
+		}
+	}
+	sort.Slice(m.entries, func(i, j int) bool { return m.entries[i].mapOffset < m.entries[j].mapOffset })
+	return m, size, nil
+}
+
+func (m *aff4MapStream) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		// The first entry which ends after the offset
+		i := sort.Search(len(m.entries), func(i int) bool {
+			return m.entries[i].mapOffset+m.entries[i].length > off
+		})
+
+		var part []byte
+		if i < len(m.entries) && m.entries[i].mapOffset <= off {
+			entry := m.entries[i]
+			part = p[n:minInt64(int64(len(p)), int64(n)+entry.mapOffset+entry.length-off)]
+			_, err = m.targets[entry.target].ReadAt(part, entry.targetOffset+off-entry.mapOffset)
+		} else {
+			gapEnd := int64(len(p)) - int64(n) + off
+			if i < len(m.entries) && m.entries[i].mapOffset < gapEnd {
+				gapEnd = m.entries[i].mapOffset
+			}
+			part = p[n : int64(n)+gapEnd-off]
+			_, err = m.gap.ReadAt(part, off)
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	return n, nil
+}
+
+type aff4ImageStream struct {
+	volume          *aff4Volume
+	urn             string
+	size            int64
+	chunkSize       int64
+	chunksInSegment int64
+	decompress      func(data []byte, chunkSize int64) ([]byte, error)
+
+	mutex       sync.Mutex
+	bevyNumber  int64
+	bevy        io.ReaderAt
+	bevyIndex   []byte
+	cachedChunk int64
+	cachedData  []byte
+}
+
+func (v *aff4Volume) openImageStream(urn string) (io.ReaderAt, int64, error) {
+	s := &aff4ImageStream{volume: v, urn: urn, bevyNumber: -1, cachedChunk: -1}
+	var ok bool
+	if s.size, ok = v.intValue(urn, aff4Size); !ok {
+		return nil, 0, errors.New("image stream size is unknown")
+	}
+	if s.chunkSize, ok = v.intValue(urn, aff4ChunkSize); !ok || s.chunkSize <= 0 {
+		return nil, 0, errors.New("image stream chunk size is unknown")
+	}
+	if s.chunksInSegment, ok = v.intValue(urn, aff4ChunksInSegment); !ok || s.chunksInSegment <= 0 {
+		return nil, 0, errors.New("image stream chunks in segment count is unknown")
+	}
+
+	method, _ := v.graph.object(urn, aff4CompressionMethod)
+	var err error
+	if s.decompress, err = aff4Decompressor(method.value); err != nil {
+		return nil, 0, err
+	}
+	return s, s.size, nil
+}
+
+func aff4Decompressor(method string) (func(data []byte, chunkSize int64) ([]byte, error), error) {
+	switch {
+	case method == "" || strings.HasSuffix(method, "NullCompressor"):
+		return func(data []byte, chunkSize int64) ([]byte, error) { return data, nil }, nil
+	case strings.Contains(method, "snappy"):
+		return func(data []byte, chunkSize int64) ([]byte, error) { return decodeSnappy(data) }, nil
+	case strings.Contains(method, "lz4"):
+		return func(data []byte, chunkSize int64) ([]byte, error) { return decodeLZ4Block(data, int(chunkSize)) }, nil
+	case strings.Contains(method, "rfc1950"):
+		return func(data []byte, chunkSize int64) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		}, nil
+	case strings.Contains(method, "rfc1951"):
+		return func(data []byte, chunkSize int64) ([]byte, error) {
+			return ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		}, nil
+	}
+	return nil, fmt.Errorf("compression method %s is not supported", method)
+}
+
+func (s *aff4ImageStream) readChunk(chunk int64) ([]byte, error) {
+	if chunk == s.cachedChunk {
+		return s.cachedData, nil
+	}
+
+	bevyNumber := chunk / s.chunksInSegment
+	if bevyNumber != s.bevyNumber {
+		name := fmt.Sprintf("%s/%08d", s.urn, bevyNumber)
+		index, err := s.volume.readMember(name + ".index")
+		if err != nil {
+			return nil, err
+		}
+		bevy, err := s.volume.memberReaderAt(name)
+		if err != nil {
+			return nil, err
+		}
+		s.bevyNumber, s.bevy, s.bevyIndex = bevyNumber, bevy, index
+	}
+
+	entry := (chunk % s.chunksInSegment) * aff4IndexEntrySize
+	if entry+aff4IndexEntrySize > int64(len(s.bevyIndex)) {
+		return nil, fmt.Errorf("chunk %d is missing in bevy index", chunk)
+	}
+	offset := int64(binary.LittleEndian.Uint64(s.bevyIndex[entry:]))
+	length := int64(binary.LittleEndian.Uint32(s.bevyIndex[entry+8:]))
+	stored, err := readBytesAt(s.bevy, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks which do not compress are stored as is
+	data := stored
+	if length != s.chunkSize {
+		if data, err = s.decompress(stored, s.chunkSize); err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", chunk, err)
+		}
+	}
+
+	s.cachedChunk, s.cachedData = chunk, data
+	return data, nil
+}
+
+func (s *aff4ImageStream) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for n < len(p) && off < s.size {
+		chunk := off / s.chunkSize
+		data, err := s.readChunk(chunk)
+		if err != nil {
+			return n, err
+		}
+		within := off % s.chunkSize
+		if within >= int64(len(data)) {
+			return n, fmt.Errorf("chunk %d is shorter than expected", chunk)
+		}
+		copied := copy(p[n:], data[within:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *aff4Volume) member(urn string) (*zip.File, error) {
+	member, ok := v.members[urn]
+	if !ok {
+		return nil, fmt.Errorf("AFF4 volume has no %s", urn)
+	}
+	return member, nil
+}
+
+func (v *aff4Volume) readMember(urn string) ([]byte, error) {
+	member, err := v.member(urn)
+	if err != nil {
+		return nil, err
+	}
+	return readZipMember(member)
+}
+
+// memberReaderAt gives random access to a member. Stored members are read
+// right from the volume file, compressed ones are decompressed to memory.
+func (v *aff4Volume) memberReaderAt(urn string) (io.ReaderAt, error) {
+	member, err := v.member(urn)
+	if err != nil {
+		return nil, err
+	}
+	if member.Method == zip.Store {
+		offset, err := member.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(v.file, offset, int64(member.UncompressedSize64)), nil
+	}
+	data, err := readZipMember(member)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func readZipMember(member *zip.File) ([]byte, error) {
+	r, err := member.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
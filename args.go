@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/atola-technology/seghash/external/github.com/alecthomas/kingpin"
 	"github.com/atola-technology/seghash/external/github.com/alecthomas/units"
@@ -19,33 +21,161 @@ Example: seghash calc inputfile.img md5`
 	// calc command constants
 	calcHelp = `Calculates segment hashes of an image file and puts resulting hashes in Hashes-<inputfile>-<hashtype>.csv.
 If file already exists it is overwritten.`
-	calcSegmentSizeHelp = `Desired size of a single segment in bytes. Minimum 2M. Must be multiple of 512.
-May have a case-insensitive multiplier suffix: M (1024*1024), G (1024*1024*1024), and T. Example: -s 2G`
-	calcInputHelp           = "Input file to calculate segment hashes over."
+	calcSegmentSizeHelp = `Desired size of a single segment in bytes. Minimum 2M. Must be multiple of the sector size. Default 4G.
+In cdc segmentation it is the average chunk size, a power of two from 4K to 1G. Default 1M.
+May have a case-insensitive multiplier suffix: K (1024), M (1024*1024), G (1024*1024*1024), and T. Example: -s 2G`
+	calcInputHelp           = "Input file or block device to calculate segment hashes over. Use - to read from standard input."
 	calcOutputPrefixHelp    = "Specify prefix to replace default 'Hashes-<inputfile>' prefix."
 	calcHashtypesHelpFormat = "Hash type. At most two hashtypes can be specified. Valid hashtypes are %s."
+	calcBadSectorsHelp      = `What to do with sectors that cannot be read: fail, zero or skip.
+In zero and skip modes unreadable sectors are zero-filled or left out of segment hash, their LBA ranges are written to <prefix>-unreadable.csv,
+and segment lines get extra column with the number of unreadable sectors in the segment, bytes for content-defined chunks.`
+	calcSectorSizeHelp = `Size of a sector in bytes, LBAs in the hashes file are counted in sectors of this size.
+Must be a power of two from 512 to 2M. Defaults to the logical sector size of a block device or 512.`
+	calcSegmentationHelp = `How input is split into segments: fixed, partitions or cdc. In partitions mode MBR or GPT partition table is read,
+segments are aligned to partitions and gaps between them, and segment lines get extra column with the partition number.
+In cdc mode segments are content-defined chunks from a quarter to eight average sizes long, cut where a rolling hash
+of the data matches, so data shifted by insertions still gives equal chunks. LBAs of chunks are byte offsets.`
+	calcStatsHelp = `Add content statistics columns to segment lines: zero (1 if all bytes are zero), entropy (Shannon entropy in bits per byte)
+and compressibility (percent of sampled data saved by deflate compression). Totals are summarized in the final report.`
+	calcRetriesHelp   = "Number of read retries of a failing sector. A failing area is read by smaller parts down to a single sector."
+	calcTeeHelp       = "Write a raw image copy of the input to specified file while calculating segment hashes."
+	calcTeeVerifyHelp = `Re-read the image copy written with --tee and verify it against calculated segment hashes.
+Process exit code is set like for verify command.`
 
 	// verify command constants
 	verifyHelp = `Verify existing input file against existing csv file with segment hashes and write diffs to file Diffs-<hashfile>.csv if found.
 Process exit code is set to 255 if any errors are encountered. Otherwise, it equals to the amount of found different segments.
 If the number of mismatches is over 254, exit code remains 254 anyway.`
 	verifyDiffOutputHelp = "Alternative file name for diff file."
-	verifyInputHelp      = "Input file to verify segment hashes over."
+	verifyDiffFormatHelp = `Diff file format: csv or json. Diff ranges are annotated with partition number, type, name and byte offset
+within the partition when the partition table is recorded in the hashes file or found in the input.`
+	verifyInputHelp = `Input file or block device to verify segment hashes over. Use - to read from standard input,
+in this case segments in the hashes file must be sorted by LBA.`
 	verifyHashesFileHelp = "Existing csv files with segment hashes."
+	verifySectorSizeHelp = `Expected sector size of the hashes file. LBAs are interpreted in sectors of size recorded in the hashes file,
+verification is refused if it differs from the specified one.`
+
+	// locate command constants
+	locateHelp = `Find files, directories and file system metadata occupying different LBA ranges listed in a diff file
+and write them to Locations-<difffile>.csv. Partitions with FAT12/16/32, exFAT and ext2/3/4 file systems are supported.`
+	locateInputHelp      = "Image file or block device which different ranges are located in."
+	locateDiffFileHelp   = "Diff file written by verify command, in csv or json format."
+	locateOutputHelp     = "Alternative file name for locations file."
+	locateSectorSizeHelp = "Size of a sector in bytes LBAs of the diff file are counted in. Defaults to the size recorded in the diff file or 512."
+
+	// compare command constants
+	compareHelp = `Match segments of two hashes files by their hashes regardless of position and write them to Compare-<secondhashfile>.csv.
+Segments of the second file are matched at the same offset, moved or added, segments of the first file missing in the second are removed.
+Use hashes files calculated with cdc segmentation to find data shifted between images.
+Process exit code equals to the number of added and removed segments, at most 254, or 255 on errors.`
+	compareFirstHelp  = "Hashes file of the original image."
+	compareSecondHelp = "Hashes file of the changed image."
+	compareOutputHelp = "Alternative file name for comparison file."
+
+	// validate command constants
+	validateHelp = `Validate the hash chain of a chain-of-custody journal written with --journal. The chain is not keyed, so entries
+edited with the chain recomputed and removal of the last entries cannot be detected, compare the printed last entry hash
+with a copy kept elsewhere.
+Process exit code is 0 if the journal is valid, 1 if it is broken or recorded output files are changed, 255 on errors.`
+	validateJournalHelp = "Journal file."
+	validateOutputsHelp = "Also check that output files recorded in the journal exist and their SHA-256 digests are unchanged."
+
+	// bench command constants
+	benchHelp = `Measure hashing throughput of each hash type from memory on a single and all CPU cores, and if input is specified,
+read throughput of the input through page cache and with direct I/O, and throughput of the calc pipeline.
+Report the bottleneck and recommended hash types, reading mode and segment size.`
+	benchSizeHelp     = "Amount of input data read by each read test. Default 1G."
+	benchInputHelp    = "Input file or block device to measure reading of."
+	benchHashtypeHelp = "Hash types of the calc pipeline test, at most two. Default md5."
+
+	// common flags constants
+	directIOHelp = `Read input with direct I/O bypassing the page cache, so hashing does not evict cached data
+and media errors are not masked by cached data. Falls back to regular reading if not supported.`
+	asHelpFormat = `Format to read input file in: %s. By default the format is detected by the file content,
+image containers are read as the data stored in them.`
+	progressHelp = `Progress output: bar, jsonl or none. In jsonl mode a JSON object per line is written: progress events each second
+with bytes done, total, rate, ETA, current segment, mismatches and warnings so far, warning events as they happen and a final summary event
+with an error field if the command fails. With none the final report is printed only.`
+	progressFdHelp = "File descriptor jsonl progress events are written to. Default 2 (stderr)."
+	journalHelp    = `Append a chain-of-custody entry to the specified journal file: operator, case number, evidence ID, host, command,
+input identity, start and finish time, result and SHA-256 digests of output files. Entries are hash-chained, see validate command.
+The command fails if its entry cannot be written.`
+	rateLimitHelp = `Limit read rate in bytes per second, e.g. 50M. May have a case-insensitive multiplier suffix like segment size.
+Default 0, unlimited.`
+	rateControlHelp = `Control file the read rate limit is re-read from each second while running, e.g. 'echo 20M > file' changes it.
+0 in the file removes the limit, missing file or invalid content leaves it unchanged.`
+	lowPriorityHelp = "Run with idle I/O priority and the lowest CPU priority (Linux)."
+	operatorHelp    = "Operator name recorded in the journal. Defaults to the current user name."
+	caseHelp        = "Case number recorded in the journal."
+	evidenceHelp    = "Evidence ID recorded in the journal."
+	yesHelp         = "Read files which look like image containers in unsupported formats as raw data without asking for confirmation."
 )
 
 type calcArgs struct {
 	segmentSize      int64
+	sectorSize       int64
+	segmentation     string
 	input            inputFile
 	hashNames        []string
 	createOutputFile func(name string) outputFile
 	delimiter        rune
+	badSectors       badSectorsMode
+	retries          int
+	directIO         bool
+	tee              outputFile
+	teeVerify        bool
+	createTeeDiffs   func(name string) outputFile // diff file of the image copy verification
+	contentStats     bool
+	progress         progressOptions
+	limits           ioLimits
 }
 
 type verifyArgs struct {
 	input              inputFile
 	createOutputFile   func() outputFile
 	segmentHashesInput inputFile
+	sectorSize         int64
+	diffFormat         string
+	directIO           bool
+	progress           progressOptions
+	limits             ioLimits
+}
+
+type locateArgs struct {
+	input            inputFile
+	diffInput        inputFile
+	sectorSize       int64
+	createOutputFile func() outputFile
+}
+
+type benchArgs struct {
+	input     inputFile // nil if only hashing is measured
+	size      int64     // input bytes read by each read test
+	hashNames []string  // hashes of the calc pipeline test
+}
+
+type validateArgs struct {
+	journalPath  string
+	checkOutputs bool
+}
+
+type compareArgs struct {
+	first            inputFile
+	second           inputFile
+	createOutputFile func() outputFile
+}
+
+// commandArgs holds arguments of the command given on command line,
+// only one of the fields is set.
+type commandArgs struct {
+	calc     *calcArgs
+	verify   *verifyArgs
+	locate   *locateArgs
+	compare  *compareArgs
+	validate *validateArgs
+	bench    *benchArgs
+	journal  *journal // records calc and verify runs if set
 }
 
 type strictBytesValue int64
@@ -90,102 +220,367 @@ func getCalcHashtypesHelpString() string {
 	return fmt.Sprintf(calcHashtypesHelpFormat, strings.Join([]string{md5Name, sha1Name, sha224Name, sha256Name, sha384Name, sha512Name}, ", "))
 }
 
-func parseArgs() (*calcArgs, *verifyArgs) {
+func getAsHelpString() string {
+	return fmt.Sprintf(asHelpFormat, strings.Join(formatNames(), ", "))
+}
+
+func parseArgs() commandArgs {
 	app := kingpin.New("seghash", segmenthashHelp)
 	app.Version(version)
 	app.VersionFlag.Short('v')
 	app.HelpFlag.Short('h')
 
 	calc := app.Command("calc", calcHelp)
-	calcSegmentSize := strictBytes(calc.Flag("segmentsize", calcSegmentSizeHelp).Short('s').Default("4G"))
+	calcSegmentSize := strictBytes(calc.Flag("segmentsize", calcSegmentSizeHelp).Short('s'))
+	calcSectorSize := strictBytes(calc.Flag("sectorsize", calcSectorSizeHelp).Short('l'))
+	calcSegmentation := calc.Flag("segmentation", calcSegmentationHelp).Default(segmentationFixed).Enum(segmentationFixed, segmentationPartitions, segmentationCDC)
 	calcOutputPrefix := calc.Flag("opref", calcOutputPrefixHelp).Short('o').String()
-	calcInput := calc.Arg("inputfile", calcInputHelp).Required().File()
+	calcBadSectors := calc.Flag("badsectors", calcBadSectorsHelp).Short('b').Default("fail").Enum("fail", "zero", "skip")
+	calcStats := calc.Flag("stats", calcStatsHelp).Bool()
+	calcRetries := calc.Flag("retries", calcRetriesHelp).Short('r').Default("3").Int()
+	calcDirectIO := calc.Flag("direct", directIOHelp).Bool()
+	calcTee := calc.Flag("tee", calcTeeHelp).Short('t').String()
+	calcTeeVerify := calc.Flag("tee-verify", calcTeeVerifyHelp).Bool()
+	calcProgress := calc.Flag("progress", progressHelp).Default(progressBar).Enum(progressBar, progressJSONL, progressNone)
+	calcProgressFd := calc.Flag("progress-fd", progressFdHelp).Default("2").Int()
+	calcLimits := limitFlags(calc)
+	calcJournal := journalFlags(calc)
+	calcAs := calc.Flag("as", getAsHelpString()).Default(formatAuto).Enum(formatNames()...)
+	calcYes := calc.Flag("yes", yesHelp).Short('y').Bool()
+	calcInput := calc.Arg("inputfile", calcInputHelp).Required().String()
 	calcHashNames := calc.Arg("hashtype", getCalcHashtypesHelpString()).Required().Strings()
 
 	verify := app.Command("verify", verifyHelp)
 	verifyDiffOutputFname := verify.Flag("diffname", verifyDiffOutputHelp).Short('d').String()
-	verifyInput := verify.Arg("inputfile", verifyInputHelp).Required().File()
-	verifyHashesFile := verify.Arg("hashfile", verifyHashesFileHelp).Required().File()
+	verifyDiffFormat := verify.Flag("diffformat", verifyDiffFormatHelp).Default(diffFormatCSV).Enum(diffFormatCSV, diffFormatJSON)
+	verifySectorSize := strictBytes(verify.Flag("sectorsize", verifySectorSizeHelp).Short('l'))
+	verifyDirectIO := verify.Flag("direct", directIOHelp).Bool()
+	verifyProgress := verify.Flag("progress", progressHelp).Default(progressBar).Enum(progressBar, progressJSONL, progressNone)
+	verifyProgressFd := verify.Flag("progress-fd", progressFdHelp).Default("2").Int()
+	verifyLimits := limitFlags(verify)
+	verifyJournal := journalFlags(verify)
+	verifyAs := verify.Flag("as", getAsHelpString()).Default(formatAuto).Enum(formatNames()...)
+	verifyYes := verify.Flag("yes", yesHelp).Short('y').Bool()
+	verifyInput := verify.Arg("inputfile", verifyInputHelp).Required().String()
+	verifyHashesFile := verify.Arg("hashfile", verifyHashesFileHelp).Required().String()
+
+	locate := app.Command("locate", locateHelp)
+	locateOutputFname := locate.Flag("output", locateOutputHelp).Short('o').String()
+	locateSectorSize := strictBytes(locate.Flag("sectorsize", locateSectorSizeHelp).Short('l'))
+	locateAs := locate.Flag("as", getAsHelpString()).Default(formatAuto).Enum(formatNames()...)
+	locateYes := locate.Flag("yes", yesHelp).Short('y').Bool()
+	locateInput := locate.Arg("inputfile", locateInputHelp).Required().String()
+	locateDiffFile := locate.Arg("difffile", locateDiffFileHelp).Required().File()
+
+	compare := app.Command("compare", compareHelp)
+	compareOutputFname := compare.Flag("output", compareOutputHelp).Short('o').String()
+	compareFirst := compare.Arg("firsthashfile", compareFirstHelp).Required().File()
+	compareSecond := compare.Arg("secondhashfile", compareSecondHelp).Required().File()
+
+	validate := app.Command("validate", validateHelp)
+	validateOutputs := validate.Flag("outputs", validateOutputsHelp).Bool()
+	validateJournal := validate.Arg("journalfile", validateJournalHelp).Required().ExistingFile()
 
-	cmd, err := app.Parse(os.Args[1:])
+	benchCmd := app.Command("bench", benchHelp)
+	benchSize := strictBytes(benchCmd.Flag("size", benchSizeHelp).Short('n'))
+	benchAs := benchCmd.Flag("as", getAsHelpString()).Default(formatAuto).Enum(formatNames()...)
+	benchYes := benchCmd.Flag("yes", yesHelp).Short('y').Bool()
+	benchInput := benchCmd.Arg("inputfile", benchInputHelp).String()
+	benchHashNames := benchCmd.Arg("hashtype", benchHashtypeHelp).Strings()
+
+	cmd, err := app.Parse(replaceStdinName(app, os.Args[1:]))
 	if err != nil {
 		fatalf("%s, try --help", err)
 	}
 	switch cmd {
 
 	case calc.FullCommand():
+		progress := openProgressOutput(*calcProgress, *calcProgressFd, "calc")
+		input := openInputFile(*calcInput, inputOptions{format: *calcAs, yes: *calcYes})
 		checkHashNames(*calcHashNames)
-		checkSegmentSize(*calcSegmentSize)
+		if *calcSectorSize == 0 {
+			*calcSectorSize = defaultSectorSize
+			if sizer, ok := input.(sectorSizer); ok {
+				if logical, _ := sizer.sectorSizes(); logical > 0 {
+					*calcSectorSize = logical
+				}
+			}
+		}
+		checkSectorSize(*calcSectorSize)
+		if *calcSegmentation == segmentationCDC {
+			if *calcSegmentSize == 0 {
+				*calcSegmentSize = defaultCDCAverageSize
+			}
+			checkCDCAverageSize(*calcSegmentSize)
+			if badSectorsModes[*calcBadSectors] == badSectorsSkip {
+				fatal("content-defined chunks cannot be found when unreadable sectors are skipped, use zero mode.")
+			}
+		} else {
+			if *calcSegmentSize == 0 {
+				*calcSegmentSize = defaultSegmentSize
+			}
+			checkSegmentSize(*calcSegmentSize, *calcSectorSize)
+		}
+		checkRetries(*calcRetries)
 
 		if calcOutputPrefix == nil || *calcOutputPrefix == "" {
-			*calcOutputPrefix = "Hashes-" + filepath.Base((*calcInput).Name())
+			*calcOutputPrefix = "Hashes-" + filepath.Base(input.Name())
 		} else {
 			checkDirPathExistence(*calcOutputPrefix)
 		}
 
-		fileIsNonEmptyFile(
-			*calcInput,
-			"<inputfile>",
-			"cannot calculate segment hashes over directories.",
-			"cannot calculate segment hashes over empty files.")
+		if isStream(input) {
+			if badSectorsModes[*calcBadSectors] != badSectorsFail {
+				fatal("bad sectors cannot be tolerated when reading a stream.")
+			}
+			if *calcSegmentation == segmentationPartitions {
+				fatal("partition table cannot be read from a stream, use fixed segmentation.")
+			}
+		} else {
+			fileIsNonEmptyFile(
+				input,
+				"<inputfile>",
+				"cannot calculate segment hashes over directories.",
+				"cannot calculate segment hashes over empty files.")
+		}
 
-		checkForensicFileExtensions(*calcInput)
+		var tee outputFile
+		if *calcTee != "" {
+			checkTeeFile(input, *calcTee, badSectorsModes[*calcBadSectors])
+			f, err := os.Create(*calcTee)
+			checkErr(err)
+			tee = f
+		} else if *calcTeeVerify {
+			fatal("--tee-verify requires --tee.")
+		}
 
-		return &calcArgs{
-			segmentSize: *calcSegmentSize,
-			hashNames:   distinct(*calcHashNames),
-			input:       *calcInput,
+		journal := openJournal(*calcJournal, "calc", input)
+		if tee != nil {
+			journal.image(tee.Name())
+		}
+		return commandArgs{journal: journal, calc: &calcArgs{
+			segmentSize:  *calcSegmentSize,
+			sectorSize:   *calcSectorSize,
+			segmentation: *calcSegmentation,
+			hashNames:    distinct(*calcHashNames),
+			input:        input,
+			badSectors:   badSectorsModes[*calcBadSectors],
+			retries:      *calcRetries,
+			directIO:     *calcDirectIO,
+			tee:          tee,
+			teeVerify:    *calcTeeVerify,
+			contentStats: *calcStats,
+			progress:     progress,
+			limits:       *calcLimits,
 			createOutputFile: func(name string) outputFile {
-				f, err := os.Create(*calcOutputPrefix + "-" + name)
-				lnCheckErr(err)
-				return f
+				return journal.output(func() outputFile {
+					f, err := os.Create(*calcOutputPrefix + "-" + name)
+					lnCheckErr(err)
+					return f
+				})()
 			},
-		}, nil
+			createTeeDiffs: func(name string) outputFile {
+				return journal.output(func() outputFile {
+					f, err := os.Create(name)
+					lnCheckErr(err)
+					return f
+				})()
+			},
+		}}
 
 	case verify.FullCommand():
+		progress := openProgressOutput(*verifyProgress, *verifyProgressFd, "verify")
+		input := openInputFile(*verifyInput, inputOptions{format: *verifyAs, yes: *verifyYes})
+		hashesFile, err := os.Open(*verifyHashesFile)
+		checkErr(err)
 		if verifyDiffOutputFname == nil || *verifyDiffOutputFname == "" {
-			*verifyDiffOutputFname = "Diffs-" + filepath.Base(filenameWithoutExtension(*verifyHashesFile))
+			*verifyDiffOutputFname = "Diffs-" + filepath.Base(filenameWithoutExtension(hashesFile))
 		} else {
 			checkFileCreation(*verifyDiffOutputFname)
 		}
 
-		*verifyDiffOutputFname = checkDiffFileExtension(*verifyDiffOutputFname)
+		*verifyDiffOutputFname = checkDiffFileExtension(*verifyDiffOutputFname, "."+*verifyDiffFormat)
+
+		if !isStream(input) {
+			fileIsNonEmptyFile(
+				input,
+				"<inputfile>",
+				"cannot verify segment hashes against directories.",
+				"cannot verify segment hashes against empty files.")
+		}
 
 		fileIsNonEmptyFile(
-			*verifyInput,
-			"<inputfile>",
+			hashesFile,
+			"<hashfile>",
 			"cannot verify segment hashes against directories.",
 			"cannot verify segment hashes against empty files.")
 
-		checkForensicFileExtensions(*verifyInput)
+		fileHasRightStructure(hashesFile, "file with segment hashes is invalid")
+		if *verifySectorSize != 0 {
+			checkSectorSize(*verifySectorSize)
+		}
+
+		journal := openJournal(*verifyJournal, "verify", input)
+		return commandArgs{journal: journal, verify: &verifyArgs{
+			input: input,
+			createOutputFile: journal.output(func() outputFile {
+				f, err := os.Create(*verifyDiffOutputFname)
+				lnCheckErr(err)
+				return f
+			}),
+			segmentHashesInput: hashesFile,
+			sectorSize:         *verifySectorSize,
+			diffFormat:         *verifyDiffFormat,
+			directIO:           *verifyDirectIO,
+			progress:           progress,
+			limits:             *verifyLimits,
+		}}
 
+	case locate.FullCommand():
+		input := openInputFile(*locateInput, inputOptions{format: *locateAs, yes: *locateYes})
+		if isStream(input) {
+			fatal("file systems cannot be walked in a stream.")
+		}
 		fileIsNonEmptyFile(
-			*verifyHashesFile,
-			"<hashfile>",
-			"cannot verify segment hashes against directories.",
-			"cannot verify segment hashes against empty files.")
+			input,
+			"<inputfile>",
+			"cannot locate ranges in directories.",
+			"cannot locate ranges in empty files.")
+		fileIsNonEmptyFile(
+			*locateDiffFile,
+			"<difffile>",
+			"cannot read diff ranges from directories.",
+			"cannot read diff ranges from empty files.")
+		if *locateSectorSize != 0 {
+			checkSectorSize(*locateSectorSize)
+		}
+		if *locateOutputFname == "" {
+			*locateOutputFname = "Locations-" + filepath.Base(filenameWithoutExtension(*locateDiffFile)) + ".csv"
+		} else {
+			checkFileCreation(*locateOutputFname)
+		}
+
+		return commandArgs{locate: &locateArgs{
+			input:      input,
+			diffInput:  *locateDiffFile,
+			sectorSize: *locateSectorSize,
+			createOutputFile: func() outputFile {
+				f, err := os.Create(*locateOutputFname)
+				lnCheckErr(err)
+				return f
+			},
+		}}
 
-		fileHasRightStructure(*verifyHashesFile, "file with segment hashes is invalid")
+	case compare.FullCommand():
+		for _, hashes := range []*os.File{*compareFirst, *compareSecond} {
+			fileIsNonEmptyFile(
+				hashes,
+				"<hashfile>",
+				"cannot compare segment hashes of directories.",
+				"cannot compare segment hashes of empty files.")
+			fileHasRightStructure(hashes, "file with segment hashes is invalid")
+		}
+		if *compareOutputFname == "" {
+			*compareOutputFname = "Compare-" + filepath.Base(filenameWithoutExtension(*compareSecond)) + ".csv"
+		} else {
+			checkFileCreation(*compareOutputFname)
+		}
 
-		return nil, &verifyArgs{
-			input: *verifyInput,
+		return commandArgs{compare: &compareArgs{
+			first:  *compareFirst,
+			second: *compareSecond,
 			createOutputFile: func() outputFile {
-				f, err := os.Create(*verifyDiffOutputFname)
+				f, err := os.Create(*compareOutputFname)
 				lnCheckErr(err)
 				return f
 			},
-			segmentHashesInput: *verifyHashesFile,
+		}}
+	case benchCmd.FullCommand():
+		args := &benchArgs{size: *benchSize, hashNames: distinct(*benchHashNames)}
+		if args.size == 0 {
+			args.size = defaultBenchSize
+		}
+		if len(args.hashNames) == 0 {
+			args.hashNames = []string{md5Name}
 		}
+		checkHashNames(args.hashNames)
+		if *benchInput != "" {
+			args.input = openInputFile(*benchInput, inputOptions{format: *benchAs, yes: *benchYes})
+			if isStream(args.input) {
+				fatal("reading of a stream cannot be measured repeatedly, specify a file or block device.")
+			}
+			fileIsNonEmptyFile(
+				args.input,
+				"<inputfile>",
+				"cannot measure reading of directories.",
+				"cannot measure reading of empty files.")
+		}
+		return commandArgs{bench: args}
+
+	case validate.FullCommand():
+		return commandArgs{validate: &validateArgs{journalPath: *validateJournal, checkOutputs: *validateOutputs}}
 	}
 
-	return nil, nil
+	return commandArgs{}
 }
 
-func finalizeArgs(calcArgs *calcArgs, verifyArgs *verifyArgs) {
-	if calcArgs != nil {
-		calcArgs.input.Close()
-	} else if verifyArgs != nil {
-		verifyArgs.input.Close()
-		verifyArgs.segmentHashesInput.Close()
+// limitFlags adds read rate and priority flags to the command
+func limitFlags(cmd *kingpin.CmdClause) *ioLimits {
+	limits := &ioLimits{}
+	cmd.Flag("ratelimit", rateLimitHelp).SetValue((*strictBytesValue)(&limits.rate))
+	cmd.Flag("ratelimit-file", rateControlHelp).StringVar(&limits.controlFile)
+	cmd.Flag("lowpriority", lowPriorityHelp).BoolVar(&limits.lowPriority)
+	return limits
+}
+
+// journalFlags adds chain-of-custody journal flags to the command
+func journalFlags(cmd *kingpin.CmdClause) *journalOptions {
+	opts := &journalOptions{}
+	cmd.Flag("journal", journalHelp).StringVar(&opts.path)
+	cmd.Flag("operator", operatorHelp).StringVar(&opts.operator)
+	cmd.Flag("case", caseHelp).StringVar(&opts.caseNumber)
+	cmd.Flag("evidence", evidenceHelp).StringVar(&opts.evidenceID)
+	return opts
+}
+
+// openProgressOutput opens the file descriptor jsonl progress is written to.
+// It is called before other arguments are checked, so their errors are
+// reported in the summary event.
+func openProgressOutput(format string, fd int, command string) progressOptions {
+	opts := progressOptions{format: format}
+	if format != progressJSONL {
+		return opts
+	}
+	if fd < 0 {
+		fatal("progress file descriptor cannot be negative.")
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if _, err := f.Stat(); err != nil {
+		fatalf("cannot write progress to file descriptor %d: %v", fd, err)
+	}
+	// Writes to stderr closed by the consumer would kill the command
+	signal.Ignore(syscall.SIGPIPE)
+	opts.output = f
+	writeFailureSummary(&opts, command)
+	return opts
+}
+
+func finalizeArgs(args commandArgs) {
+	if args.calc != nil {
+		args.calc.input.Close()
+		if args.calc.tee != nil {
+			args.calc.tee.Close()
+		}
+	} else if args.verify != nil {
+		args.verify.input.Close()
+		args.verify.segmentHashesInput.Close()
+	} else if args.locate != nil {
+		args.locate.input.Close()
+		args.locate.diffInput.Close()
+	} else if args.bench != nil && args.bench.input != nil {
+		args.bench.input.Close()
+	} else if args.compare != nil {
+		args.compare.first.Close()
+		args.compare.second.Close()
 	}
 }
@@ -4,14 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 )
 
 const (
 	minSegmentSize       = 2 * 1024 * 1024
 	maxHashesToCalculate = 2
-	sectorSize           = 512
+	defaultSectorSize    = 512
 )
 
 func distinct(names []string) []string {
@@ -50,12 +49,45 @@ func checkHashNames(hashNames []string) {
 	}
 }
 
-func checkSegmentSize(segmentSize int64) {
+func checkSegmentSize(segmentSize, sectorSize int64) {
 	if segmentSize < minSegmentSize {
 		fatal("segment size is less then 2M")
 	}
-	if (segmentSize % int64(sectorSize)) != 0 {
-		fatal("segment size is not a multiple of 512.")
+	if (segmentSize % sectorSize) != 0 {
+		fatalf("segment size is not a multiple of %d.", sectorSize)
+	}
+}
+
+func checkCDCAverageSize(averageSize int64) {
+	if averageSize < minCDCAverageSize || averageSize > maxCDCAverageSize || averageSize&(averageSize-1) != 0 {
+		fatal("average chunk size must be a power of two from 4K to 1G.")
+	}
+}
+
+func checkSectorSize(sectorSize int64) {
+	if sectorSize < defaultSectorSize || sectorSize > minSegmentSize || sectorSize&(sectorSize-1) != 0 {
+		fatal("sector size must be a power of two from 512 to 2M.")
+	}
+}
+
+func checkRetries(retries int) {
+	if retries < 0 {
+		fatal("retries count cannot be negative.")
+	}
+}
+
+func checkTeeFile(input inputFile, teeName string, badSectors badSectorsMode) {
+	if badSectors == badSectorsSkip {
+		fatal("image copy cannot be written when unreadable sectors are skipped, use zero mode.")
+	}
+	teeInfo, err := os.Stat(teeName)
+	if err != nil {
+		return
+	}
+	inputInfo, err := input.Stat()
+	checkErr(err)
+	if os.SameFile(teeInfo, inputInfo) {
+		fatal("image copy cannot be written over <inputfile>.")
 	}
 }
 
@@ -93,58 +125,10 @@ func fileHasRightStructure(f inputFile, errorStr string) {
 	f.Seek(0, 0)
 }
 
-func checkForensicFileExtensions(f inputFile) {
-	if hasForensicContainerFileExtensions(f) {
-		question := fmt.Sprintf("File %s will be interpreted as a raw file. Do you want to continue?", filepath.Base(f.Name()))
-		if askForConfirmation(question) {
-			return
-		}
-
-		os.Exit(0)
-	}
-}
-
-func hasForensicContainerFileExtensions(f inputFile) bool {
-	extension := filepath.Ext(f.Name())
-	if len(extension) < 3 {
-		return false
-	}
-
-	// remove '.' from extension and convert to Upper case
-	extension = strings.ToUpper(extension[1:])
-
-	if strings.HasPrefix(extension, "EX") ||
-		strings.HasPrefix(extension, "LX") {
-
-		number, err := strconv.Atoi(extension[2:])
-		if err == nil && number > 0 && number < 100 {
-			return true
-		}
-	} else if strings.HasPrefix(extension, "E") ||
-		strings.HasPrefix(extension, "S") ||
-		strings.HasPrefix(extension, "L") {
-
-		number, err := strconv.Atoi(extension[1:])
-		if err == nil && number > 0 && number < 100 {
-			return true
-		}
-	} else if extension == "AFF" ||
-		extension == "AFM" ||
-		extension == "AFD" ||
-		extension == "AD1" ||
-		extension == "MFS01" ||
-		extension == "AFF4" {
-
-		return true
-	}
-
-	return false
-}
-
-func checkDiffFileExtension(verifyDiffOutputFname string) string {
+func checkDiffFileExtension(verifyDiffOutputFname, diffExtension string) string {
 	extension := strings.ToLower(filepath.Ext(verifyDiffOutputFname))
-	if extension != ".csv" {
-		return verifyDiffOutputFname + ".csv"
+	if extension != diffExtension {
+		return verifyDiffOutputFname + diffExtension
 	}
 
 	return verifyDiffOutputFname
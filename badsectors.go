@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+type badSectorsMode int
+
+const (
+	badSectorsFail badSectorsMode = iota
+	badSectorsZero
+	badSectorsSkip
+)
+
+var badSectorsModes = map[string]badSectorsMode{
+	"fail": badSectorsFail,
+	"zero": badSectorsZero,
+	"skip": badSectorsSkip,
+}
+
+// readOptions tunes the way readFile treats the input
+type readOptions struct {
+	badSectors badSectorsMode
+	retries    int
+	sectorSize int64
+	errorMap   *errorMap
+	directIO   bool
+	eof        chan struct{} // closed when stream input is read to the end
+	limiter    *rateLimiter
+	readHoles  bool // holes of sparse files are read, not skipped
+}
+
+// errorMap collects unreadable ranges and writes them as LBA ranges to
+// a csv file. The file is created when the first unreadable sector is found.
+type errorMap struct {
+	createOutput func() outputFile
+	out          outputFile
+	csvWriter    *csv.Writer
+	pending      readRange
+	sectorSize   int64
+	sectors      int64
+	warning      func(message string) // reports unreadable ranges if set
+}
+
+func (m *errorMap) add(ranges []readRange) {
+	if m == nil {
+		return
+	}
+	for _, r := range ranges {
+		startLba, lastLba := bytesToSectors(r.start, r.length, m.sectorSize)
+		m.sectors += lastLba - startLba + 1
+		if m.warning != nil {
+			m.warning(fmt.Sprintf("unreadable LBA range (%d, %d)", startLba, lastLba))
+		}
+		if m.pending.length > 0 && m.pending.start+m.pending.length == r.start {
+			m.pending.length += r.length
+			continue
+		}
+		m.flush()
+		m.pending = r
+	}
+}
+
+func (m *errorMap) flush() {
+	if m.pending.length == 0 {
+		return
+	}
+	if m.csvWriter == nil {
+		m.out = m.createOutput()
+		m.csvWriter = createCsvWriter(m.out)
+	}
+	startLba, endLba := bytesToSectors(m.pending.start, m.pending.length, m.sectorSize)
+	writeDiffLine(m.csvWriter, startLba, endLba)
+	m.pending = readRange{}
+}
+
+// close writes the last collected range and returns the name of error map
+// file. Empty name is returned if all sectors were read.
+func (m *errorMap) close() string {
+	if m == nil {
+		return ""
+	}
+	m.flush()
+	if m.out == nil {
+		return ""
+	}
+	m.out.Close()
+	return m.out.Name()
+}
+
+// readTolerant fills buf with data starting at offset. The failing area is
+// split in halves down to a single sector, a failed read of a single sector is
+// retried. Sectors which still cannot be read are zero-filled and appended to
+// unreadable.
+func readTolerant(input io.ReadSeeker, buf []byte, offset int64, retries, sectorSize int, unreadable *[]readRange) (n int, eof bool) {
+	attempts := 1
+	if len(buf) <= sectorSize {
+		attempts += retries
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		n, err = readAt(input, buf, offset)
+		if err == nil {
+			return n, false
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, true
+		}
+	}
+
+	if len(buf) <= sectorSize {
+		for i := range buf {
+			buf[i] = 0
+		}
+		*unreadable = append(*unreadable, readRange{start: offset, length: int64(len(buf))})
+		return len(buf), false
+	}
+
+	half := (len(buf)/2 + sectorSize - 1) / sectorSize * sectorSize
+	n, eof = readTolerant(input, buf[:half], offset, retries, sectorSize, unreadable)
+	if eof {
+		return n, eof
+	}
+	m, eof := readTolerant(input, buf[half:], offset+int64(half), retries, sectorSize, unreadable)
+	return n + m, eof
+}
+
+// unreadableChunk makes a chunk of data with unreadable ranges in it.
+// In skip mode unreadable ranges are cut out of the chunk data.
+func unreadableChunk(data []byte, offset int64, unreadable []readRange, skip bool) segmentChunk {
+	chunk := segmentChunk{data: data}
+	for _, r := range unreadable {
+		chunk.unreadable += r.length
+	}
+	if !skip {
+		for _, r := range unreadable {
+			chunk.unreadableRanges = append(chunk.unreadableRanges, readRange{start: r.start - offset, length: r.length})
+		}
+		return chunk
+	}
+
+	kept := 0
+	pos := int64(0)
+	for _, r := range unreadable {
+		kept += copy(data[kept:], data[pos:r.start-offset])
+		pos = r.start - offset + r.length
+	}
+	kept += copy(data[kept:], data[pos:])
+	chunk.data = data[:kept]
+	chunk.skipped = chunk.unreadable
+	return chunk
+}
+
+// unreadableIn returns the number of zero-filled unreadable bytes of the
+// chunk data from start to end.
+func (c *segmentChunk) unreadableIn(start, end int64) int64 {
+	n := int64(0)
+	for _, r := range c.unreadableRanges {
+		if overlap := minInt64(end, r.start+r.length) - maxInt64(start, r.start); overlap > 0 {
+			n += overlap
+		}
+	}
+	return n
+}
+
+func readAt(input io.ReadSeeker, buf []byte, offset int64) (int, error) {
+	if _, err := input.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(input, buf)
+}
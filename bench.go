@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	benchHashDuration      = time.Second
+	defaultBenchSize       = 1024 * 1024 * 1024
+	benchSegmentReadTime   = 10 * time.Second // recommended segment is read in about this time
+	benchDirectIOAdvantage = 1.1              // direct I/O is recommended if that much faster
+	benchReadShare         = 0.9              // pipeline slower than that share of reading is held up by hashing
+)
+
+type hashThroughput struct {
+	name       string
+	singleCore float64 // bytes per second
+	multiCore  float64
+}
+
+// bench measures throughput of hashing from memory, reading the input
+// and the calc pipeline, and recommends settings for this hardware.
+func bench(args *benchArgs) {
+	fmt.Printf("Hashing %s blocks from memory for %v per hash type. CPU cores: %d.\n", formatBytes(bufferSize), benchHashDuration, runtime.NumCPU())
+	names := []string{md5Name, sha1Name, sha224Name, sha256Name, sha384Name, sha512Name}
+	hashes := make([]hashThroughput, len(names))
+	for i, name := range names {
+		hashes[i] = hashThroughput{name: name, singleCore: benchHash(name, 1), multiCore: benchHash(name, runtime.NumCPU())}
+		fmt.Printf("  %-7s single core: %s, all cores: %s\n", name, formatRate(hashes[i].singleCore), formatRate(hashes[i].multiCore))
+	}
+	if args.input == nil {
+		fmt.Println(recommendHashes(hashes, 0))
+		return
+	}
+
+	size := minInt64(args.size, fileSize(args.input))
+	fmt.Printf("Reading %s of %s.\n", formatBytes(size), describeInput(args.input))
+	// Holes of sparse files are read, skipping them would overstate the read rate
+	readRate := benchRead(args.input, size, readOptions{readHoles: true})
+	fmt.Printf("  Read through page cache: %s\n", formatRate(readRate))
+	directIO := false
+	if enableDirectIO(args.input) {
+		directRate := benchRead(args.input, size, readOptions{directIO: true, readHoles: true})
+		checkErr(setDirectIO(args.input, false))
+		fmt.Printf("  Direct read: %s\n", formatRate(directRate))
+		if directRate > readRate*benchDirectIOAdvantage {
+			directIO, readRate = true, directRate
+		}
+	}
+
+	pipelineRate := benchPipeline(args.input, size, args.hashNames, readOptions{directIO: directIO, readHoles: true})
+	fmt.Printf("  calc pipeline with %s: %s\n", strings.Join(args.hashNames, ", "), formatRate(pipelineRate))
+
+	fmt.Println("Bottleneck and recommendations:")
+	slowest := hashThroughput{singleCore: -1}
+	for _, h := range hashes {
+		if contains(args.hashNames, h.name) && (slowest.singleCore < 0 || h.singleCore < slowest.singleCore) {
+			slowest = h
+		}
+	}
+	// The pipeline keeps up with reading unless hashing holds it up. Each
+	// hash type is calculated by a single goroutine, the slowest one is named.
+	if pipelineRate < readRate*benchReadShare {
+		fmt.Printf("  Hashing is the bottleneck: calc pipeline runs at %s, input is read at %s, %s is calculated at %s.\n",
+			formatRate(pipelineRate), formatRate(readRate), slowest.name, formatRate(slowest.singleCore))
+	} else {
+		fmt.Printf("  Reading is the bottleneck: calc pipeline runs at %s, input is read at %s.\n",
+			formatRate(pipelineRate), formatRate(readRate))
+	}
+	fmt.Println(recommendHashes(hashes, readRate))
+	if directIO {
+		fmt.Println("  Use --direct, direct reading is faster on this input.")
+	}
+	fmt.Printf("  Segment size: %s, a segment is read in about %v.\n", formatBytes(recommendSegmentSize(pipelineRate)), benchSegmentReadTime)
+}
+
+// benchHash returns bytes per second hashed by the number of goroutines
+func benchHash(name string, goroutines int) float64 {
+	data := make([]byte, bufferSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var hashed int64
+	var mutex sync.Mutex
+	wg := sync.WaitGroup{}
+	wg.Add(goroutines)
+	start := time.Now()
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			h := getHashContainersByNames([]string{name})[0].h
+			n := int64(0)
+			for time.Since(start) < benchHashDuration {
+				_, err := h.Write(data)
+				lnCheckErr(err)
+				n += int64(len(data))
+			}
+			mutex.Lock()
+			hashed += n
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	return float64(hashed) / time.Since(start).Seconds()
+}
+
+// benchRead returns bytes per second of reading the beginning of input.
+// Read data is dropped from the page cache, so following tests read it again.
+func benchRead(input inputFile, size int64, opts readOptions) float64 {
+	return benchPipeline(input, size, nil, opts)
+}
+
+// benchPipeline returns bytes per second of reading input and calculating
+// hashes like calc does, only hashes file is not written.
+func benchPipeline(input inputFile, size int64, hashNames []string, opts readOptions) float64 {
+	_, err := input.Seek(0, io.SeekStart)
+	checkErr(err)
+	hashContainers := getHashContainersByNames(hashNames)
+	consumersCount := len(hashContainers)
+	if consumersCount == 0 {
+		consumersCount = 1
+	}
+
+	start := time.Now()
+	segmentChunks := readFile(input, bufferSize, consumersCount, produceReadRanges(bufferSize, size, nil), func(int64) {}, opts)
+	wg := sync.WaitGroup{}
+	wg.Add(consumersCount)
+	for i := range segmentChunks {
+		go func(i int) {
+			defer wg.Done()
+			if len(hashContainers) == 0 {
+				for range segmentChunks[i] {
+				}
+				return
+			}
+			for range calculateHash(hashContainers[i], segmentChunks[i]) {
+			}
+		}(i)
+	}
+	wg.Wait()
+	return float64(size) / time.Since(start).Seconds()
+}
+
+// recommendHashes lists hash types calculated faster than input is read,
+// they do not slow calc down.
+func recommendHashes(hashes []hashThroughput, readRate float64) string {
+	if readRate == 0 {
+		fastest := hashes[0]
+		for _, h := range hashes {
+			if h.singleCore > fastest.singleCore {
+				fastest = h
+			}
+		}
+		return fmt.Sprintf("Fastest hash type on this CPU: %s. Specify input to measure reading and the calc pipeline.", fastest.name)
+	}
+	var free []string
+	for _, h := range hashes {
+		if h.singleCore >= readRate {
+			free = append(free, h.name)
+		}
+	}
+	if len(free) == 0 {
+		return "  No hash type keeps up with reading, calc runs at the speed of the slowest specified hash type."
+	}
+	return fmt.Sprintf("  Hash types not slowing calc down: %s. Up to two of them can be calculated at once.", strings.Join(free, ", "))
+}
+
+// recommendSegmentSize returns power of two segment size read in about
+// benchSegmentReadTime, from the minimum segment size to 4G.
+func recommendSegmentSize(rate float64) int64 {
+	target := int64(rate * benchSegmentReadTime.Seconds())
+	size := int64(minSegmentSize)
+	for size*2 <= target && size*2 <= defaultSegmentSize {
+		size *= 2
+	}
+	return size
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d%s", int64(value), units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+func formatRate(bytesPerSecond float64) string {
+	return fmt.Sprintf("%.0f MB/s", bytesPerSecond/(1024*1024))
+}
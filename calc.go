@@ -7,41 +7,144 @@ import (
 	"sync"
 )
 
+const (
+	segmentationFixed      = "fixed"
+	segmentationPartitions = "partitions"
+	defaultSegmentSize     = 4 * 1024 * 1024 * 1024
+)
+
 func calc(args *calcArgs, showProgress bool) []string {
 	if len(args.hashNames) > 2 {
 		fatal("cannot calculate more than two hashes simultaneously")
 	}
 	hashContainers := getHashContainersByNames(args.hashNames)
 
-	progress, finishProgress := getProgress(showProgress, args.input)
+	progress := getProgress(showProgress, args.progress, args.input, "calc")
+
+	opts := readOptions{badSectors: args.badSectors, retries: args.retries, sectorSize: args.sectorSize, directIO: args.directIO, limiter: args.limits.apply()}
+	format := hashFileFormat{sectorSize: args.sectorSize, content: args.contentStats}
+	if args.badSectors != badSectorsFail {
+		opts.errorMap = &errorMap{sectorSize: args.sectorSize, warning: progress.warning, createOutput: func() outputFile {
+			return args.createOutputFile("unreadable.csv")
+		}}
+		format.unreadable = true
+	}
+	if sizer, ok := args.input.(sectorSizer); ok {
+		format.logicalSectorSize, format.physicalSectorSize = sizer.sectorSizes()
+	}
 
-	readRanges := produceReadRanges(args.segmentSize, fileSize(args.input))
-	segmentChunks := readFile(args.input, bufferSize, len(hashContainers), readRanges, progress)
+	size := fileSize(args.input)
+	if size == unknownSize {
+		opts.eof = make(chan struct{})
+	}
+	if args.segmentation == segmentationCDC {
+		format.sectorSize, format.cdcAverageSize = cdcByteSectorSize, args.segmentSize
+	}
+	// Length of the last segment cannot be told by its LBA range
+	format.exactLength = format.sectorSize > 1 && (size == unknownSize || size%format.sectorSize != 0)
+	var readRanges <-chan readRange
+	if args.segmentation == segmentationPartitions {
+		scheme, partitions, err := readPartitionTable(args.input, args.sectorSize)
+		checkErr(err)
+		areas, err := partitionAreas(partitions, size, args.sectorSize)
+		checkErr(err)
+		_, err = args.input.Seek(0, io.SeekStart)
+		checkErr(err)
+		format.partitionScheme, format.partitions = scheme, partitions
+		readRanges = produceAreaRanges(areas, args.segmentSize)
+	} else if args.segmentation == segmentationCDC {
+		// Input is read through, segments are cut by content
+		readRanges = produceReadRanges(bufferSize, size, opts.eof)
+	} else {
+		readRanges = produceReadRanges(args.segmentSize, size, opts.eof)
+	}
+	readRanges = trackSegments(readRanges, progress, format.sectorSize)
+	var storedHashes map[string][]byte
+	if hasher, ok := args.input.(storedHasher); ok {
+		storedHashes = hasher.storedHashes()
+	}
+
+	consumersCount := len(hashContainers)
+	if args.tee != nil {
+		consumersCount++
+	}
+	if len(storedHashes) > 0 {
+		consumersCount++
+	}
+	segmentChunks := readFile(args.input, bufferSize, consumersCount, readRanges, progress.add, opts)
 
 	outputFilenames := make([]string, len(args.hashNames))
 	wg := sync.WaitGroup{}
-	wg.Add(len(hashContainers))
-	for i, segmentChunk := range segmentChunks {
-		calculatedHashes := calculateHash(hashContainers[i], segmentChunk)
+	wg.Add(consumersCount)
+	otherChunks := segmentChunks[len(hashContainers):]
+	if args.tee != nil {
+		writeImage(args.tee, otherChunks[0], &wg)
+		otherChunks = otherChunks[1:]
+	}
+	var storedHashesMismatched func() []string
+	if len(storedHashes) > 0 {
+		storedHashesMismatched = checkStoredHashes(storedHashes, otherChunks[0], &wg)
+	}
+	var summary *contentSummary
+	if args.contentStats {
+		summary = &contentSummary{}
+	}
+	for i, readChunks := range segmentChunks[:len(hashContainers)] {
+		var chunks <-chan segmentChunk = readChunks
+		if format.cdcAverageSize > 0 {
+			chunks = splitContentDefined(chunks, format.cdcAverageSize)
+		}
+		if args.contentStats {
+			hashContainers[i].stats = newContentStats()
+		}
+		calculatedHashes := calculateHash(hashContainers[i], chunks)
 		out := args.createOutputFile(fmt.Sprintf("%s.csv", hashContainers[i].name))
-		writeFile(out, calculatedHashes, &wg)
+		// Statistics in all hashes files are equal, the first one is summarized
+		var fileSummary *contentSummary
+		if i == 0 {
+			fileSummary = summary
+		}
+		writeFile(out, calculatedHashes, format, fileSummary, &wg)
 		outputFilenames[i] = out.Name()
 	}
 	wg.Wait()
-	finishProgress(fmt.Sprintf("Segment hashes calculated. \nInput file: %s. Output file(s): %s", args.input.Name(), strings.Join(outputFilenames, ", ")))
+	finishStr := fmt.Sprintf("Segment hashes calculated. \nInput file: %s. Output file(s): %s", describeInput(args.input), strings.Join(outputFilenames, ", "))
+	if args.tee != nil {
+		finishStr += fmt.Sprintf("\nImage copy written to %s.", args.tee.Name())
+	}
+	if storedHashesMismatched != nil {
+		if mismatched := storedHashesMismatched(); len(mismatched) > 0 {
+			finishStr += fmt.Sprintf("\nWARNING: image data does not match %s hash(es) stored in the image.", strings.Join(mismatched, ", "))
+		} else {
+			finishStr += "\nImage data matches hash(es) stored in the image."
+		}
+	}
+	if args.contentStats {
+		finishStr += "\n" + summary.String()
+	}
+	if errorMapFname := opts.errorMap.close(); errorMapFname != "" {
+		finishStr += fmt.Sprintf("\nUnreadable sectors: %d. Unreadable LBA ranges written to %s.", opts.errorMap.sectors, errorMapFname)
+	}
+	progress.finish(finishStr)
 	return outputFilenames
 }
 
-func produceReadRanges(segmentSize, fileSize int64) <-chan readRange {
+// produceReadRanges splits input into segments. Ranges of input with
+// unknown size are produced until eof channel is closed.
+func produceReadRanges(segmentSize, fileSize int64, eof <-chan struct{}) <-chan readRange {
 	out := make(chan readRange)
 	go func() {
 		defer close(out)
 
-		for producedBytes := int64(0); producedBytes < fileSize; producedBytes += segmentSize {
-			if fileSize - producedBytes < segmentSize {
-				out <- readRange{start: producedBytes, length: fileSize - producedBytes}
-			} else {
-				out <- readRange{start: producedBytes, length: segmentSize}
+		for producedBytes := int64(0); fileSize == unknownSize || producedBytes < fileSize; producedBytes += segmentSize {
+			r := readRange{start: producedBytes, length: segmentSize}
+			if fileSize != unknownSize && fileSize-producedBytes < segmentSize {
+				r.length = fileSize - producedBytes
+			}
+			select {
+			case out <- r:
+			case <-eof:
+				return
 			}
 		}
 	}()
@@ -49,13 +152,39 @@ func produceReadRanges(segmentSize, fileSize int64) <-chan readRange {
 	return out
 }
 
-func writeFile(output io.Writer, in <-chan segment, wg *sync.WaitGroup) {
+// produceAreaRanges splits each of areas into segments, so no segment
+// crosses an area boundary.
+func produceAreaRanges(areas []readRange, segmentSize int64) <-chan readRange {
+	out := make(chan readRange)
+	go func() {
+		defer close(out)
+
+		for _, area := range areas {
+			for produced := int64(0); produced < area.length; produced += segmentSize {
+				out <- readRange{start: area.start + produced, length: minInt64(segmentSize, area.length-produced)}
+			}
+		}
+	}()
+
+	return out
+}
+
+func writeFile(output io.Writer, in <-chan segment, format hashFileFormat, summary *contentSummary, wg *sync.WaitGroup) {
 	csvWriter := createCsvWriter(output)
 	go func() {
 		defer wg.Done()
 
+		writeMetadata(output, format.metadata())
+
 		for segment := range in {
-			writeSegmentLine(csvWriter, segment)
+			// Stream may end right at the segment boundary
+			if segment.length == 0 {
+				continue
+			}
+			writeSegmentLine(csvWriter, segment, format)
+			if summary != nil {
+				summary.add(segment)
+			}
 		}
 	}()
 }
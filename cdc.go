@@ -0,0 +1,128 @@
+package main
+
+// Content-defined chunking splits data at positions chosen by a rolling hash
+// of the preceding bytes, so data inserted or removed in the middle shifts
+// chunk boundaries along with the data instead of changing every following
+// chunk. Boundaries are found with FastCDC: Gear rolling hash and normalized
+// chunking with a stricter mask before the average size and a looser one after.
+
+const (
+	segmentationCDC = "cdc"
+
+	cdcByteSectorSize     = 1 // chunk LBAs are byte offsets
+	defaultCDCAverageSize = 1024 * 1024
+	minCDCAverageSize     = 4 * 1024
+	maxCDCAverageSize     = 1024 * 1024 * 1024
+	cdcNormalization      = 2
+)
+
+// gearTable holds random values for Gear hash. It is generated by a fixed
+// sequence, since hashes files of different runs must have equal boundaries.
+var gearTable = func() (table [256]uint64) {
+	state := uint64(0)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// cdcSizes returns minimum and maximum chunk size for the average one
+func cdcSizes(averageSize int64) (minSize, maxSize int64) {
+	return averageSize / 4, averageSize * 8
+}
+
+type cdcChunker struct {
+	minSize, averageSize, maxSize int64
+	strictMask, looseMask         uint64
+	hash                          uint64
+	length                        int64 // bytes of the current chunk seen
+}
+
+func newCDCChunker(averageSize int64) *cdcChunker {
+	bits := uint(0)
+	for int64(1)<<(bits+1) <= averageSize {
+		bits++
+	}
+	c := &cdcChunker{averageSize: averageSize}
+	c.minSize, c.maxSize = cdcSizes(averageSize)
+	// Gear hash is shifted left, so its high bits depend on more bytes
+	c.strictMask = ^uint64(0) << (64 - bits - cdcNormalization)
+	c.looseMask = ^uint64(0) << (64 - bits + cdcNormalization)
+	return c
+}
+
+// boundary returns the number of bytes of data up to the end of the current
+// chunk, or -1 if the chunk continues past data.
+func (c *cdcChunker) boundary(data []byte) int {
+	i := 0
+	// Boundaries are not looked for in the minimum size
+	if skip := c.minSize - c.length; skip > 0 {
+		if skip >= int64(len(data)) {
+			c.length += int64(len(data))
+			return -1
+		}
+		i = int(skip)
+		c.length += skip
+	}
+	for ; i < len(data); i++ {
+		c.hash = c.hash<<1 + gearTable[data[i]]
+		c.length++
+		mask := c.looseMask
+		if c.length < c.averageSize {
+			mask = c.strictMask
+		}
+		if c.hash&mask == 0 || c.length >= c.maxSize {
+			c.hash, c.length = 0, 0
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// splitContentDefined cuts chunks read from input at content-defined
+// boundaries, so each hashed segment is a content-defined chunk. Segment
+// boundaries of incoming chunks are ignored.
+func splitContentDefined(in <-chan segmentChunk, averageSize int64) <-chan segmentChunk {
+	out := make(chan segmentChunk)
+	go func() {
+		defer close(out)
+
+		// Read buffer may be refilled while the last piece is still hashed,
+		// so pieces are cut from own copies of the data
+		var buffers [2][]byte
+		curBuffer := 0
+		chunker := newCDCChunker(averageSize)
+		position, segmentStart := int64(0), int64(0)
+		for chunk := range in {
+			buffers[curBuffer] = append(buffers[curBuffer][:0], chunk.data...)
+			data := buffers[curBuffer]
+			curBuffer ^= 1
+			// Unreadable ranges are split between the pieces they fall in.
+			// Unreadable sectors are not skipped with chunks, so data holds
+			// zeros in their place.
+			pieceStart := int64(0)
+			for len(data) > 0 {
+				n := chunker.boundary(data)
+				isLast := n >= 0
+				if !isLast {
+					n = len(data)
+				}
+				pieceEnd := pieceStart + int64(n)
+				out <- segmentChunk{data: data[:n], isLast: isLast, baseSegmentStart: segmentStart, unreadable: chunk.unreadableIn(pieceStart, pieceEnd)}
+				pieceStart = pieceEnd
+				position += int64(n)
+				if isLast {
+					segmentStart = position
+				}
+				data = data[n:]
+			}
+		}
+	}()
+
+	return out
+}
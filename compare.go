@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	compareMatched = "matched"
+	compareMoved   = "moved"
+	compareAdded   = "added"
+	compareRemoved = "removed"
+)
+
+// compare matches segments of two hashes files by hash regardless of their
+// position, so data shifted between images is found with content-defined
+// segments. Each segment of the second file is matched, moved or added,
+// segments of the first file not found in the second one are removed.
+func compare(args *compareArgs) int {
+	firstFormat, firstSegments := readSegments(args.first)
+	secondFormat, secondSegments := readSegments(args.second)
+	if firstFormat.sectorSize != secondFormat.sectorSize {
+		fatalf("LBAs of hashes files are in sectors of different size: %d and %d.", firstFormat.sectorSize, secondFormat.sectorSize)
+	}
+	if firstFormat.cdcAverageSize != secondFormat.cdcAverageSize {
+		fatal("segments of hashes files are cut differently, calculate both with equal segmentation and segment size.")
+	}
+	if len(firstSegments[0].hash) != len(secondSegments[0].hash) {
+		fatal("hashes files contain different hash types.")
+	}
+
+	firstByHash := make(map[string]segment, len(firstSegments))
+	for _, seg := range firstSegments {
+		if _, ok := firstByHash[string(seg.hash)]; !ok {
+			firstByHash[string(seg.hash)] = seg
+		}
+	}
+
+	out := args.createOutputFile()
+	defer out.Close()
+	var metadata [][2]string
+	if firstFormat.sectorSize != defaultSectorSize {
+		metadata = append(metadata, [2]string{"sectorsize", fmt.Sprintf("%d", firstFormat.sectorSize)})
+	}
+	metadata = append(metadata, [2]string{"columns", "status,firststartlba,firstendlba,secondstartlba,secondendlba"})
+	writeMetadata(out, metadata)
+	csvWriter := createCsvWriter(out)
+	writeLine := func(status string, first, second *segment) {
+		values := []string{status, "", "", "", ""}
+		for i, seg := range []*segment{first, second} {
+			if seg != nil {
+				startLba, endLba := bytesToSectors(seg.start, seg.length, firstFormat.sectorSize)
+				values[1+2*i], values[2+2*i] = fmt.Sprintf("%d", startLba), fmt.Sprintf("%d", endLba)
+			}
+		}
+		lnCheckErr(csvWriter.Write(values))
+	}
+
+	secondHashes := make(map[string]bool, len(secondSegments))
+	counts := make(map[string]int)
+	matchedBytes, secondBytes := int64(0), int64(0)
+	for i := range secondSegments {
+		seg := &secondSegments[i]
+		secondHashes[string(seg.hash)] = true
+		secondBytes += seg.length
+		status := compareAdded
+		var first *segment
+		if match, ok := firstByHash[string(seg.hash)]; ok {
+			status, first = compareMoved, &match
+			if match.start == seg.start {
+				status = compareMatched
+			}
+			matchedBytes += seg.length
+		}
+		counts[status]++
+		writeLine(status, first, seg)
+	}
+	for i := range firstSegments {
+		if seg := &firstSegments[i]; !secondHashes[string(seg.hash)] {
+			counts[compareRemoved]++
+			writeLine(compareRemoved, seg, nil)
+		}
+	}
+	csvWriter.Flush()
+	lnCheckErr(csvWriter.Error())
+
+	matchedPercent := float64(0)
+	if secondBytes > 0 {
+		matchedPercent = float64(matchedBytes) * 100 / float64(secondBytes)
+	}
+	fmt.Printf("Segment hashes compared. \nFirst hashes file: %s. Second hashes file: %s. \n"+
+		"Matched segments: %d, moved: %d, added: %d, removed: %d. Data of the second file found in the first one: %.1f%%. \n"+
+		"Comparison written to %s.\n",
+		args.first.Name(), args.second.Name(),
+		counts[compareMatched], counts[compareMoved], counts[compareAdded], counts[compareRemoved], matchedPercent, out.Name())
+	return counts[compareAdded] + counts[compareRemoved]
+}
+
+// readSegments reads all segments of hashes file. Invalid lines are fatal.
+func readSegments(hashes inputFile) (hashFileFormat, []segment) {
+	format := readHashFileFormat(hashes)
+	csvReader := createCsvReader(hashes)
+	var segments []segment
+	for {
+		startLba, endLba, length, hash, err := readSegmentLine(csvReader, format)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalf("invalid line in %s: %v", hashes.Name(), err)
+		}
+		start, _ := sectorToBytes(startLba, endLba, format.sectorSize)
+		segments = append(segments, segment{start: start, length: length, hash: hash})
+	}
+	if len(segments) == 0 {
+		fatalf("no segment hashes found in %s.", hashes.Name())
+	}
+	return format, segments
+}
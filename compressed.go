@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Compressed raw images are decompressed on the fly and read as streams,
+// so hashes refer to the uncompressed image.
+
+const (
+	formatGzip  = "gzip"
+	formatBzip2 = "bzip2"
+	formatZstd  = "zstd"
+)
+
+var (
+	gzipSignature  = []byte{0x1f, 0x8b, 0x08}
+	bzip2Signature = []byte("BZh")
+)
+
+// decompressedStream reads decompressed data and closes the compressed source
+type decompressedStream struct {
+	io.Reader
+	io.Closer
+}
+
+// compressionFormat returns compression format which signature header
+// starts with, empty string if data is not compressed.
+func compressionFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipSignature):
+		return formatGzip
+	case bytes.HasPrefix(header, bzip2Signature):
+		return formatBzip2
+	case isZstdHeader(header):
+		return formatZstd
+	}
+	return ""
+}
+
+func newDecompressor(format string, r io.Reader) (io.Reader, error) {
+	switch format {
+	case formatGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case formatBzip2:
+		return bzip2.NewReader(r), nil
+	case formatZstd:
+		return newZstdReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression format %s", format)
+}
+
+// openCompressed returns stream of decompressed data of a compressed file
+func openCompressed(f *os.File, format string) (inputFile, error) {
+	return decompressStream(f, f.Name(), format)
+}
+
+// decompressStream reads r decompressing it in specified format. If format
+// is formatAuto, it is detected by data signature, data is read as is if
+// it is not compressed.
+func decompressStream(r io.ReadCloser, name, format string) (*streamFile, error) {
+	buffered := bufio.NewReader(r)
+	if format == formatAuto {
+		header, err := buffered.Peek(formatProbeSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if format = compressionFormat(header); format == "" {
+			return newStreamFile(decompressedStream{Reader: buffered, Closer: r}, name), nil
+		}
+	}
+
+	decompressed, err := newDecompressor(format, buffered)
+	if err != nil {
+		return nil, err
+	}
+	s := newStreamFile(decompressedStream{Reader: decompressed, Closer: r}, name)
+	s.format = format + " compressed"
+	return s, nil
+}
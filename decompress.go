@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errCorruptCompressedData = errors.New("corrupt compressed data")
+
+// decodeSnappy decodes a block in Snappy format (without framing).
+func decodeSnappy(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > 1<<32 {
+		return nil, errCorruptCompressedData
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, count int
+		switch tag & 3 {
+		case 0:
+			count = int(tag >> 2)
+			src = src[1:]
+			if count >= 60 {
+				extra := count - 59
+				if len(src) < extra {
+					return nil, errCorruptCompressedData
+				}
+				count = 0
+				for i := extra - 1; i >= 0; i-- {
+					count = count<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			count++
+			if len(src) < count {
+				return nil, errCorruptCompressedData
+			}
+			dst = append(dst, src[:count]...)
+			src = src[count:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errCorruptCompressedData
+			}
+			count = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errCorruptCompressedData
+			}
+			count = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errCorruptCompressedData
+			}
+			count = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errCorruptCompressedData
+		}
+		dst = appendMatch(dst, offset, count)
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errCorruptCompressedData
+	}
+	return dst, nil
+}
+
+// decodeLZ4Block decodes an LZ4 block (without frame) of at most maxSize bytes.
+func decodeLZ4Block(src []byte, maxSize int) ([]byte, error) {
+	dst := make([]byte, 0, maxSize)
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+
+		count, n := lz4Length(src, int(token>>4))
+		if n < 0 || len(src) < n+count {
+			return nil, errCorruptCompressedData
+		}
+		dst = append(dst, src[n:n+count]...)
+		src = src[n+count:]
+		if len(src) == 0 {
+			// The last sequence has literals only
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, errCorruptCompressedData
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+		count, n = lz4Length(src, int(token&15))
+		if n < 0 || offset == 0 || offset > len(dst) {
+			return nil, errCorruptCompressedData
+		}
+		src = src[n:]
+		dst = appendMatch(dst, offset, count+4)
+		if len(dst) > maxSize {
+			return nil, errCorruptCompressedData
+		}
+	}
+	return dst, nil
+}
+
+// lz4Length reads extended length which continues in following bytes
+// when 4-bit length is 15. It returns the number of bytes read.
+func lz4Length(src []byte, length int) (int, int) {
+	n := 0
+	if length == 15 {
+		for {
+			if n >= len(src) {
+				return 0, -1
+			}
+			length += int(src[n])
+			n++
+			if src[n-1] != 255 {
+				break
+			}
+		}
+	}
+	return length, n
+}
+
+// appendMatch copies count bytes starting offset bytes back, the ranges may overlap.
+func appendMatch(dst []byte, offset, count int) []byte {
+	start := len(dst) - offset
+	for i := 0; i < count; i++ {
+		dst = append(dst, dst[start+i])
+	}
+	return dst
+}
+
+// decodeADC decodes Apple Data Compression used in DMG images.
+func decodeADC(src []byte, maxSize int) ([]byte, error) {
+	dst := make([]byte, 0, maxSize)
+	for len(src) > 0 {
+		control := src[0]
+		var offset, count int
+		switch {
+		case control&0x80 != 0:
+			count = int(control&0x7f) + 1
+			if len(src) < 1+count {
+				return nil, errCorruptCompressedData
+			}
+			dst = append(dst, src[1:1+count]...)
+			src = src[1+count:]
+			continue
+		case control&0x40 != 0:
+			if len(src) < 3 {
+				return nil, errCorruptCompressedData
+			}
+			count = int(control&0x3f) + 4
+			offset = int(binary.BigEndian.Uint16(src[1:])) + 1
+			src = src[3:]
+		default:
+			if len(src) < 2 {
+				return nil, errCorruptCompressedData
+			}
+			count = int(control>>2&0x0f) + 3
+			offset = int(control&0x03)<<8 | int(src[1]) + 1
+			src = src[2:]
+		}
+		if offset > len(dst) {
+			return nil, errCorruptCompressedData
+		}
+		dst = appendMatch(dst, offset, count)
+		if len(dst) > maxSize {
+			return nil, errCorruptCompressedData
+		}
+	}
+	return dst, nil
+}
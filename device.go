@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// deviceFile is a block device or another special file which size
+// is not reported by Stat.
+type deviceFile struct {
+	*os.File
+	size               int64
+	logicalSectorSize  int64
+	physicalSectorSize int64
+}
+
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (d *deviceFile) Stat() (os.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedFileInfo{FileInfo: fi, size: d.size}, nil
+}
+
+// sectorSizes returns sector sizes reported by the device, zero if unknown.
+func (d *deviceFile) sectorSizes() (logical, physical int64) {
+	return d.logicalSectorSize, d.physicalSectorSize
+}
+
+// sectorSizer is implemented by inputs which know their sector sizes
+type sectorSizer interface {
+	sectorSizes() (logical, physical int64)
+}
+
+// seekSize determines size of f by seeking to its end.
+func seekSize(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return size, err
+}
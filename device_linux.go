@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioctlBlkGetSize64 = 0x80081272
+	ioctlBlkSszGet    = 0x1268
+	ioctlBlkPbszGet   = 0x127b
+)
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if err := ioctl(f, ioctlBlkGetSize64, unsafe.Pointer(&size)); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+func deviceSectorSizes(f *os.File) (logical, physical int64) {
+	var size int32
+	if ioctl(f, ioctlBlkSszGet, unsafe.Pointer(&size)) == nil {
+		logical = int64(size)
+	}
+	if ioctl(f, ioctlBlkPbszGet, unsafe.Pointer(&size)) == nil {
+		physical = int64(size)
+	}
+	return
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+func deviceSize(f *os.File) (int64, error) {
+	return seekSize(f)
+}
+
+func deviceSectorSizes(f *os.File) (logical, physical int64) {
+	return 0, 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	diffFormatCSV  = "csv"
+	diffFormatJSON = "json"
+)
+
+// diffWriter writes different segments and verify errors found in them.
+// When the partition table is known, diff ranges are split at partition
+// boundaries and annotated with the partition of each piece.
+type diffWriter interface {
+	writeDiff(startLba, endLba int64)
+	writeError(message string)
+	Name() string
+	Close() error
+}
+
+// diffAnnotation locates a diff range in the partition table
+type diffAnnotation struct {
+	partitions []partition
+	sectorSize int64
+}
+
+func (a diffAnnotation) enabled() bool {
+	return len(a.partitions) > 0
+}
+
+// diffPiece is a part of diff range lying within a single partition or gap
+type diffPiece struct {
+	startLba    int64
+	endLba      int64
+	partition   partition
+	offset      int64 // byte offset of the piece within the partition
+	inPartition bool
+}
+
+// split cuts LBA range at partition boundaries, so each piece can be
+// attributed to a single partition.
+func (a diffAnnotation) split(startLba, endLba int64) []diffPiece {
+	var pieces []diffPiece
+	end := (endLba + 1) * a.sectorSize
+	for position := startLba * a.sectorSize; position < end; {
+		piece := diffPiece{startLba: position / a.sectorSize}
+		pieceEnd := end
+		if p, ok := partitionAt(a.partitions, position); ok {
+			piece.partition, piece.offset, piece.inPartition = p, position-p.start, true
+			pieceEnd = minInt64(pieceEnd, p.start+p.length)
+		} else {
+			for _, p := range a.partitions {
+				if p.start > position {
+					pieceEnd = minInt64(pieceEnd, p.start)
+				}
+			}
+		}
+		piece.endLba = (pieceEnd - 1) / a.sectorSize
+		pieces = append(pieces, piece)
+		position = pieceEnd
+	}
+	return pieces
+}
+
+// progressDiffWriter reports diffs and errors as progress events
+type progressDiffWriter struct {
+	diffWriter
+	progress progressReporter
+}
+
+func (w *progressDiffWriter) writeDiff(startLba, endLba int64) {
+	w.progress.mismatch()
+	w.diffWriter.writeDiff(startLba, endLba)
+}
+
+func (w *progressDiffWriter) writeError(message string) {
+	w.progress.warning(message)
+	w.diffWriter.writeError(message)
+}
+
+func newDiffWriter(format string, out outputFile, annotation diffAnnotation) diffWriter {
+	if format == diffFormatJSON {
+		return &jsonDiffWriter{out: out, annotation: annotation}
+	}
+	var metadata [][2]string
+	if annotation.sectorSize != defaultSectorSize {
+		metadata = append(metadata, [2]string{"sectorsize", fmt.Sprintf("%d", annotation.sectorSize)})
+	}
+	if annotation.enabled() {
+		metadata = append(metadata, [2]string{"columns", "startlba,endlba,partition,type,name,offset"})
+	}
+	writeMetadata(out, metadata)
+	return &csvDiffWriter{out: out, csvWriter: createCsvWriter(out), annotation: annotation}
+}
+
+type csvDiffWriter struct {
+	out        outputFile
+	csvWriter  *csv.Writer
+	annotation diffAnnotation
+}
+
+func (w *csvDiffWriter) writeDiff(startLba, endLba int64) {
+	if !w.annotation.enabled() {
+		writeDiffLine(w.csvWriter, startLba, endLba)
+		return
+	}
+	for _, piece := range w.annotation.split(startLba, endLba) {
+		values := []string{fmt.Sprintf("%d", piece.startLba), fmt.Sprintf("%d", piece.endLba), "", "", "", ""}
+		if piece.inPartition {
+			values[2] = fmt.Sprintf("%d", piece.partition.number)
+			values[3] = piece.partition.typeName()
+			values[4] = piece.partition.name
+			values[5] = fmt.Sprintf("%d", piece.offset)
+		}
+		err := w.csvWriter.Write(values)
+		lnCheckErr(err)
+	}
+	w.csvWriter.Flush()
+	lnCheckErr(w.csvWriter.Error())
+}
+
+func (w *csvDiffWriter) writeError(message string) {
+	writeErrorLine(w.csvWriter, message)
+}
+
+func (w *csvDiffWriter) Name() string {
+	return w.out.Name()
+}
+
+func (w *csvDiffWriter) Close() error {
+	return w.out.Close()
+}
+
+// jsonDiffWriter writes an array of diff and error objects. The array is
+// written incrementally, so the diffs found are not held in memory.
+type jsonDiffWriter struct {
+	out        outputFile
+	annotation diffAnnotation
+	count      int
+}
+
+type jsonPartition struct {
+	Number   int    `json:"number"`
+	Type     string `json:"type"`
+	TypeCode string `json:"typecode"`
+	Name     string `json:"name,omitempty"`
+	Offset   int64  `json:"offset"`
+}
+
+type jsonDiff struct {
+	StartLba  *int64         `json:"startlba,omitempty"`
+	EndLba    *int64         `json:"endlba,omitempty"`
+	Partition *jsonPartition `json:"partition,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+func (w *jsonDiffWriter) write(diff jsonDiff) {
+	data, err := json.Marshal(diff)
+	lnCheckErr(err)
+	separator := ",\n"
+	if w.count == 0 {
+		separator = "[\n"
+	}
+	w.count++
+	_, err = io.WriteString(w.out, separator+string(data))
+	lnCheckErr(err)
+}
+
+func (w *jsonDiffWriter) writeDiff(startLba, endLba int64) {
+	if !w.annotation.enabled() {
+		w.write(jsonDiff{StartLba: &startLba, EndLba: &endLba})
+		return
+	}
+	for _, piece := range w.annotation.split(startLba, endLba) {
+		diff := jsonDiff{StartLba: &piece.startLba, EndLba: &piece.endLba}
+		if piece.inPartition {
+			p := piece.partition
+			diff.Partition = &jsonPartition{Number: p.number, Type: p.typeName(), TypeCode: p.typeCode, Name: p.name, Offset: piece.offset}
+		}
+		w.write(diff)
+	}
+}
+
+func (w *jsonDiffWriter) writeError(message string) {
+	w.write(jsonDiff{Error: message})
+}
+
+func (w *jsonDiffWriter) Name() string {
+	return w.out.Name()
+}
+
+func (w *jsonDiffWriter) Close() error {
+	_, err := io.WriteString(w.out, "\n]\n")
+	lnCheckErr(err)
+	return w.out.Close()
+}
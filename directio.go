@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment of buffers, offsets and read sizes
+// suitable for direct I/O on most devices and file systems.
+const directIOAlignment = 4096
+
+// readLength rounds length up to the direct I/O alignment when needed.
+func (opts readOptions) readLength(length int64) int64 {
+	if !opts.directIO {
+		return length
+	}
+	return (length + directIOAlignment - 1) / directIOAlignment * directIOAlignment
+}
+
+func alignedBuffer(size int64, alignment int) []byte {
+	buf := make([]byte, size+int64(alignment))
+	shift := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(alignment-1))
+	if shift > 0 {
+		shift = alignment - shift
+	}
+	return buf[shift : int64(shift)+size : int64(shift)+size]
+}
+
+// enableDirectIO switches input to reading that bypasses the page cache.
+// It returns false when the platform or file system does not support it.
+func enableDirectIO(input io.Reader) bool {
+	err := setDirectIO(input, true)
+	if err == nil {
+		err = probeDirectIO(input)
+	}
+	if err != nil {
+		setDirectIO(input, false)
+		fmt.Printf("Direct I/O is not available (%v), reading through page cache.\n", err)
+		return false
+	}
+	return true
+}
+
+// probeDirectIO reads the first aligned block of input as some file
+// systems accept O_DIRECT flag but fail on actual reads.
+func probeDirectIO(input io.Reader) error {
+	readerAt, ok := input.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	_, err := readerAt.ReadAt(alignedBuffer(directIOAlignment, directIOAlignment), 0)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
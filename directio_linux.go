@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+type fileDescriptor interface {
+	Fd() uintptr
+}
+
+func fcntl(fd uintptr, cmd int, arg int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, uintptr(cmd), uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func setDirectIO(input interface{}, enable bool) error {
+	f, ok := input.(fileDescriptor)
+	if !ok {
+		return errors.New("input is not a file")
+	}
+	flags, err := fcntl(f.Fd(), syscall.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if enable {
+		flags |= syscall.O_DIRECT
+	} else {
+		flags &^= syscall.O_DIRECT
+	}
+	_, err = fcntl(f.Fd(), syscall.F_SETFL, flags)
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setDirectIO(input interface{}, enable bool) error {
+	if !enable {
+		return nil
+	}
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DMG (UDIF) image ends with the koly trailer which points to XML property
+// list. Its blkx resources hold mish tables, each one describes a range of
+// disk sectors as runs which are zero, raw or compressed.
+
+const (
+	dmgTrailerSize   = 512
+	dmgSectorSize    = 512
+	dmgMishChunkSize = 40
+	dmgMishHeader    = 204
+
+	dmgRunZero       = 0x00000000
+	dmgRunRaw        = 0x00000001
+	dmgRunIgnore     = 0x00000002
+	dmgRunADC        = 0x80000004
+	dmgRunZlib       = 0x80000005
+	dmgRunBzip2      = 0x80000006
+	dmgRunLZFSE      = 0x80000007
+	dmgRunLZMA       = 0x80000008
+	dmgRunComment    = 0x7ffffffe
+	dmgRunTerminator = 0xffffffff
+)
+
+var (
+	dmgSignature          = []byte("koly")
+	dmgMishSignature      = []byte("mish")
+	dmgEncryptedSignature = []byte("encrcdsa")
+)
+
+type dmgRun struct {
+	start  int64 // offset in the disk
+	size   int64
+	kind   uint32
+	offset int64 // offset of stored data in the file
+	length int64
+}
+
+type dmgImage struct {
+	file io.ReaderAt
+	runs []dmgRun
+	size int64
+
+	mutex       sync.Mutex
+	cachedIndex int
+	cachedData  []byte
+}
+
+func openDMG(f *os.File, trailer []byte) (inputFile, error) {
+	img, err := newDMG(f, trailer)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFile{reader: img, size: img.size, file: f, format: "DMG"}, nil
+}
+
+func newDMG(f io.ReaderAt, trailer []byte) (*dmgImage, error) {
+	dataForkOffset := int64(binary.BigEndian.Uint64(trailer[24:]))
+	xmlOffset, xmlLength := int64(binary.BigEndian.Uint64(trailer[216:])), int64(binary.BigEndian.Uint64(trailer[224:]))
+	if xmlLength == 0 {
+		return nil, errors.New("DMG images without XML property list are not supported")
+	}
+	plist, err := readBytesAt(f, xmlOffset, xmlLength)
+	if err != nil {
+		return nil, fmt.Errorf("DMG property list: %v", err)
+	}
+	tables, err := dmgBlkxTables(plist)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &dmgImage{file: f, size: int64(binary.BigEndian.Uint64(trailer[492:])) * dmgSectorSize, cachedIndex: -1}
+	for _, table := range tables {
+		if err := img.addMishTable(table, dataForkOffset); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(img.runs, func(i, j int) bool { return img.runs[i].start < img.runs[j].start })
+	return img, nil
+}
+
+func (img *dmgImage) addMishTable(table []byte, dataForkOffset int64) error {
+	if len(table) < dmgMishHeader || !bytes.HasPrefix(table, dmgMishSignature) {
+		return errors.New("invalid DMG mish table")
+	}
+	firstSector := int64(binary.BigEndian.Uint64(table[8:]))
+	dataOffset := dataForkOffset + int64(binary.BigEndian.Uint64(table[24:]))
+	count := int(binary.BigEndian.Uint32(table[200:]))
+	if len(table) < dmgMishHeader+count*dmgMishChunkSize {
+		return errors.New("DMG mish table is truncated")
+	}
+
+	for i := 0; i < count; i++ {
+		chunk := table[dmgMishHeader+i*dmgMishChunkSize:]
+		run := dmgRun{
+			kind:   binary.BigEndian.Uint32(chunk),
+			start:  (firstSector + int64(binary.BigEndian.Uint64(chunk[8:]))) * dmgSectorSize,
+			size:   int64(binary.BigEndian.Uint64(chunk[16:])) * dmgSectorSize,
+			offset: dataOffset + int64(binary.BigEndian.Uint64(chunk[24:])),
+			length: int64(binary.BigEndian.Uint64(chunk[32:])),
+		}
+		switch run.kind {
+		case dmgRunTerminator:
+			return nil
+		case dmgRunComment:
+			continue
+		case dmgRunZero, dmgRunRaw, dmgRunIgnore, dmgRunADC, dmgRunZlib, dmgRunBzip2:
+		case dmgRunLZFSE:
+			return errors.New("DMG images with LZFSE compression are not supported")
+		case dmgRunLZMA:
+			return errors.New("DMG images with LZMA compression are not supported")
+		default:
+			return fmt.Errorf("DMG run type 0x%08x is not supported", run.kind)
+		}
+		if run.size > 0 {
+			img.runs = append(img.runs, run)
+		}
+	}
+	return nil
+}
+
+// dmgBlkxTables returns decoded Data of blkx resources of the property list
+func dmgBlkxTables(plist []byte) ([][]byte, error) {
+	root, err := parsePlist(plist)
+	if err != nil {
+		return nil, fmt.Errorf("DMG property list: %v", err)
+	}
+	resources, _ := root.(map[string]interface{})
+	forks, _ := resources["resource-fork"].(map[string]interface{})
+	blkx, ok := forks["blkx"].([]interface{})
+	if !ok {
+		return nil, errors.New("DMG property list has no blkx resources")
+	}
+
+	var tables [][]byte
+	for _, item := range blkx {
+		resource, _ := item.(map[string]interface{})
+		if data, ok := resource["Data"].([]byte); ok {
+			tables = append(tables, data)
+		}
+	}
+	return tables, nil
+}
+
+// parsePlist decodes XML property list to maps, slices, strings and byte slices.
+func parsePlist(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return parsePlistValue(decoder, start)
+		}
+	}
+}
+
+func parsePlistValue(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		key := ""
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := token.(type) {
+			case xml.EndElement:
+				return dict, nil
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					if err := decoder.DecodeElement(&key, &t); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				value, err := parsePlistValue(decoder, t)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = value
+			}
+		}
+	case "array":
+		var array []interface{}
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := token.(type) {
+			case xml.EndElement:
+				return array, nil
+			case xml.StartElement:
+				value, err := parsePlistValue(decoder, t)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+		}
+	default:
+		var text string
+		if err := decoder.DecodeElement(&text, &start); err != nil {
+			return nil, err
+		}
+		if start.Name.Local == "data" {
+			return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		}
+		return text, nil
+	}
+}
+
+func (img *dmgImage) readRun(index int) ([]byte, error) {
+	if index == img.cachedIndex {
+		return img.cachedData, nil
+	}
+	run := img.runs[index]
+	stored, err := readBytesAt(img.file, run.offset, run.length)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	switch run.kind {
+	case dmgRunRaw:
+		data = stored
+	case dmgRunADC:
+		data, err = decodeADC(stored, int(run.size))
+	case dmgRunZlib, dmgRunBzip2:
+		var r io.Reader
+		if run.kind == dmgRunZlib {
+			r, err = zlib.NewReader(bytes.NewReader(stored))
+		} else {
+			r = bzip2.NewReader(bytes.NewReader(stored))
+		}
+		if err == nil {
+			data = make([]byte, run.size)
+			var n int
+			n, err = io.ReadFull(r, data)
+			if err == io.ErrUnexpectedEOF {
+				data, err = data[:n], nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DMG run at offset %d: %v", run.offset, err)
+	}
+
+	img.cachedIndex, img.cachedData = index, data
+	return data, nil
+}
+
+func (img *dmgImage) ReadAt(p []byte, off int64) (n int, err error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	for n < len(p) && off < img.size {
+		// The last run which starts at or before the offset
+		index := sort.Search(len(img.runs), func(i int) bool { return img.runs[i].start > off }) - 1
+		var part []byte
+		if index < 0 || off >= img.runs[index].start+img.runs[index].size {
+			// Not described sectors are read as zeros
+			end := img.size
+			if index+1 < len(img.runs) {
+				end = img.runs[index+1].start
+			}
+			part = p[n:minInt64(int64(len(p)), int64(n)+end-off)]
+			zeroFill(part)
+		} else {
+			run := img.runs[index]
+			within := off - run.start
+			part = p[n:minInt64(int64(len(p)), int64(n)+run.size-within)]
+			switch run.kind {
+			case dmgRunZero, dmgRunIgnore:
+				zeroFill(part)
+			default:
+				data, err := img.readRun(index)
+				if err != nil {
+					return n, err
+				}
+				if copied := copy(part, data[minInt64(within, int64(len(data))):]); copied < len(part) {
+					zeroFill(part[copied:])
+				}
+			}
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EWF (Expert Witness Compression Format) images consist of segment files
+// .E01, .E02, ..., .E99, .EAA, ..., .EZZ, .FAA and so on. Each segment file
+// is a chain of sections. Media data is stored in chunks which offsets
+// are listed in table sections following sectors sections.
+
+const (
+	ewfFileHeaderSize        = 13
+	ewfSectionDescriptorSize = 76
+	ewfTableHeaderSize       = 24
+	ewfCompressedFlag        = 0x80000000
+)
+
+type ewfChunk struct {
+	file       *os.File
+	offset     int64
+	size       int64
+	compressed bool
+}
+
+type ewfImage struct {
+	chunks    []ewfChunk
+	chunkSize int64
+	size      int64
+
+	mutex       sync.Mutex
+	cachedIndex int
+	cachedData  []byte
+}
+
+// ewfSegmentName returns the name of segment file with 1-based number
+// built after the first segment name
+func ewfSegmentName(firstName string, number int) string {
+	ext := filepath.Ext(firstName)
+	base := firstName[:len(firstName)-len(ext)]
+	first := 'E'
+	if len(ext) > 1 && ext[1] >= 'a' && ext[1] <= 'z' {
+		first = 'e'
+	}
+	if number <= 99 {
+		return fmt.Sprintf("%s.%c%02d", base, first, number)
+	}
+
+	letterA := 'A'
+	if first == 'e' {
+		letterA = 'a'
+	}
+	index := number - 100
+	return fmt.Sprintf("%s.%c%c%c", base,
+		first+rune(index/(26*26)),
+		letterA+rune(index/26%26),
+		letterA+rune(index%26))
+}
+
+func openEWF(f *os.File) (inputFile, error) {
+	img := &ewfImage{cachedIndex: -1}
+	result := &imageFile{reader: img, file: f, format: "EWF", hashes: map[string][]byte{}}
+
+	for number := 1; ; number++ {
+		segmentFile := f
+		if number > 1 {
+			var err error
+			segmentFile, err = os.Open(ewfSegmentName(f.Name(), number))
+			if err != nil {
+				return nil, fmt.Errorf("EWF segment file %d: %v", number, err)
+			}
+			result.closers = append(result.closers, segmentFile)
+		}
+
+		last, err := img.readSegment(segmentFile, number, result.hashes)
+		if err != nil {
+			return nil, fmt.Errorf("EWF segment file %s: %v", segmentFile.Name(), err)
+		}
+		if last {
+			break
+		}
+	}
+
+	if img.chunkSize == 0 {
+		return nil, errors.New("EWF volume section is not found")
+	}
+	if int64(len(img.chunks))*img.chunkSize < img.size {
+		return nil, fmt.Errorf("EWF image has %d chunks of %d expected", len(img.chunks), (img.size+img.chunkSize-1)/img.chunkSize)
+	}
+	result.size = img.size
+	return result, nil
+}
+
+// readSegment reads sections of a single segment file. It returns true
+// when the segment is the last one.
+func (img *ewfImage) readSegment(f *os.File, number int, hashes map[string][]byte) (last bool, err error) {
+	header := make([]byte, ewfFileHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return
+	}
+	if !bytes.HasPrefix(header, ewfSignature) {
+		return false, errors.New("invalid EWF signature")
+	}
+	if n := int(binary.LittleEndian.Uint16(header[9:])); n != number {
+		return false, fmt.Errorf("segment number is %d, expected %d", n, number)
+	}
+
+	var sectorsEnd int64
+	descriptor := make([]byte, ewfSectionDescriptorSize)
+	for offset := int64(ewfFileHeaderSize); ; {
+		if _, err = f.ReadAt(descriptor, offset); err != nil {
+			return
+		}
+		sectionType := string(bytes.TrimRight(descriptor[:16], "\x00"))
+		next := int64(binary.LittleEndian.Uint64(descriptor[16:]))
+		size := int64(binary.LittleEndian.Uint64(descriptor[24:]))
+		dataOffset := offset + ewfSectionDescriptorSize
+
+		switch sectionType {
+		case "volume", "disk":
+			err = img.readVolume(f, dataOffset)
+		case "sectors":
+			sectorsEnd = offset + size
+		case "table":
+			err = img.readTable(f, dataOffset, size-ewfSectionDescriptorSize, sectorsEnd, offset)
+		case "hash":
+			err = readStoredHash(f, dataOffset, md5Name, 16, hashes)
+		case "digest":
+			err = readStoredHash(f, dataOffset, md5Name, 16, hashes)
+			if err == nil {
+				err = readStoredHash(f, dataOffset+16, sha1Name, 20, hashes)
+			}
+		case "done":
+			return true, nil
+		case "next":
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s section at offset %d: %v", sectionType, offset, err)
+		}
+
+		if next <= offset {
+			return false, fmt.Errorf("invalid next section offset %d after section %s at offset %d", next, sectionType, offset)
+		}
+		offset = next
+	}
+}
+
+// readStoredHash reads a hash calculated at acquisition. All-zero hash was
+// not calculated, it is left out.
+func readStoredHash(f *os.File, offset int64, name string, length int64, hashes map[string][]byte) error {
+	hash, err := readBytesAt(f, offset, length)
+	if err == nil && !isZero(hash) {
+		hashes[name] = hash
+	}
+	return err
+}
+
+func (img *ewfImage) readVolume(f *os.File, offset int64) error {
+	volume, err := readBytesAt(f, offset, 24)
+	if err != nil {
+		return err
+	}
+	sectorsPerChunk := int64(binary.LittleEndian.Uint32(volume[8:]))
+	bytesPerSector := int64(binary.LittleEndian.Uint32(volume[12:]))
+	sectors := int64(binary.LittleEndian.Uint64(volume[16:]))
+	if sectorsPerChunk == 0 || bytesPerSector == 0 {
+		return errors.New("invalid chunk geometry")
+	}
+	img.chunkSize = sectorsPerChunk * bytesPerSector
+	img.size = sectors * bytesPerSector
+	return nil
+}
+
+// readTable reads chunk offsets. Chunks are stored in the preceding sectors
+// section, so the last chunk of the table ends where that section ends.
+func (img *ewfImage) readTable(f *os.File, offset, size, sectorsEnd, tableSectionOffset int64) error {
+	tableHeader, err := readBytesAt(f, offset, ewfTableHeaderSize)
+	if err != nil {
+		return err
+	}
+	count := int64(binary.LittleEndian.Uint32(tableHeader))
+	baseOffset := int64(binary.LittleEndian.Uint64(tableHeader[8:]))
+	// Entries are allocated for the count, it must fit in the section
+	if count > (size-ewfTableHeaderSize)/4 {
+		return fmt.Errorf("%d table entries do not fit in section of %d bytes", count, size)
+	}
+	entries, err := readBytesAt(f, offset+ewfTableHeaderSize, count*4)
+	if err != nil {
+		return err
+	}
+	if sectorsEnd == 0 {
+		sectorsEnd = tableSectionOffset
+	}
+
+	for i := int64(0); i < count; i++ {
+		entry := binary.LittleEndian.Uint32(entries[i*4:])
+		chunk := ewfChunk{
+			file:       f,
+			offset:     baseOffset + int64(entry&^ewfCompressedFlag),
+			compressed: entry&ewfCompressedFlag != 0,
+		}
+		end := sectorsEnd
+		if i+1 < count {
+			end = baseOffset + int64(binary.LittleEndian.Uint32(entries[(i+1)*4:])&^ewfCompressedFlag)
+		}
+		chunk.size = end - chunk.offset
+		if chunk.size <= 0 {
+			return fmt.Errorf("invalid offset of chunk %d", len(img.chunks))
+		}
+		img.chunks = append(img.chunks, chunk)
+	}
+	return nil
+}
+
+func (img *ewfImage) readChunk(index int) ([]byte, error) {
+	if index == img.cachedIndex {
+		return img.cachedData, nil
+	}
+
+	chunk := img.chunks[index]
+	stored, err := readBytesAt(chunk.file, chunk.offset, chunk.size)
+	if err != nil {
+		return nil, err
+	}
+
+	data := stored
+	if chunk.compressed {
+		r, err := zlib.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", index, err)
+		}
+		data = make([]byte, img.chunkSize)
+		n, err := io.ReadFull(r, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("chunk %d: %v", index, err)
+		}
+		data = data[:n]
+	} else if int64(len(data)) > img.chunkSize {
+		// Uncompressed chunk is followed by its checksum
+		data = data[:img.chunkSize]
+	}
+
+	img.cachedIndex, img.cachedData = index, data
+	return data, nil
+}
+
+func (img *ewfImage) ReadAt(p []byte, off int64) (n int, err error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	for n < len(p) && off < img.size {
+		index := int(off / img.chunkSize)
+		data, err := img.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+		within := off % img.chunkSize
+		if within >= int64(len(data)) {
+			return n, fmt.Errorf("chunk %d is shorter than expected", index)
+		}
+		copied := copy(p[n:], data[within:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func readBytesAt(r io.ReaderAt, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	n, err := r.ReadAt(data, offset)
+	if int64(n) == length {
+		return data, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ext2/3/4 volumes are divided into block groups, each with block and inode
+// bitmaps and an inode table. Superblock and group descriptors are backed up
+// in some groups. Data blocks of a file are mapped by block pointers or,
+// in ext4, by a tree of extents.
+
+const (
+	extMagic              = 0xef53
+	extSuperblockOffset   = 1024
+	extRootInode          = 2
+	extExtentMagic        = 0xf30a
+	extCompatHasJournal   = 0x4
+	extCompatSparseSuper2 = 0x200
+	extIncompatFiletype   = 0x2
+	extIncompatMetaBg     = 0x10
+	extIncompatExtents    = 0x40
+	extIncompat64Bit      = 0x80
+	extIncompatFlexBg     = 0x200
+	extRoCompatSparse     = 0x1
+	extInodeFlagExtents   = 0x80000
+	extInodeFlagInline    = 0x10000000
+	extModeTypeMask       = 0xf000
+	extModeDirectory      = 0x4000
+	extModeRegular        = 0x8000
+	extModeSymlink        = 0xa000
+	extDirectPointers     = 12
+	extMaxExtentDepth     = 5
+)
+
+type extGroup struct {
+	blockBitmap int64
+	inodeBitmap int64
+	inodeTable  int64
+}
+
+type extFileSystem struct {
+	volume          io.ReaderAt
+	blockSize       int64
+	inodeSize       int64
+	inodesPerGroup  int64
+	blocksPerGroup  int64
+	firstDataBlock  int64
+	descriptorSize  int64
+	reservedGdt     int64
+	firstMetaBg     int64
+	journalInode    uint32
+	backupGroups    [2]uint32
+	compat          uint32
+	incompat        uint32
+	roCompat        uint32
+	groups          []extGroup
+	is64Bit         bool
+	addressPerBlock int64
+}
+
+func openExt(volume io.ReaderAt, size int64, sb []byte) (fileSystem, error) {
+	fs := &extFileSystem{
+		volume:         volume,
+		blockSize:      1024 << binary.LittleEndian.Uint32(sb[24:]),
+		blocksPerGroup: int64(binary.LittleEndian.Uint32(sb[32:])),
+		inodesPerGroup: int64(binary.LittleEndian.Uint32(sb[40:])),
+		firstDataBlock: int64(binary.LittleEndian.Uint32(sb[20:])),
+		inodeSize:      128,
+		compat:         binary.LittleEndian.Uint32(sb[92:]),
+		incompat:       binary.LittleEndian.Uint32(sb[96:]),
+		roCompat:       binary.LittleEndian.Uint32(sb[100:]),
+		reservedGdt:    int64(binary.LittleEndian.Uint16(sb[0xce:])),
+		journalInode:   binary.LittleEndian.Uint32(sb[0xe0:]),
+		firstMetaBg:    int64(binary.LittleEndian.Uint32(sb[0x104:])),
+		descriptorSize: 32,
+	}
+	if binary.LittleEndian.Uint32(sb[76:]) > 0 {
+		fs.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	fs.backupGroups[0] = binary.LittleEndian.Uint32(sb[0x24c:])
+	fs.backupGroups[1] = binary.LittleEndian.Uint32(sb[0x250:])
+	blocksCount := int64(binary.LittleEndian.Uint32(sb[4:]))
+	if fs.incompat&extIncompat64Bit != 0 {
+		fs.is64Bit = true
+		blocksCount |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		if descriptorSize := int64(binary.LittleEndian.Uint16(sb[0xfe:])); descriptorSize >= 32 {
+			fs.descriptorSize = descriptorSize
+		}
+	}
+	if fs.blockSize > 65536 || fs.blocksPerGroup == 0 || fs.inodesPerGroup == 0 || fs.inodeSize < 128 {
+		return nil, errors.New("invalid ext superblock")
+	}
+	if blocksCount*fs.blockSize > size {
+		return nil, fmt.Errorf("ext volume size %d exceeds partition size %d", blocksCount*fs.blockSize, size)
+	}
+	fs.addressPerBlock = fs.blockSize / 4
+
+	groupCount := (blocksCount - fs.firstDataBlock + fs.blocksPerGroup - 1) / fs.blocksPerGroup
+	descriptors := make([]byte, groupCount*fs.descriptorSize)
+	if _, err := volume.ReadAt(descriptors, (fs.firstDataBlock+1)*fs.blockSize); err != nil {
+		return nil, fmt.Errorf("cannot read group descriptors: %v", err)
+	}
+	fs.groups = make([]extGroup, groupCount)
+	for i := range fs.groups {
+		d := descriptors[int64(i)*fs.descriptorSize:]
+		group := extGroup{
+			blockBitmap: int64(binary.LittleEndian.Uint32(d[0:])),
+			inodeBitmap: int64(binary.LittleEndian.Uint32(d[4:])),
+			inodeTable:  int64(binary.LittleEndian.Uint32(d[8:])),
+		}
+		if fs.is64Bit && fs.descriptorSize >= 64 {
+			group.blockBitmap |= int64(binary.LittleEndian.Uint32(d[0x20:])) << 32
+			group.inodeBitmap |= int64(binary.LittleEndian.Uint32(d[0x24:])) << 32
+			group.inodeTable |= int64(binary.LittleEndian.Uint32(d[0x28:])) << 32
+		}
+		fs.groups[i] = group
+	}
+	return fs, nil
+}
+
+func (fs *extFileSystem) name() string {
+	switch {
+	case fs.incompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBg) != 0:
+		return "ext4"
+	case fs.compat&extCompatHasJournal != 0:
+		return "ext3"
+	}
+	return "ext2"
+}
+
+// hasSuperblock tells whether the group holds superblock and descriptors copy
+func (fs *extFileSystem) hasSuperblock(group int) bool {
+	if group == 0 {
+		return true
+	}
+	if fs.compat&extCompatSparseSuper2 != 0 {
+		return uint32(group) == fs.backupGroups[0] || uint32(group) == fs.backupGroups[1]
+	}
+	if fs.roCompat&extRoCompatSparse == 0 || group == 1 {
+		return true
+	}
+	for _, base := range []int{3, 5, 7} {
+		power := base
+		for power < group {
+			power *= base
+		}
+		if power == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *extFileSystem) walk(visit fsVisitor) error {
+	descriptorBlocks := (int64(len(fs.groups))*fs.descriptorSize + fs.blockSize - 1) / fs.blockSize
+	if fs.incompat&extIncompatMetaBg != 0 {
+		descriptorBlocks = fs.firstMetaBg
+	}
+	tableBlocks := (fs.inodesPerGroup*fs.inodeSize + fs.blockSize - 1) / fs.blockSize
+	for i, group := range fs.groups {
+		if fs.hasSuperblock(i) {
+			start := (fs.firstDataBlock + int64(i)*fs.blocksPerGroup) * fs.blockSize
+			if i == 0 {
+				// Superblock follows the boot block, with blocks larger than
+				// 1K both share block 0
+				visit(fsObjectMetadata, "[boot block]", 0, extSuperblockOffset)
+				visit(fsObjectMetadata, "[superblock]", extSuperblockOffset, maxInt64(fs.blockSize, 2*extSuperblockOffset)-extSuperblockOffset)
+				visit(fsObjectMetadata, "[group descriptors]", start+fs.blockSize, (descriptorBlocks+fs.reservedGdt)*fs.blockSize)
+			} else {
+				visit(fsObjectMetadata, fmt.Sprintf("[superblock backup, group %d]", i), start, fs.blockSize)
+				visit(fsObjectMetadata, fmt.Sprintf("[group descriptors backup, group %d]", i), start+fs.blockSize, (descriptorBlocks+fs.reservedGdt)*fs.blockSize)
+			}
+		}
+		visit(fsObjectMetadata, fmt.Sprintf("[block bitmap, group %d]", i), group.blockBitmap*fs.blockSize, fs.blockSize)
+		visit(fsObjectMetadata, fmt.Sprintf("[inode bitmap, group %d]", i), group.inodeBitmap*fs.blockSize, fs.blockSize)
+		visit(fsObjectMetadata, fmt.Sprintf("[inode table, group %d]", i), group.inodeTable*fs.blockSize, tableBlocks*fs.blockSize)
+	}
+
+	if fs.compat&extCompatHasJournal != 0 && fs.journalInode != 0 {
+		inode, err := fs.readInode(fs.journalInode)
+		if err != nil {
+			return err
+		}
+		_, blocks, err := fs.inodeBlocks(inode)
+		if err != nil {
+			return fmt.Errorf("journal: %v", err)
+		}
+		visitRanges(visit, fsObjectMetadata, "[journal]", blocks)
+	}
+
+	root, err := fs.readInode(extRootInode)
+	if err != nil {
+		return err
+	}
+	return fs.walkDirectory(root, "/", visit, map[uint32]bool{extRootInode: true}, 0)
+}
+
+func (fs *extFileSystem) readInode(number uint32) ([]byte, error) {
+	index := int64(number - 1)
+	group := index / fs.inodesPerGroup
+	if number == 0 || group >= int64(len(fs.groups)) {
+		return nil, fmt.Errorf("invalid inode number %d", number)
+	}
+	inode := make([]byte, fs.inodeSize)
+	offset := fs.groups[group].inodeTable*fs.blockSize + index%fs.inodesPerGroup*fs.inodeSize
+	if _, err := fs.volume.ReadAt(inode, offset); err != nil {
+		return nil, fmt.Errorf("cannot read inode %d: %v", number, err)
+	}
+	return inode, nil
+}
+
+// inodeBlocks returns data blocks of the inode in logical order and all
+// blocks it occupies including mapping blocks and extended attributes block.
+func (fs *extFileSystem) inodeBlocks(inode []byte) (data, all []readRange, err error) {
+	mode := binary.LittleEndian.Uint16(inode[0:])
+	flags := binary.LittleEndian.Uint32(inode[32:])
+	size := int64(binary.LittleEndian.Uint32(inode[4:])) | int64(binary.LittleEndian.Uint32(inode[108:]))<<32
+
+	var dataList, allList rangeList
+	addBlocks := func(list *rangeList, start, count int64) {
+		list.add(start*fs.blockSize, count*fs.blockSize)
+	}
+	fastSymlink := mode&extModeTypeMask == extModeSymlink && size < 60 && flags&extInodeFlagExtents == 0
+	hasBlocks := mode&extModeTypeMask == extModeDirectory || mode&extModeTypeMask == extModeRegular || mode&extModeTypeMask == extModeSymlink
+	switch {
+	case !hasBlocks || fastSymlink || flags&extInodeFlagInline != 0:
+	case flags&extInodeFlagExtents != 0:
+		err = fs.extentBlocks(inode[40:100], 0, func(start, count int64, leaf bool) {
+			if leaf {
+				addBlocks(&dataList, start, count)
+			}
+			addBlocks(&allList, start, count)
+		})
+	default:
+		err = fs.indirectBlocks(inode[40:100], func(start int64, leaf bool) {
+			if leaf {
+				addBlocks(&dataList, start, 1)
+			}
+			addBlocks(&allList, start, 1)
+		})
+	}
+
+	attributesBlock := int64(binary.LittleEndian.Uint32(inode[104:]))
+	if fs.is64Bit {
+		attributesBlock |= int64(binary.LittleEndian.Uint16(inode[118:])) << 32
+	}
+	if attributesBlock != 0 {
+		addBlocks(&allList, attributesBlock, 1)
+	}
+	return dataList, allList, err
+}
+
+// extentBlocks walks extent tree node. Leaf extents are reported with leaf
+// flag set, index nodes below the inode are reported as mapping blocks.
+func (fs *extFileSystem) extentBlocks(node []byte, depth int, report func(start, count int64, leaf bool)) error {
+	if binary.LittleEndian.Uint16(node[0:]) != extExtentMagic || depth > extMaxExtentDepth {
+		return errors.New("invalid extent tree")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	leaf := binary.LittleEndian.Uint16(node[6:]) == 0
+	if 12+entries*12 > len(node) {
+		return errors.New("invalid extent tree")
+	}
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12:]
+		if leaf {
+			count := int64(binary.LittleEndian.Uint16(entry[4:]))
+			// Uninitialized extents have length increased by 32768
+			if count > 32768 {
+				count -= 32768
+			}
+			start := int64(binary.LittleEndian.Uint16(entry[6:]))<<32 | int64(binary.LittleEndian.Uint32(entry[8:]))
+			report(start, count, true)
+			continue
+		}
+		child := int64(binary.LittleEndian.Uint32(entry[4:])) | int64(binary.LittleEndian.Uint16(entry[8:]))<<32
+		report(child, 1, false)
+		block := make([]byte, fs.blockSize)
+		if _, err := fs.volume.ReadAt(block, child*fs.blockSize); err != nil {
+			return err
+		}
+		if err := fs.extentBlocks(block, depth+1, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indirectBlocks walks direct pointers followed by single, double and triple
+// indirect pointers of ext2/3 inode.
+func (fs *extFileSystem) indirectBlocks(pointers []byte, report func(block int64, leaf bool)) error {
+	for i := 0; i < extDirectPointers+3; i++ {
+		block := int64(binary.LittleEndian.Uint32(pointers[4*i:]))
+		if block == 0 {
+			continue
+		}
+		if i < extDirectPointers {
+			report(block, true)
+			continue
+		}
+		if err := fs.indirectBlock(block, i-extDirectPointers, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *extFileSystem) indirectBlock(block int64, level int, report func(block int64, leaf bool)) error {
+	report(block, false)
+	pointers := make([]byte, fs.blockSize)
+	if _, err := fs.volume.ReadAt(pointers, block*fs.blockSize); err != nil {
+		return err
+	}
+	for i := int64(0); i < fs.addressPerBlock; i++ {
+		child := int64(binary.LittleEndian.Uint32(pointers[4*i:]))
+		if child == 0 {
+			continue
+		}
+		if level == 0 {
+			report(child, true)
+		} else if err := fs.indirectBlock(child, level-1, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *extFileSystem) walkDirectory(inode []byte, dirPath string, visit fsVisitor, visited map[uint32]bool, depth int) error {
+	if depth > maxDirectoryDepth {
+		return fmt.Errorf("directory %s is nested too deep", dirPath)
+	}
+	data, all, err := fs.inodeBlocks(inode)
+	if err != nil {
+		return fmt.Errorf("directory %s: %v", dirPath, err)
+	}
+	visitRanges(visit, fsObjectDirectory, dirPath, all)
+	entries, err := readRanges(fs.volume, data)
+	if err != nil {
+		return err
+	}
+
+	for pos := 0; pos+8 <= len(entries); {
+		number := binary.LittleEndian.Uint32(entries[pos:])
+		recordLength := int(binary.LittleEndian.Uint16(entries[pos+4:]))
+		nameLength := int(entries[pos+6])
+		if fs.incompat&extIncompatFiletype == 0 {
+			nameLength |= int(entries[pos+7]) << 8
+		}
+		if recordLength < 8 || pos+recordLength > len(entries) || 8+nameLength > recordLength {
+			// Skip to the next block of damaged directory
+			pos = (pos/int(fs.blockSize) + 1) * int(fs.blockSize)
+			continue
+		}
+		name := string(entries[pos+8 : pos+8+nameLength])
+		pos += recordLength
+		if number == 0 || name == "." || name == ".." {
+			continue
+		}
+
+		child, err := fs.readInode(number)
+		if err != nil {
+			return err
+		}
+		path := childPath(dirPath, name)
+		if binary.LittleEndian.Uint16(child[0:])&extModeTypeMask == extModeDirectory {
+			if visited[number] {
+				continue
+			}
+			visited[number] = true
+			if err := fs.walkDirectory(child, path, visit, visited, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		_, blocks, err := fs.inodeBlocks(child)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		visitRanges(visit, fsObjectFile, path, blocks)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"syscall"
+)
+
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+func fadvise(input interface{}, offset, length int64, advice int) {
+	if f, ok := input.(fileDescriptor); ok {
+		syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), uintptr(advice), 0, 0)
+	}
+}
+
+// adviseSequential asks the kernel for aggressive read-ahead of input.
+func adviseSequential(input interface{}) {
+	fadvise(input, 0, 0, fadvSequential)
+}
+
+// dropCache tells the kernel that the range of input already read will
+// not be needed again, so hashing does not evict other cached data.
+func dropCache(input interface{}, offset, length int64) {
+	fadvise(input, offset, length, fadvDontNeed)
+}
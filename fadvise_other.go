@@ -0,0 +1,8 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+func adviseSequential(input interface{}) {}
+
+func dropCache(input interface{}, offset, length int64) {}
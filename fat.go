@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FAT12/16/32 and exFAT volumes consist of reserved area with boot sector,
+// file allocation tables and data area divided into clusters. Files and
+// directories occupy chains of clusters linked in FAT.
+
+const (
+	fatDirEntrySize  = 32
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrLongName  = 0x0f
+	fatDeletedEntry  = 0xe5
+
+	exfatEntryBitmap     = 0x81
+	exfatEntryUpcase     = 0x82
+	exfatEntryFile       = 0x85
+	exfatEntryStream     = 0xc0
+	exfatEntryName       = 0xc1
+	exfatNoFatChain      = 0x02
+	exfatAllocationFlag  = 0x01
+	exfatNameCharsInName = 15
+)
+
+// fatTable follows cluster chains in the file allocation table
+type fatTable struct {
+	data         []byte
+	bits         int // 12, 16, 32 or 28 for FAT32 which uses lower 28 bits
+	clusterCount uint32
+}
+
+func (t fatTable) next(cluster uint32) (uint32, bool) {
+	var value, endOfChain uint32
+	switch t.bits {
+	case 12:
+		offset := int(cluster) + int(cluster)/2
+		if offset+2 > len(t.data) {
+			return 0, false
+		}
+		value = uint32(binary.LittleEndian.Uint16(t.data[offset:]))
+		if cluster%2 == 1 {
+			value >>= 4
+		}
+		value &= 0xfff
+		endOfChain = 0xff7
+	case 16:
+		if int(cluster)*2+2 > len(t.data) {
+			return 0, false
+		}
+		value = uint32(binary.LittleEndian.Uint16(t.data[cluster*2:]))
+		endOfChain = 0xfff7
+	default:
+		if int(cluster)*4+4 > len(t.data) {
+			return 0, false
+		}
+		value = binary.LittleEndian.Uint32(t.data[cluster*4:])
+		endOfChain = 0xfffffff7
+		if t.bits == 28 {
+			value &= 0x0fffffff
+			endOfChain = 0x0ffffff7
+		}
+	}
+	if value < 2 || value >= endOfChain || value > t.clusterCount+1 {
+		return 0, false
+	}
+	return value, true
+}
+
+// chain returns clusters of the chain starting at first cluster. At most
+// limit clusters are returned if limit is positive.
+func (t fatTable) chain(first uint32, limit int64) []uint32 {
+	if first < 2 || first > t.clusterCount+1 {
+		return nil
+	}
+	clusters := []uint32{first}
+	for cluster := first; limit <= 0 || int64(len(clusters)) < limit; {
+		next, ok := t.next(cluster)
+		// Loops in damaged FAT are cut at the number of clusters
+		if !ok || uint32(len(clusters)) > t.clusterCount {
+			break
+		}
+		clusters = append(clusters, next)
+		cluster = next
+	}
+	return clusters
+}
+
+// clusterRanges converts clusters to byte ranges of the volume
+func clusterRanges(clusters []uint32, dataStart, clusterSize int64) []readRange {
+	var ranges rangeList
+	for _, cluster := range clusters {
+		ranges.add(dataStart+int64(cluster-2)*clusterSize, clusterSize)
+	}
+	return ranges
+}
+
+type fatFileSystem struct {
+	volume      io.ReaderAt
+	fatType     string
+	clusterSize int64
+	reserved    int64
+	fatCount    int64
+	fatSize     int64
+	rootStart   int64
+	rootSize    int64
+	rootCluster uint32
+	dataStart   int64
+	fat         fatTable
+}
+
+func openFAT(volume io.ReaderAt, size int64, boot []byte) (fileSystem, error) {
+	sectorSize := int64(binary.LittleEndian.Uint16(boot[11:]))
+	sectorsPerCluster := int64(boot[13])
+	reservedSectors := int64(binary.LittleEndian.Uint16(boot[14:]))
+	fatCount := int64(boot[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(boot[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(boot[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(boot[32:]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(boot[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(boot[36:]))
+	}
+	if (sectorSize != 512 && sectorSize != 1024 && sectorSize != 2048 && sectorSize != 4096) ||
+		sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 ||
+		reservedSectors == 0 || fatCount == 0 || fatSectors == 0 || totalSectors == 0 {
+		return nil, errors.New("no supported file system found")
+	}
+
+	fs := &fatFileSystem{
+		volume:      volume,
+		clusterSize: sectorsPerCluster * sectorSize,
+		reserved:    reservedSectors * sectorSize,
+		fatCount:    fatCount,
+		fatSize:     fatSectors * sectorSize,
+	}
+	fs.rootStart = fs.reserved + fatCount*fs.fatSize
+	fs.rootSize = (rootEntries*fatDirEntrySize + sectorSize - 1) / sectorSize * sectorSize
+	fs.dataStart = fs.rootStart + fs.rootSize
+	if fs.dataStart >= totalSectors*sectorSize || totalSectors*sectorSize > size {
+		return nil, fmt.Errorf("FAT volume size %d exceeds partition size %d", totalSectors*sectorSize, size)
+	}
+	clusterCount := (totalSectors*sectorSize - fs.dataStart) / fs.clusterSize
+	fs.fat.clusterCount = uint32(clusterCount)
+	switch {
+	case clusterCount < 4085:
+		fs.fatType, fs.fat.bits = "FAT12", 12
+	case clusterCount < 65525:
+		fs.fatType, fs.fat.bits = "FAT16", 16
+	default:
+		fs.fatType, fs.fat.bits = "FAT32", 28
+		fs.rootCluster = binary.LittleEndian.Uint32(boot[44:])
+	}
+
+	fs.fat.data = make([]byte, fs.fatSize)
+	if _, err := volume.ReadAt(fs.fat.data, fs.reserved); err != nil {
+		return nil, fmt.Errorf("cannot read FAT: %v", err)
+	}
+	return fs, nil
+}
+
+func (fs *fatFileSystem) name() string {
+	return fs.fatType
+}
+
+func (fs *fatFileSystem) walk(visit fsVisitor) error {
+	visit(fsObjectMetadata, "[reserved sectors]", 0, fs.reserved)
+	for i := int64(0); i < fs.fatCount; i++ {
+		visit(fsObjectMetadata, fmt.Sprintf("[FAT %d]", i+1), fs.reserved+i*fs.fatSize, fs.fatSize)
+	}
+
+	var root []readRange
+	if fs.rootCluster != 0 {
+		root = clusterRanges(fs.fat.chain(fs.rootCluster, 0), fs.dataStart, fs.clusterSize)
+	} else {
+		root = []readRange{{start: fs.rootStart, length: fs.rootSize}}
+	}
+	visitRanges(visit, fsObjectDirectory, "/", root)
+	return fs.walkDirectory(root, "/", visit, map[uint32]bool{}, 0)
+}
+
+func (fs *fatFileSystem) walkDirectory(ranges []readRange, dirPath string, visit fsVisitor, visited map[uint32]bool, depth int) error {
+	if depth > maxDirectoryDepth {
+		return fmt.Errorf("directory %s is nested too deep", dirPath)
+	}
+	data, err := readRanges(fs.volume, ranges)
+	if err != nil {
+		return err
+	}
+
+	longName := make([]string, 0)
+	for pos := 0; pos+fatDirEntrySize <= len(data); pos += fatDirEntrySize {
+		entry := data[pos : pos+fatDirEntrySize]
+		if entry[0] == 0 {
+			break
+		}
+		attributes := entry[11]
+		if entry[0] == fatDeletedEntry {
+			longName = longName[:0]
+			continue
+		}
+		if attributes&0x3f == fatAttrLongName {
+			// Long name parts precede the short entry in reverse order
+			part := decodeUTF16(append(append(append([]byte(nil), entry[1:11]...), entry[14:26]...), entry[28:32]...))
+			longName = append([]string{part}, longName...)
+			continue
+		}
+		name := strings.Join(longName, "")
+		longName = longName[:0]
+		if attributes&fatAttrVolumeID != 0 {
+			continue
+		}
+		if name == "" {
+			name = fatShortName(entry)
+		}
+		if name == "." || name == ".." {
+			continue
+		}
+
+		first := uint32(binary.LittleEndian.Uint16(entry[26:]))
+		if fs.fat.bits == 28 {
+			first |= uint32(binary.LittleEndian.Uint16(entry[20:])) << 16
+		}
+		path := childPath(dirPath, name)
+		if attributes&fatAttrDirectory != 0 {
+			if visited[first] {
+				continue
+			}
+			visited[first] = true
+			clusters := clusterRanges(fs.fat.chain(first, 0), fs.dataStart, fs.clusterSize)
+			visitRanges(visit, fsObjectDirectory, path, clusters)
+			if err := fs.walkDirectory(clusters, path, visit, visited, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		size := int64(binary.LittleEndian.Uint32(entry[28:]))
+		count := (size + fs.clusterSize - 1) / fs.clusterSize
+		if count > 0 {
+			visitRanges(visit, fsObjectFile, path, clusterRanges(fs.fat.chain(first, count), fs.dataStart, fs.clusterSize))
+		}
+	}
+	return nil
+}
+
+// fatShortName makes 8.3 name taking into account lower case flags
+func fatShortName(entry []byte) string {
+	base := []byte(strings.TrimRight(string(entry[0:8]), " "))
+	if len(base) > 0 && base[0] == 0x05 {
+		base[0] = fatDeletedEntry
+	}
+	extension := strings.TrimRight(string(entry[8:11]), " ")
+	name := string(base)
+	if entry[12]&0x08 != 0 {
+		name = strings.ToLower(name)
+	}
+	if entry[12]&0x10 != 0 {
+		extension = strings.ToLower(extension)
+	}
+	if extension != "" {
+		name += "." + extension
+	}
+	return name
+}
+
+type exfatFileSystem struct {
+	volume      io.ReaderAt
+	sectorSize  int64
+	clusterSize int64
+	fatOffset   int64
+	fatLength   int64
+	fatCount    int64
+	heapOffset  int64
+	rootCluster uint32
+	fat         fatTable
+}
+
+func openExFAT(volume io.ReaderAt, size int64, boot []byte) (fileSystem, error) {
+	sectorShift := uint(boot[108])
+	clusterShift := uint(boot[109])
+	if sectorShift < 9 || sectorShift > 12 || sectorShift+clusterShift > 25 {
+		return nil, errors.New("invalid exFAT boot sector")
+	}
+	fs := &exfatFileSystem{
+		volume:      volume,
+		sectorSize:  int64(1) << sectorShift,
+		fatCount:    int64(boot[110]),
+		rootCluster: binary.LittleEndian.Uint32(boot[96:]),
+	}
+	fs.clusterSize = fs.sectorSize << clusterShift
+	fs.fatOffset = int64(binary.LittleEndian.Uint32(boot[80:])) * fs.sectorSize
+	fs.fatLength = int64(binary.LittleEndian.Uint32(boot[84:])) * fs.sectorSize
+	fs.heapOffset = int64(binary.LittleEndian.Uint32(boot[88:])) * fs.sectorSize
+	fs.fat.clusterCount = binary.LittleEndian.Uint32(boot[92:])
+	fs.fat.bits = 32
+	if fs.fatCount == 0 || fs.fatOffset+fs.fatLength > size {
+		return nil, errors.New("invalid exFAT boot sector")
+	}
+
+	fs.fat.data = make([]byte, fs.fatLength)
+	if _, err := volume.ReadAt(fs.fat.data, fs.fatOffset); err != nil {
+		return nil, fmt.Errorf("cannot read FAT: %v", err)
+	}
+	return fs, nil
+}
+
+func (fs *exfatFileSystem) name() string {
+	return "exFAT"
+}
+
+func (fs *exfatFileSystem) walk(visit fsVisitor) error {
+	visit(fsObjectMetadata, "[boot region]", 0, 12*fs.sectorSize)
+	visit(fsObjectMetadata, "[backup boot region]", 12*fs.sectorSize, 12*fs.sectorSize)
+	for i := int64(0); i < fs.fatCount; i++ {
+		visit(fsObjectMetadata, fmt.Sprintf("[FAT %d]", i+1), fs.fatOffset+i*fs.fatLength, fs.fatLength)
+	}
+
+	root := clusterRanges(fs.fat.chain(fs.rootCluster, 0), fs.heapOffset, fs.clusterSize)
+	visitRanges(visit, fsObjectDirectory, "/", root)
+	return fs.walkDirectory(root, "/", visit, map[uint32]bool{}, 0)
+}
+
+// clusters returns byte ranges of data stream. Contiguous streams are not
+// recorded in FAT.
+func (fs *exfatFileSystem) clusters(first uint32, length int64, noFatChain bool) []readRange {
+	count := (length + fs.clusterSize - 1) / fs.clusterSize
+	if first < 2 || count == 0 {
+		return nil
+	}
+	if noFatChain {
+		return []readRange{{start: fs.heapOffset + int64(first-2)*fs.clusterSize, length: count * fs.clusterSize}}
+	}
+	return clusterRanges(fs.fat.chain(first, count), fs.heapOffset, fs.clusterSize)
+}
+
+func (fs *exfatFileSystem) walkDirectory(ranges []readRange, dirPath string, visit fsVisitor, visited map[uint32]bool, depth int) error {
+	if depth > maxDirectoryDepth {
+		return fmt.Errorf("directory %s is nested too deep", dirPath)
+	}
+	data, err := readRanges(fs.volume, ranges)
+	if err != nil {
+		return err
+	}
+
+	for pos := 0; pos+fatDirEntrySize <= len(data); pos += fatDirEntrySize {
+		entry := data[pos : pos+fatDirEntrySize]
+		switch entry[0] {
+		case 0:
+			return nil
+		case exfatEntryBitmap, exfatEntryUpcase:
+			name := "[allocation bitmap]"
+			if entry[0] == exfatEntryUpcase {
+				name = "[up-case table]"
+			}
+			visitRanges(visit, fsObjectMetadata, name,
+				fs.clusters(binary.LittleEndian.Uint32(entry[20:]), int64(binary.LittleEndian.Uint64(entry[24:])), false))
+		case exfatEntryFile:
+			secondaryCount := int(entry[1])
+			if pos+(secondaryCount+1)*fatDirEntrySize > len(data) || secondaryCount < 1 {
+				return fmt.Errorf("truncated file entry set in directory %s", dirPath)
+			}
+			stream := data[pos+fatDirEntrySize : pos+2*fatDirEntrySize]
+			if stream[0] != exfatEntryStream {
+				return fmt.Errorf("stream extension entry is missing in directory %s", dirPath)
+			}
+			nameLength := int(stream[3])
+			var name []byte
+			for i := 2; i <= secondaryCount; i++ {
+				nameEntry := data[pos+i*fatDirEntrySize : pos+(i+1)*fatDirEntrySize]
+				if nameEntry[0] == exfatEntryName {
+					name = append(name, nameEntry[2:2+2*exfatNameCharsInName]...)
+				}
+			}
+			if len(name) > 2*nameLength {
+				name = name[:2*nameLength]
+			}
+			path := childPath(dirPath, decodeUTF16(name))
+
+			first := binary.LittleEndian.Uint32(stream[20:])
+			var clusters []readRange
+			if stream[1]&exfatAllocationFlag != 0 {
+				clusters = fs.clusters(first, int64(binary.LittleEndian.Uint64(stream[24:])), stream[1]&exfatNoFatChain != 0)
+			}
+			if binary.LittleEndian.Uint16(entry[4:])&fatAttrDirectory != 0 {
+				if !visited[first] {
+					visited[first] = true
+					visitRanges(visit, fsObjectDirectory, path, clusters)
+					if err := fs.walkDirectory(clusters, path, visit, visited, depth+1); err != nil {
+						return err
+					}
+				}
+			} else {
+				visitRanges(visit, fsObjectFile, path, clusters)
+			}
+			pos += secondaryCount * fatDirEntrySize
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+// File systems are walked to find files, directories and metadata structures
+// occupying changed sectors. Only allocated objects are reported, space
+// not occupied by any of them is unallocated.
+
+const (
+	fsObjectFile      = "file"
+	fsObjectDirectory = "directory"
+	fsObjectMetadata  = "metadata"
+
+	maxDirectoryDepth = 256
+)
+
+// fsVisitor receives a byte range of the volume occupied by an object
+type fsVisitor func(kind, path string, start, length int64)
+
+type fileSystem interface {
+	name() string
+	walk(visit fsVisitor) error
+}
+
+// volumeReader reads a partition or the whole input as a volume
+type volumeReader struct {
+	input io.ReadSeeker
+	start int64
+	size  int64
+}
+
+func (v *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > v.size {
+		return 0, fmt.Errorf("read of %d bytes at offset %d is beyond volume end", len(p), off)
+	}
+	return readAt(v.input, p, v.start+off)
+}
+
+// openFileSystem detects a file system by its boot sector or superblock.
+func openFileSystem(volume io.ReaderAt, size int64) (fileSystem, error) {
+	boot := make([]byte, 2048)
+	if size < int64(len(boot)) {
+		return nil, errors.New("volume is too small")
+	}
+	if _, err := volume.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(boot[3:11], []byte("EXFAT   ")):
+		return openExFAT(volume, size, boot)
+	case bytes.Equal(boot[3:11], []byte("NTFS    ")):
+		return nil, errors.New("NTFS file system is not supported")
+	case binary.LittleEndian.Uint16(boot[1024+56:]) == extMagic:
+		return openExt(volume, size, boot[1024:])
+	case boot[510] == 0x55 && boot[511] == 0xaa:
+		return openFAT(volume, size, boot)
+	}
+	return nil, errors.New("no supported file system found")
+}
+
+// rangeList accumulates byte ranges merging adjacent ones
+type rangeList []readRange
+
+func (l *rangeList) add(start, length int64) {
+	if n := len(*l); n > 0 && (*l)[n-1].start+(*l)[n-1].length == start {
+		(*l)[n-1].length += length
+		return
+	}
+	*l = append(*l, readRange{start: start, length: length})
+}
+
+func visitRanges(visit fsVisitor, kind, path string, ranges []readRange) {
+	for _, r := range ranges {
+		visit(kind, path, r.start, r.length)
+	}
+}
+
+// readRanges reads ranges of the volume one after another.
+func readRanges(volume io.ReaderAt, ranges []readRange) ([]byte, error) {
+	var data []byte
+	for _, r := range ranges {
+		buf := make([]byte, r.length)
+		if _, err := volume.ReadAt(buf, r.start); err != nil {
+			return nil, err
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+func decodeUTF16(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+func childPath(dirPath, name string) string {
+	if dirPath == "/" {
+		return "/" + name
+	}
+	return dirPath + "/" + name
+}
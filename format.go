@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Format of an image file is detected by signatures in its first and last
+// sectors. Formats which are recognized but cannot be read are reported,
+// so that a container is not hashed as raw data by mistake.
+
+const (
+	formatAuto      = "auto"
+	formatRaw       = "raw"
+	formatSplit     = "split"
+	formatProbeSize = 512
+)
+
+var (
+	lvfSignature  = []byte("LVF\x09\x0d\x0a\xff\x00")
+	lef2Signature = []byte("LEF2\x0d\x0a\x81\x00")
+	affSignature  = []byte("AFF10\r\n\x00")
+	ad1Signature  = []byte("ADSEGMENTEDFILE")
+)
+
+// inputFormat is an image file format. Formats which cannot be read have
+// no name and open function.
+type inputFormat struct {
+	name   string
+	title  string
+	detect func(header, trailer []byte) bool
+	open   func(f *os.File, header, trailer []byte) (inputFile, error)
+}
+
+var inputFormats = []inputFormat{
+	{formatGzip, "gzip compressed", headerPrefix(gzipSignature), compressedOpener(formatGzip)},
+	{formatBzip2, "bzip2 compressed", headerPrefix(bzip2Signature), compressedOpener(formatBzip2)},
+	{formatZstd, "zstd compressed", func(header, trailer []byte) bool {
+		return isZstdHeader(header)
+	}, compressedOpener(formatZstd)},
+	{"ewf", "EWF (E01)", headerPrefix(ewfSignature), func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openEWF(f)
+	}},
+	{"", "EWF2 (Ex01)", headerPrefix(ewf2Signature), nil},
+	{"", "logical EWF (L01)", headerPrefix(lvfSignature), nil},
+	{"", "logical EWF2 (Lx01)", headerPrefix(lef2Signature), nil},
+	{"", "AFF", headerPrefix(affSignature), nil},
+	{"", "AD1", headerPrefix(ad1Signature), nil},
+	{"aff4", "AFF4", headerPrefix(zipSignature), func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openAFF4(f)
+	}},
+	{"qcow2", "QCOW2", headerPrefix(qcow2Signature), func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openQCOW2(f)
+	}},
+	{"vmdk", "VMDK", headerPrefix(vmdkSparseSignature, vmdkDescriptorSignature), func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openVMDK(f, header)
+	}},
+	{"vhdx", "VHDX", headerPrefix(vhdxSignature), func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openVHDX(f)
+	}},
+	{"vhd", "VHD", func(header, trailer []byte) bool {
+		return bytes.HasPrefix(header, vhdSignature) || bytes.HasPrefix(trailer, vhdSignature)
+	}, func(f *os.File, header, trailer []byte) (inputFile, error) {
+		// Dynamic disks have a copy of the footer at the start
+		if bytes.HasPrefix(header, vhdSignature) {
+			return openVHD(f, header)
+		}
+		if !bytes.HasPrefix(trailer, vhdSignature) {
+			return nil, nil
+		}
+		return openVHD(f, trailer)
+	}},
+	{"", "encrypted DMG", headerPrefix(dmgEncryptedSignature), nil},
+	{"dmg", "DMG", func(header, trailer []byte) bool {
+		return bytes.HasPrefix(trailer, dmgSignature)
+	}, func(f *os.File, header, trailer []byte) (inputFile, error) {
+		if !bytes.HasPrefix(trailer, dmgSignature) {
+			return nil, nil
+		}
+		return openDMG(f, trailer)
+	}},
+}
+
+func headerPrefix(signatures ...[]byte) func(header, trailer []byte) bool {
+	return func(header, trailer []byte) bool {
+		for _, signature := range signatures {
+			if bytes.HasPrefix(header, signature) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func compressedOpener(format string) func(f *os.File, header, trailer []byte) (inputFile, error) {
+	return func(f *os.File, header, trailer []byte) (inputFile, error) {
+		return openCompressed(f, format)
+	}
+}
+
+// formatNames returns names of formats which input can be read as
+func formatNames() []string {
+	names := []string{formatAuto, formatRaw, formatSplit}
+	for _, format := range inputFormats {
+		if format.name != "" {
+			names = append(names, format.name)
+		}
+	}
+	return names
+}
+
+func findFormat(name string) *inputFormat {
+	for i := range inputFormats {
+		if inputFormats[i].name == name {
+			return &inputFormats[i]
+		}
+	}
+	return nil
+}
+
+// detectFormat returns format recognized by the first and the last sectors
+// of the file, nil if it is not recognized.
+func detectFormat(header, trailer []byte) *inputFormat {
+	for i := range inputFormats {
+		if inputFormats[i].detect(header, trailer) {
+			return &inputFormats[i]
+		}
+	}
+	return nil
+}
+
+// readProbe reads the first and the last sectors of the file
+func readProbe(f *os.File) (header, trailer []byte, err error) {
+	header = make([]byte, formatProbeSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	header = header[:n]
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() > formatProbeSize {
+		if trailer, err = readBytesAt(f, fi.Size()-formatProbeSize, formatProbeSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	return header, trailer, nil
+}
+
+// openImageFile opens regular file in the format specified in options or
+// detected by the file content. Files in unrecognized formats are read as
+// raw images.
+func openImageFile(f *os.File, opts inputOptions) (inputFile, error) {
+	switch opts.format {
+	case formatRaw:
+		return f, nil
+	case formatSplit:
+		split, err := openSplitImage(f)
+		if err == nil && split == nil {
+			err = fmt.Errorf("%s is not the first part of a split image", f.Name())
+		}
+		return split, err
+	}
+
+	header, trailer, err := readProbe(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.format != formatAuto {
+		format := findFormat(opts.format)
+		if !format.detect(header, trailer) {
+			return nil, fmt.Errorf("%s is not %s image", f.Name(), format.title)
+		}
+		input, err := format.open(f, header, trailer)
+		if err == nil && input == nil {
+			err = fmt.Errorf("%s is not %s image", f.Name(), format.title)
+		}
+		return input, err
+	}
+
+	if format := detectFormat(header, trailer); format != nil {
+		name := filepath.Base(f.Name())
+		if format.open == nil {
+			confirmRawInput(fmt.Sprintf("File %s looks like %s image which cannot be read.", name, format.title), opts)
+			return f, nil
+		}
+		input, err := format.open(f, header, trailer)
+		if err != nil {
+			return nil, fmt.Errorf("%s looks like %s image: %v. Use --as raw to read it as raw data", name, format.title, err)
+		}
+		if input != nil {
+			return input, nil
+		}
+	}
+
+	split, err := openSplitImage(f)
+	if err != nil || split != nil {
+		return split, err
+	}
+	return f, nil
+}
+
+// confirmRawInput asks whether the file which format is recognized but
+// cannot be read should be hashed as raw data. The program exits if not.
+func confirmRawInput(problem string, opts inputOptions) {
+	if opts.yes {
+		fmt.Println(problem, "It is read as raw data.")
+		return
+	}
+	if !isTerminal(os.Stdin) {
+		fatal(problem + " Use --as raw or --yes to read it as raw data.")
+	}
+	if !askForConfirmation(problem + " Do you want to read it as raw data?") {
+		os.Exit(0)
+	}
+}
+
+// inputFormatTitle returns format of data read from the input for reports,
+// empty string for raw data.
+func inputFormatTitle(input inputFile) string {
+	switch f := input.(type) {
+	case *imageFile:
+		return f.format
+	case *streamFile:
+		return f.format
+	}
+	return ""
+}
+
+// describeInput returns input name with its format for reports
+func describeInput(input inputFile) string {
+	if title := inputFormatTitle(input); title != "" {
+		return fmt.Sprintf("%s (%s)", input.Name(), title)
+	}
+	return input.Name()
+}
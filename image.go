@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// imageFile presents logical data stored in an image container as inputFile.
+type imageFile struct {
+	reader   io.ReaderAt
+	size     int64
+	position int64
+	file     *os.File
+	format   string
+	closers  []io.Closer
+	hashes   map[string][]byte
+}
+
+func (img *imageFile) Read(p []byte) (int, error) {
+	if img.position >= img.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > img.size-img.position {
+		p = p[:img.size-img.position]
+	}
+	n, err := img.reader.ReadAt(p, img.position)
+	img.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (img *imageFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += img.position
+	case io.SeekEnd:
+		offset += img.size
+	}
+	if offset < 0 {
+		return img.position, errors.New("negative seek position")
+	}
+	img.position = offset
+	return offset, nil
+}
+
+func (img *imageFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > img.size-off {
+		n, err := img.reader.ReadAt(p[:img.size-off], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return img.reader.ReadAt(p, off)
+}
+
+func (img *imageFile) Close() error {
+	for _, c := range img.closers {
+		c.Close()
+	}
+	return img.file.Close()
+}
+
+func (img *imageFile) Name() string {
+	return img.file.Name()
+}
+
+func (img *imageFile) Stat() (os.FileInfo, error) {
+	fi, err := img.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedFileInfo{FileInfo: fi, size: img.size}, nil
+}
+
+// storedHasher is implemented by inputs which keep hashes of the whole image
+type storedHasher interface {
+	storedHashes() map[string][]byte
+}
+
+// storedHashes returns hashes of the whole image kept in the container
+func (img *imageFile) storedHashes() map[string][]byte {
+	return img.hashes
+}
+
+var (
+	ewfSignature  = []byte("EVF\x09\x0d\x0a\xff\x00")
+	ewf2Signature = []byte("EVF2\x0d\x0a\x81\x00")
+	zipSignature  = []byte("PK\x03\x04")
+)
+
+const maxParentDepth = 16
+
+// parentDisk is a base image of a differencing virtual disk. Data which is
+// not allocated in the child image is read from the parent.
+type parentDisk struct {
+	reader io.ReaderAt
+	size   int64
+}
+
+// openParentDisk opens parent virtual disk or raw image. Relative names are
+// relative to the directory of the child image.
+func openParentDisk(name, childName string, depth int) (parentDisk, []io.Closer, error) {
+	if depth > maxParentDepth {
+		return parentDisk{}, nil, errors.New("parent images chain is too long")
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(childName), name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return parentDisk{}, nil, err
+	}
+	closers := []io.Closer{f}
+
+	header := make([]byte, 512)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return parentDisk{}, nil, err
+	}
+	header = header[:n]
+
+	var parent parentDisk
+	var parentClosers []io.Closer
+	switch {
+	case bytes.HasPrefix(header, qcow2Signature):
+		var img *qcow2Image
+		if img, parentClosers, err = newQCOW2(f, name, depth); err == nil {
+			parent = parentDisk{img, img.size}
+		}
+	case bytes.HasPrefix(header, vmdkSparseSignature), bytes.HasPrefix(header, vmdkDescriptorSignature):
+		var disk *vmdkDisk
+		if disk, parentClosers, err = newVMDK(f, header, depth); err == nil {
+			parent = parentDisk{disk, disk.size}
+		}
+	default:
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			parent = parentDisk{f, fi.Size()}
+		}
+	}
+	if err != nil {
+		f.Close()
+		return parentDisk{}, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return parent, append(closers, parentClosers...), nil
+}
+
+// readAt reads parent data at the offset of the virtual disk, data beyond
+// the end of the parent or missing parent are read as zeros.
+func (d parentDisk) readAt(p []byte, off int64) error {
+	n := 0
+	if d.reader != nil && off < d.size {
+		m, err := d.reader.ReadAt(p[:minInt64(int64(len(p)), d.size-off)], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		n = m
+	}
+	zeroFill(p[n:])
+	return nil
+}
+
+func zeroFill(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// checkStoredHashes calculates whole image hashes which are stored in the
+// image container, so they can be compared after all data is read.
+func checkStoredHashes(stored map[string][]byte, in <-chan segmentChunk, wg *sync.WaitGroup) (mismatched func() []string) {
+	names := make([]string, 0, len(stored))
+	for name := range stored {
+		names = append(names, name)
+	}
+	hashContainers := getHashContainersByNames(names)
+
+	go func() {
+		defer wg.Done()
+
+		for chunk := range in {
+			for _, hc := range hashContainers {
+				hc.h.Write(chunk.data)
+			}
+		}
+	}()
+
+	return func() []string {
+		var mismatched []string
+		for _, hc := range hashContainers {
+			if !bytes.Equal(hc.h.Sum(nil), stored[hc.name]) {
+				mismatched = append(mismatched, hc.name)
+			}
+		}
+		return mismatched
+	}
+}
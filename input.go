@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/atola-technology/seghash/external/github.com/alecthomas/kingpin"
+)
+
+const (
+	// stdinName is the input file name which stands for standard input
+	stdinName = "-"
+	// stdinArg replaces stdinName in command line as kingpin takes lone "-" for a flag
+	stdinArg = "<stdin>"
+)
+
+// inputOptions control how the format of input data is determined
+type inputOptions struct {
+	format string // formatAuto, formatRaw or the name of the format to read input in
+	yes    bool   // read files in recognized but unsupported formats as raw without confirmation
+}
+
+// openInputFile opens a file, device, named pipe or standard input.
+func openInputFile(name string, opts inputOptions) inputFile {
+	if name == stdinArg {
+		return openStream(os.Stdin, "stdin", opts)
+	}
+	f, err := os.Open(name)
+	checkErr(err)
+	return openInput(f, opts)
+}
+
+// openStream reads stdin or a pipe sequentially, decompressing it if needed
+func openStream(r io.ReadCloser, name string, opts inputOptions) inputFile {
+	format := opts.format
+	switch format {
+	case formatRaw:
+		return newStreamFile(r, name)
+	case formatAuto, formatGzip, formatBzip2, formatZstd:
+	default:
+		fatalf("%s cannot be read as %s, only raw or compressed data can be read from a stream.", name, format)
+	}
+	s, err := decompressStream(r, name, format)
+	checkErr(err)
+	return s
+}
+
+// replaceStdinName prepares command line arguments for parsing. Only the
+// input file argument of a command is replaced, flag values are kept as is.
+func replaceStdinName(app *kingpin.Application, args []string) []string {
+	replaced := append([]string(nil), args...)
+	model := app.Model()
+	valueFlags := make(map[string]bool)
+	addFlags := func(flags *kingpin.FlagGroupModel) {
+		for _, flag := range flags.Flags {
+			if !flag.IsBoolFlag() {
+				valueFlags["--"+flag.Name] = true
+				if flag.Short != 0 {
+					valueFlags["-"+string(flag.Short)] = true
+				}
+			}
+		}
+	}
+	addFlags(model.FlagGroupModel)
+
+	var cmd *kingpin.CmdModel
+	argsOnly := false
+	for i := 0; i < len(replaced); i++ {
+		arg := replaced[i]
+		if !argsOnly && arg == "--" {
+			argsOnly = true
+			continue
+		}
+		if !argsOnly && len(arg) > 1 && arg[0] == '-' {
+			// Value of a flag is the next argument unless given as --flag=value or -fvalue
+			if valueFlags[arg] {
+				i++
+			}
+			continue
+		}
+		if cmd == nil {
+			for _, c := range model.FlattenedCommands() {
+				if c.Name == arg {
+					cmd = c
+				}
+			}
+			if cmd == nil || len(cmd.Args) == 0 || cmd.Args[0].Name != "inputfile" {
+				break
+			}
+			addFlags(cmd.FlagGroupModel)
+			continue
+		}
+		if arg == stdinName {
+			replaced[i] = stdinArg
+		}
+		break
+	}
+	return replaced
+}
+
+// openInput returns f itself for raw image files, wraps image containers to
+// read data stored in them, joins parts of split images, wraps devices so
+// that their size is reported properly, and pipes and compressed images to
+// read them sequentially.
+func openInput(f *os.File, opts inputOptions) inputFile {
+	fi, err := f.Stat()
+	checkErr(err)
+	if fi.Mode()&os.ModeNamedPipe != 0 {
+		return openStream(f, f.Name(), opts)
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		input, err := openImageFile(f, opts)
+		checkErr(err)
+		return input
+	}
+
+	d := &deviceFile{File: f}
+	d.size, err = deviceSize(f)
+	if err != nil {
+		d.size, err = seekSize(f)
+		checkErr(err)
+	}
+	d.logicalSectorSize, d.physicalSectorSize = deviceSectorSizes(f)
+	return d
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chain-of-custody journal is a JSON lines file, an entry is appended for
+// each calc or verify run. Every entry holds the hash of the previous one and
+// its own hash, so entries corrupted, inserted or removed in the middle break
+// the chain. The hashes are not keyed: whoever can write the journal can
+// recompute the chain after an edit, or remove the last entries. Such changes
+// are found only by comparing the last entry hash with a copy kept elsewhere.
+
+const (
+	journalCompleted = "completed"
+	journalFailed    = "failed"
+
+	journalLockTimeout = time.Minute
+	journalLockPoll    = 100 * time.Millisecond
+)
+
+type journalOptions struct {
+	path       string
+	operator   string
+	caseNumber string
+	evidenceID string
+}
+
+type journalInput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Size        int64  `json:"size"` // -1 for streams
+}
+
+type journalResult struct {
+	Status      string `json:"status"`
+	ExitCode    int    `json:"exitcode"`
+	Differences *int   `json:"differences,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+type journalFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type journalEntry struct {
+	Sequence  int           `json:"sequence"`
+	Previous  string        `json:"previous"`
+	Started   string        `json:"started"`
+	Finished  string        `json:"finished"`
+	Operator  string        `json:"operator"`
+	Case      string        `json:"case"`
+	Evidence  string        `json:"evidence"`
+	Host      string        `json:"host"`
+	Command   string        `json:"command"`
+	Arguments []string      `json:"arguments"`
+	Input     journalInput  `json:"input"`
+	Result    journalResult `json:"result"`
+	Outputs   []journalFile `json:"outputs"`
+	Hash      string        `json:"hash"`
+}
+
+// digest returns hash of the entry serialized with empty hash field
+func (e journalEntry) digest() string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	lnCheckErr(err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// journal records the running command. Methods of nil journal do nothing.
+type journal struct {
+	mutex   sync.Mutex
+	path    string
+	entry   journalEntry
+	outputs []string
+	images  []string // outputs not digested for their size
+	written bool
+}
+
+// openJournal checks the existing journal chain before the command is run,
+// so a broken journal is found before hours of hashing.
+func openJournal(opts journalOptions, command string, input inputFile) *journal {
+	if opts.path == "" {
+		return nil
+	}
+	entries, err := readJournal(opts.path)
+	if err != nil && !os.IsNotExist(err) {
+		fatalf("cannot read journal %s: %v", opts.path, err)
+	}
+	if broken, reason := validateJournal(entries); broken >= 0 {
+		fatalf("journal %s is broken at entry %d: %s.", opts.path, broken+1, reason)
+	}
+
+	j := &journal{path: opts.path}
+	j.entry = journalEntry{
+		Started:   time.Now().UTC().Format(time.RFC3339Nano),
+		Operator:  opts.operator,
+		Case:      opts.caseNumber,
+		Evidence:  opts.evidenceID,
+		Command:   command,
+		Arguments: os.Args[1:],
+		Input:     journalInput{Name: input.Name(), Description: describeInput(input), Size: fileSize(input)},
+	}
+	if !isStream(input) {
+		j.entry.Input.Name = absolutePath(input.Name())
+	}
+	if j.entry.Operator == "" {
+		if u, err := user.Current(); err == nil {
+			j.entry.Operator = u.Username
+		}
+	}
+	j.entry.Host, _ = os.Hostname()
+
+	// Failed runs are journaled too
+	fatalHooks = append(fatalHooks, func(message string) {
+		if err := j.finish(journalResult{Status: journalFailed, ExitCode: 255, Message: message}); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+		}
+	})
+	return j
+}
+
+func absolutePath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// output wraps output file creation to record the file
+func (j *journal) output(create func() outputFile) func() outputFile {
+	if j == nil {
+		return create
+	}
+	return func() outputFile {
+		f := create()
+		j.mutex.Lock()
+		j.outputs = append(j.outputs, f.Name())
+		j.mutex.Unlock()
+		return f
+	}
+}
+
+// image records an image copy, it is identified by its segment hashes
+func (j *journal) image(name string) {
+	if j != nil {
+		j.images = append(j.images, name)
+	}
+}
+
+// finish appends the entry of the run to the journal. The run is failed if
+// it cannot be journaled.
+func (j *journal) finish(result journalResult) error {
+	if j == nil {
+		return nil
+	}
+	// Errors while writing the entry must not journal it again
+	j.mutex.Lock()
+	written := j.written
+	j.written = true
+	j.mutex.Unlock()
+	if written {
+		return nil
+	}
+
+	j.entry.Finished = time.Now().UTC().Format(time.RFC3339Nano)
+	j.entry.Result = result
+	j.entry.Outputs = []journalFile{}
+	for _, name := range j.outputs {
+		j.entry.Outputs = append(j.entry.Outputs, digestFile(name))
+	}
+	for _, name := range j.images {
+		file := journalFile{Name: absolutePath(name)}
+		if fi, err := os.Stat(name); err == nil {
+			file.Size = fi.Size()
+		}
+		j.entry.Outputs = append(j.entry.Outputs, file)
+	}
+
+	// The chain is read again, other runs may have appended to it. Runs
+	// sharing the journal append one by one, or they would chain to the same entry.
+	unlock, err := lockJournal(j.path)
+	if err != nil {
+		return fmt.Errorf("cannot write journal %s: %v", j.path, err)
+	}
+	defer unlock()
+	entries, err := readJournal(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot read journal %s: %v", j.path, err)
+	}
+	if len(entries) > 0 {
+		j.entry.Sequence = entries[len(entries)-1].Sequence + 1
+		j.entry.Previous = entries[len(entries)-1].Hash
+	} else {
+		j.entry.Sequence = 1
+	}
+	j.entry.Hash = j.entry.digest()
+
+	data, err := json.Marshal(j.entry)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write journal %s: %v", j.path, err)
+	}
+	return nil
+}
+
+// lockJournal creates the lock file of the journal, waiting while another
+// run holds it. The lock file holds host name and process ID of the run, a
+// lock left by a run of this host which is gone is removed. Locks of other
+// hosts cannot be checked, they are waited for a while. The returned
+// function removes the lock file.
+func lockJournal(path string) (func(), error) {
+	lockPath := path + ".lock"
+	host, _ := os.Hostname()
+	deadline := time.Now().Add(journalLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%s %d\n", host, os.Getpid())
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		owner, _ := ioutil.ReadFile(lockPath)
+		if isStaleLock(string(owner), host) {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("journal is locked by %s (%s) for %v, remove the lock file if that run is gone",
+				lockPath, strings.TrimSpace(string(owner)), journalLockTimeout)
+		}
+		time.Sleep(journalLockPoll)
+	}
+}
+
+// isStaleLock reports whether lock file content names a process of the host
+// which is not running.
+func isStaleLock(owner, host string) bool {
+	fields := strings.Fields(owner)
+	if len(fields) != 2 || fields[0] != host {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[1])
+	return err == nil && !processExists(pid)
+}
+
+func digestFile(name string) journalFile {
+	file := journalFile{Name: absolutePath(name)}
+	f, err := os.Open(name)
+	if err != nil {
+		return file
+	}
+	defer f.Close()
+	h := sha256.New()
+	file.Size, err = io.Copy(h, f)
+	if err == nil {
+		file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	return file
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// validateJournal returns index of the first broken entry and the reason,
+// or -1 if the chain is intact.
+func validateJournal(entries []journalEntry) (int, string) {
+	previous := ""
+	for i, entry := range entries {
+		switch {
+		case entry.Sequence != i+1:
+			return i, fmt.Sprintf("sequence number %d, expected %d", entry.Sequence, i+1)
+		case entry.Previous != previous:
+			return i, "previous entry hash does not match"
+		case entry.Hash != entry.digest():
+			return i, "entry hash does not match its content"
+		}
+		previous = entry.Hash
+	}
+	return -1, ""
+}
+
+// validate checks the journal chain and optionally that output files
+// recorded in it are unchanged. Exit code is 0 if the journal is valid.
+func validate(args *validateArgs) int {
+	entries, err := readJournal(args.journalPath)
+	checkErr(err)
+	if len(entries) == 0 {
+		fatalf("no entries found in journal %s.", args.journalPath)
+	}
+	if broken, reason := validateJournal(entries); broken >= 0 {
+		fmt.Printf("Journal %s is broken at entry %d: %s.\n", args.journalPath, broken+1, reason)
+		return 1
+	}
+	finishStr := fmt.Sprintf("Journal %s is valid. \nEntries: %d, from %s to %s. Last entry hash: %s.",
+		args.journalPath, len(entries), entries[0].Started, entries[len(entries)-1].Finished, entries[len(entries)-1].Hash)
+
+	if args.checkOutputs {
+		changed := 0
+		for _, entry := range entries {
+			for _, output := range entry.Outputs {
+				if output.SHA256 == "" {
+					continue
+				}
+				if current := digestFile(output.Name); current.SHA256 != output.SHA256 {
+					changed++
+					finishStr += fmt.Sprintf("\nWARNING: output file %s of entry %d is changed or missing.", output.Name, entry.Sequence)
+				}
+			}
+		}
+		if changed > 0 {
+			fmt.Println(finishStr)
+			return 1
+		}
+		finishStr += "\nRecorded output files are unchanged."
+	}
+	fmt.Println(finishStr)
+	return 0
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	locateUnallocated   = "unallocated"
+	locateUnpartitioned = "unpartitioned"
+	locateUnknown       = "unknown"
+)
+
+// locatedPiece collects objects found in a piece of a diff range
+type locatedPiece struct {
+	diffPiece
+	start   int64
+	length  int64
+	objects map[string]string // path to object kind
+	covered int64
+}
+
+// locate lists files, directories and file system metadata which occupy
+// different LBA ranges listed in a diff file.
+func locate(args *locateArgs) {
+	diffRanges, sectorSize := readDiffRanges(args.diffInput, args.sectorSize)
+	_, err := args.input.Seek(0, io.SeekStart)
+	checkErr(err)
+
+	// Partition table of diffs in byte offsets is read in sectors of default size
+	tableSectorSize := sectorSize
+	if sectorSize == cdcByteSectorSize {
+		tableSectorSize = defaultSectorSize
+	}
+	volumes, err := readVolumes(args.input, tableSectorSize)
+	if err != nil {
+		fmt.Printf("No partition table found (%v), input is treated as a single volume.\n", err)
+	}
+	annotation := diffAnnotation{partitions: volumes, sectorSize: sectorSize}
+
+	var pieces []*locatedPiece
+	for _, r := range diffRanges {
+		for _, piece := range annotation.split(r[0], r[1]) {
+			start, length := sectorToBytes(piece.startLba, piece.endLba, sectorSize)
+			pieces = append(pieces, &locatedPiece{diffPiece: piece, start: start, length: length, objects: map[string]string{}})
+		}
+	}
+
+	fileSystems := make(map[int]string)
+	var warnings []string
+	for _, volume := range volumes {
+		volumePieces := piecesInVolume(pieces, volume)
+		if len(volumePieces) == 0 {
+			continue
+		}
+		fs, err := openFileSystem(&volumeReader{input: args.input, start: volume.start, size: volume.length}, volume.length)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", volumeName(volume), err))
+			fileSystems[volume.number] = locateUnknown
+			continue
+		}
+		fileSystems[volume.number] = fs.name()
+		err = fs.walk(func(kind, path string, start, length int64) {
+			addLocatedObject(volumePieces, kind, path, volume.start+start, length)
+		})
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s walk stopped: %v", volumeName(volume), fs.name(), err))
+		}
+	}
+
+	out := args.createOutputFile()
+	defer out.Close()
+	writeLocations(out, pieces, fileSystems, sectorSize)
+
+	finishStr := fmt.Sprintf("Different ranges located. \nInput data file: %s. Input diff file: %s. \nLocations written to %s.",
+		describeInput(args.input), args.diffInput.Name(), out.Name())
+	for _, warning := range warnings {
+		finishStr += "\nWARNING: " + warning
+	}
+	fmt.Println(finishStr)
+}
+
+// readVolumes returns partitions of the input, or the whole input as a single
+// volume if there is no partition table.
+func readVolumes(input inputFile, sectorSize int64) ([]partition, error) {
+	_, partitions, err := readPartitionTable(input, sectorSize)
+	if err != nil || len(partitions) == 0 {
+		return []partition{{start: 0, length: fileSize(input)}}, err
+	}
+	size := fileSize(input)
+	for i := range partitions {
+		partitions[i].length = minInt64(partitions[i].length, size-partitions[i].start)
+	}
+	return partitions, nil
+}
+
+func volumeName(volume partition) string {
+	if volume.number == 0 {
+		return "volume"
+	}
+	return fmt.Sprintf("partition %d", volume.number)
+}
+
+func piecesInVolume(pieces []*locatedPiece, volume partition) []*locatedPiece {
+	var found []*locatedPiece
+	for _, piece := range pieces {
+		if piece.inPartition && piece.partition.number == volume.number {
+			found = append(found, piece)
+		}
+	}
+	return found
+}
+
+// addLocatedObject records an object in pieces its byte range intersects.
+// Pieces are sorted by start.
+func addLocatedObject(pieces []*locatedPiece, kind, path string, start, length int64) {
+	end := start + length
+	first := sort.Search(len(pieces), func(i int) bool {
+		return pieces[i].start+pieces[i].length > start
+	})
+	for _, piece := range pieces[first:] {
+		if piece.start >= end {
+			break
+		}
+		overlap := minInt64(end, piece.start+piece.length) - maxInt64(start, piece.start)
+		piece.objects[path] = kind
+		piece.covered += overlap
+	}
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func writeLocations(out outputFile, pieces []*locatedPiece, fileSystems map[int]string, sectorSize int64) {
+	var metadata [][2]string
+	if sectorSize != defaultSectorSize {
+		metadata = append(metadata, [2]string{"sectorsize", fmt.Sprintf("%d", sectorSize)})
+	}
+	metadata = append(metadata, [2]string{"columns", "startlba,endlba,partition,filesystem,kind,path"})
+	writeMetadata(out, metadata)
+	csvWriter := createCsvWriter(out)
+	for _, piece := range pieces {
+		prefix := []string{fmt.Sprintf("%d", piece.startLba), fmt.Sprintf("%d", piece.endLba), "", ""}
+		if !piece.inPartition {
+			lnCheckErr(csvWriter.Write(append(prefix, locateUnpartitioned, "")))
+			continue
+		}
+		if piece.partition.number != 0 {
+			prefix[2] = fmt.Sprintf("%d", piece.partition.number)
+		}
+		prefix[3] = fileSystems[piece.partition.number]
+		if prefix[3] == locateUnknown {
+			lnCheckErr(csvWriter.Write(append(prefix, locateUnknown, "")))
+			continue
+		}
+
+		paths := make([]string, 0, len(piece.objects))
+		for path := range piece.objects {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			lnCheckErr(csvWriter.Write(append(prefix, piece.objects[path], path)))
+		}
+		// Objects of consistent file system do not overlap, so space
+		// is left unallocated if they cover less than the piece.
+		if piece.covered < piece.length {
+			lnCheckErr(csvWriter.Write(append(prefix, locateUnallocated, "")))
+		}
+	}
+	csvWriter.Flush()
+	lnCheckErr(csvWriter.Error())
+}
+
+// readDiffRanges reads LBA ranges from CSV or JSON diff file written by
+// verify. Error lines are skipped. Ranges are sorted by start LBA.
+func readDiffRanges(diffs inputFile, sectorSize int64) (lbas [][2]int64, diffSectorSize int64) {
+	diffSectorSize = defaultSectorSize
+	if value, ok := readMetadata(diffs)["sectorsize"]; ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 || parsed&(parsed-1) != 0 {
+			fatalf("invalid sector size '%s' in diff file.", value)
+		}
+		diffSectorSize = parsed
+		if sectorSize != 0 && sectorSize != diffSectorSize {
+			fatalf("diff file LBAs are in %d-byte sectors, but sector size %d is specified.", diffSectorSize, sectorSize)
+		}
+	} else if sectorSize != 0 {
+		diffSectorSize = sectorSize
+	}
+
+	reader := bufio.NewReader(diffs)
+	head, _ := reader.Peek(64)
+	if bytes.HasPrefix(bytes.TrimSpace(head), []byte("[")) {
+		var entries []jsonDiff
+		if err := json.NewDecoder(reader).Decode(&entries); err != nil {
+			fatalf("invalid JSON diff file: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.StartLba != nil && entry.EndLba != nil {
+				lbas = append(lbas, [2]int64{*entry.StartLba, *entry.EndLba})
+			}
+		}
+	} else {
+		csvReader := createCsvReader(reader)
+		for {
+			record, err := csvReader.Read()
+			if err == io.EOF {
+				break
+			}
+			checkErr(err)
+			if len(record) < 2 {
+				continue
+			}
+			startLba, startErr := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+			endLba, endErr := strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64)
+			if startErr != nil || endErr != nil || endLba < startLba {
+				continue
+			}
+			lbas = append(lbas, [2]int64{startLba, endLba})
+		}
+	}
+	if len(lbas) == 0 {
+		fatal("no different LBA ranges found in diff file.")
+	}
+
+	sort.Slice(lbas, func(i, j int) bool { return lbas[i][0] < lbas[j][0] })
+	return lbas, diffSectorSize
+}
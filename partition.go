@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Partition-aware segmentation aligns segments to partitions and to gaps
+// between them, so a mismatch can be attributed to a single volume.
+// Partitions are found in MBR with extended partitions chain or in GPT.
+
+const (
+	partitionSchemeMBR = "mbr"
+	partitionSchemeGPT = "gpt"
+
+	mbrSize              = 512
+	mbrEntriesOffset     = 446
+	mbrEntrySize         = 16
+	mbrProtectiveType    = 0xee
+	maxLogicalPartitions = 128
+	gptHeaderMinSize     = 92
+	gptMaxEntries        = 1024
+)
+
+var gptSignature = []byte("EFI PART")
+
+// partition is a volume found in the partition table of the input
+type partition struct {
+	number   int
+	typeCode string // MBR partition type as hex byte or GPT partition type GUID
+	name     string // GPT partition name
+	start    int64
+	length   int64
+}
+
+var mbrPartitionTypes = map[string]string{
+	"01": "FAT12",
+	"04": "FAT16",
+	"05": "Extended",
+	"06": "FAT16",
+	"07": "NTFS/exFAT",
+	"0b": "FAT32",
+	"0c": "FAT32 LBA",
+	"0e": "FAT16 LBA",
+	"0f": "Extended LBA",
+	"27": "Windows recovery",
+	"82": "Linux swap",
+	"83": "Linux",
+	"85": "Linux extended",
+	"8e": "Linux LVM",
+	"a5": "FreeBSD",
+	"a8": "Apple UFS",
+	"af": "Apple HFS+",
+	"fd": "Linux RAID",
+}
+
+var gptPartitionTypes = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI System",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"E3C9E316-0B5C-4DB8-817D-F92DF00215AE": "Microsoft reserved",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+	"DE94BBA4-06D1-4D40-A16A-BFD50179D6AC": "Windows recovery",
+	"5808C8AA-7E8F-42E0-85D2-E1E90434CFB3": "Windows LDM metadata",
+	"AF9B60A0-1431-4F62-BC68-3311714A69AD": "Windows LDM data",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"933AC7E1-2EB4-4F13-B844-0E14E2AEF915": "Linux home",
+	"48465300-0000-11AA-AA11-00306543ECAC": "Apple HFS+",
+	"7C3457EF-0000-11AA-AA11-00306543ECAC": "Apple APFS",
+	"516E7CB4-6ECF-11D6-8FF8-00022D09712B": "FreeBSD",
+}
+
+// typeName returns human readable partition type, or its code if the type
+// is unknown.
+func (p partition) typeName() string {
+	if name, ok := mbrPartitionTypes[p.typeCode]; ok {
+		return name
+	}
+	if name, ok := gptPartitionTypes[p.typeCode]; ok {
+		return name
+	}
+	return p.typeCode
+}
+
+func isExtendedPartitionType(partitionType byte) bool {
+	return partitionType == 0x05 || partitionType == 0x0f || partitionType == 0x85
+}
+
+// guidString formats GUID stored with mixed endianness as in GPT.
+func guidString(b []byte) string {
+	s := strings.ToUpper(hex.EncodeToString([]byte{
+		b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6],
+		b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15]}))
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// readPartitionTable finds partitions of the input. GPT is looked for
+// in sectors of specified size first, then in 512 and 4096-byte sectors.
+func readPartitionTable(input io.ReadSeeker, sectorSize int64) (scheme string, partitions []partition, err error) {
+	mbr := make([]byte, mbrSize)
+	if _, err = readAt(input, mbr, 0); err != nil {
+		return "", nil, fmt.Errorf("cannot read MBR: %v", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return "", nil, errors.New("no MBR or GPT partition table found")
+	}
+	for i := 0; i < 4; i++ {
+		entry := mbr[mbrEntriesOffset+i*mbrEntrySize:]
+		if entry[0] != 0 && entry[0] != 0x80 {
+			// Volume boot record has the same signature as MBR
+			return "", nil, errors.New("no MBR or GPT partition table found")
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if mbr[mbrEntriesOffset+i*mbrEntrySize+4] == mbrProtectiveType {
+			partitions, err = readGPT(input, sectorSize)
+			return partitionSchemeGPT, partitions, err
+		}
+	}
+	partitions, err = readMBR(input, mbr, sectorSize)
+	return partitionSchemeMBR, partitions, err
+}
+
+// readMBR lists primary partitions and logical partitions of the extended
+// partition. Logical partitions are numbered from 5.
+func readMBR(input io.ReadSeeker, mbr []byte, sectorSize int64) ([]partition, error) {
+	var partitions []partition
+	for i := 0; i < 4; i++ {
+		entry := mbr[mbrEntriesOffset+i*mbrEntrySize:]
+		partitionType := entry[4]
+		start := int64(binary.LittleEndian.Uint32(entry[8:]))
+		count := int64(binary.LittleEndian.Uint32(entry[12:]))
+		if partitionType == 0 || count == 0 {
+			continue
+		}
+		if isExtendedPartitionType(partitionType) {
+			logical, err := readExtendedPartitions(input, start, sectorSize, 5)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, logical...)
+			continue
+		}
+		partitions = append(partitions, partition{
+			number:   i + 1,
+			typeCode: fmt.Sprintf("%02x", partitionType),
+			start:    start * sectorSize,
+			length:   count * sectorSize,
+		})
+	}
+	return partitions, nil
+}
+
+// readExtendedPartitions follows the chain of extended boot records. The first
+// entry of EBR describes a logical partition relative to the EBR, the second
+// one points to the next EBR relative to the extended partition start.
+func readExtendedPartitions(input io.ReadSeeker, extendedStart, sectorSize int64, number int) ([]partition, error) {
+	var partitions []partition
+	ebr := make([]byte, mbrSize)
+	for ebrStart := extendedStart; len(partitions) < maxLogicalPartitions; {
+		if _, err := readAt(input, ebr, ebrStart*sectorSize); err != nil {
+			return nil, fmt.Errorf("cannot read extended boot record at LBA %d: %v", ebrStart, err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return nil, fmt.Errorf("invalid extended boot record at LBA %d", ebrStart)
+		}
+		entry := ebr[mbrEntriesOffset:]
+		if count := int64(binary.LittleEndian.Uint32(entry[12:])); entry[4] != 0 && count > 0 {
+			partitions = append(partitions, partition{
+				number:   number + len(partitions),
+				typeCode: fmt.Sprintf("%02x", entry[4]),
+				start:    (ebrStart + int64(binary.LittleEndian.Uint32(entry[8:]))) * sectorSize,
+				length:   count * sectorSize,
+			})
+		}
+		next := ebr[mbrEntriesOffset+mbrEntrySize:]
+		if !isExtendedPartitionType(next[4]) {
+			break
+		}
+		nextStart := extendedStart + int64(binary.LittleEndian.Uint32(next[8:]))
+		if nextStart <= ebrStart {
+			return nil, fmt.Errorf("extended boot records chain loops at LBA %d", ebrStart)
+		}
+		ebrStart = nextStart
+	}
+	return partitions, nil
+}
+
+// readGPT lists partitions of GUID partition table which header is at LBA 1.
+func readGPT(input io.ReadSeeker, sectorSize int64) ([]partition, error) {
+	header := make([]byte, gptHeaderMinSize)
+	found := false
+	for _, size := range []int64{sectorSize, 512, 4096} {
+		if _, err := readAt(input, header, size); err == nil && bytes.Equal(header[:8], gptSignature) {
+			sectorSize = size
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("protective MBR found, but GPT header is missing")
+	}
+
+	headerSize := int64(binary.LittleEndian.Uint32(header[12:]))
+	if headerSize < gptHeaderMinSize || headerSize > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+	header = make([]byte, headerSize)
+	if _, err := readAt(input, header, sectorSize); err != nil {
+		return nil, err
+	}
+	storedCRC := binary.LittleEndian.Uint32(header[16:])
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	if crc32.ChecksumIEEE(header) != storedCRC {
+		return nil, errors.New("GPT header checksum mismatch")
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:]))
+	entriesCount := int64(binary.LittleEndian.Uint32(header[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if entriesCount > gptMaxEntries || entrySize < 128 || entrySize%8 != 0 {
+		return nil, fmt.Errorf("invalid GPT partition entries array: %d entries of %d bytes", entriesCount, entrySize)
+	}
+	entries := make([]byte, entriesCount*entrySize)
+	if _, err := readAt(input, entries, entriesLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read GPT partition entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		return nil, errors.New("GPT partition entries checksum mismatch")
+	}
+
+	var partitions []partition
+	for i := int64(0); i < entriesCount; i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(entry[32:]))
+		last := int64(binary.LittleEndian.Uint64(entry[40:]))
+		if last < first {
+			return nil, fmt.Errorf("GPT partition %d has invalid LBA range (%d, %d)", i+1, first, last)
+		}
+		partitions = append(partitions, partition{
+			number:   int(i + 1),
+			typeCode: guidString(entry[:16]),
+			name:     decodeUTF16(entry[56:128]),
+			start:    first * sectorSize,
+			length:   (last - first + 1) * sectorSize,
+		})
+	}
+	return partitions, nil
+}
+
+// partitionAreas splits input of specified size into partitions and gaps
+// between them. Partitions are clipped to the input size.
+func partitionAreas(partitions []partition, size, sectorSize int64) ([]readRange, error) {
+	sorted := append([]partition(nil), partitions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	var areas []readRange
+	position := int64(0)
+	for _, p := range sorted {
+		if p.start%sectorSize != 0 || p.length%sectorSize != 0 {
+			return nil, fmt.Errorf("partition %d is not aligned to %d-byte sectors", p.number, sectorSize)
+		}
+		if p.start < position {
+			return nil, fmt.Errorf("partition %d overlaps another partition", p.number)
+		}
+		if p.start >= size {
+			continue
+		}
+		if p.start > position {
+			areas = append(areas, readRange{start: position, length: p.start - position})
+		}
+		position = minInt64(p.start+p.length, size)
+		areas = append(areas, readRange{start: p.start, length: position - p.start})
+	}
+	if position < size {
+		areas = append(areas, readRange{start: position, length: size - position})
+	}
+	return areas, nil
+}
+
+// partitionAt returns the partition containing specified offset.
+func partitionAt(partitions []partition, offset int64) (partition, bool) {
+	for _, p := range partitions {
+		if offset >= p.start && offset < p.start+p.length {
+			return p, true
+		}
+	}
+	return partition{}, false
+}
@@ -0,0 +1,42 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+	lowestNice       = 19
+)
+
+// lowerPriority sets idle I/O class and the lowest CPU priority. Linux
+// priorities belong to threads, so all threads of the process are changed
+// and threads started later inherit them.
+func lowerPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowestNice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import (
+	"errors"
+)
+
+func lowerPriority() error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/atola-technology/seghash/external/github.com/cheggaaa/pb"
+)
+
+const (
+	progressBar   = "bar"
+	progressJSONL = "jsonl"
+	progressNone  = "none"
+
+	progressInterval = time.Second
+	progressMismatch = "Progress percentage is different from 100 due to overlapping or lack of segments in hashes file (different data size was expected to be processed)."
+)
+
+type progressOptions struct {
+	format    string
+	output    io.Writer // jsonl events are written to, stderr by default
+	reporting *bool     // a jsonl reporter is created, it writes the summary of a failure
+}
+
+// progressReporter shows progress of reading input and events of a command
+type progressReporter interface {
+	add(n int64)
+	segment(startLba, endLba int64) // segment being read
+	mismatch()
+	warning(message string)
+	finish(finishStr string)
+}
+
+type noProgress struct{}
+
+func (noProgress) add(n int64)                    {}
+func (noProgress) segment(startLba, endLba int64) {}
+func (noProgress) mismatch()                      {}
+func (noProgress) warning(message string)         {}
+func (noProgress) finish(finishStr string)        {}
+
+// resultProgress shows no progress, only the final report
+type resultProgress struct {
+	noProgress
+}
+
+func (resultProgress) finish(finishStr string) {
+	fmt.Println(finishStr)
+}
+
+// barProgress shows progress bar in terminal
+type barProgress struct {
+	bar     *pb.ProgressBar
+	started bool
+}
+
+func (p *barProgress) add(n int64) {
+	if !p.started {
+		p.started = true
+		p.bar.Start()
+	}
+	p.bar.Add64(n)
+}
+
+func (p *barProgress) segment(startLba, endLba int64) {}
+func (p *barProgress) mismatch()                      {}
+func (p *barProgress) warning(message string)         {}
+
+func (p *barProgress) finish(finishStr string) {
+	if p.bar.Total > 0 && p.bar.Get() != p.bar.Total {
+		finishStr = progressMismatch + "\n" + finishStr
+	}
+	p.bar.FinishPrint(finishStr)
+}
+
+// jsonProgress writes a JSON object per line: progress events periodically,
+// warning events as they happen and a summary event at the end.
+type jsonProgress struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	command    string
+	total      int64
+	done       int64
+	started    time.Time
+	current    *jsonSegment
+	mismatches int
+	warnings   int
+	finished   bool // summary is written, no events follow it
+	stop       chan struct{}
+}
+
+type jsonSegment struct {
+	StartLba int64 `json:"startlba"`
+	EndLba   int64 `json:"endlba"`
+}
+
+type jsonProgressEvent struct {
+	Event      string       `json:"event"`
+	Command    string       `json:"command"`
+	Time       string       `json:"time"`
+	Bytes      int64        `json:"bytes"`
+	Total      int64        `json:"total,omitempty"`
+	Rate       float64      `json:"rate"`          // bytes per second
+	ETA        *float64     `json:"eta,omitempty"` // seconds
+	Elapsed    float64      `json:"elapsed"`       // seconds
+	Segment    *jsonSegment `json:"segment,omitempty"`
+	Mismatches int          `json:"mismatches"`
+	Warnings   int          `json:"warnings"`
+	Message    string       `json:"message,omitempty"`
+	Error      string       `json:"error,omitempty"` // summary of a failed command
+}
+
+func createJSONProgress(total int64, out io.Writer, command string) *jsonProgress {
+	p := &jsonProgress{out: out, command: command, total: total, started: time.Now(), stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mutex.Lock()
+				if !p.finished {
+					p.write(p.event("progress"))
+				}
+				p.mutex.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	// Front end gets the summary event of a failed command too
+	fatalHooks = append(fatalHooks, p.fail)
+	return p
+}
+
+// writeFailureSummary makes a command failing before its progress reporter
+// is created write the summary event too, e.g. if the input is missing.
+func writeFailureSummary(opts *progressOptions, command string) {
+	reporting := false
+	opts.reporting = &reporting
+	p := &jsonProgress{out: opts.output, command: command, started: time.Now(), stop: make(chan struct{})}
+	fatalHooks = append(fatalHooks, func(message string) {
+		if !reporting {
+			p.fail(message)
+		}
+	})
+}
+
+// event fills an event with current state, mutex must be held
+func (p *jsonProgress) event(name string) jsonProgressEvent {
+	elapsed := time.Since(p.started).Seconds()
+	e := jsonProgressEvent{Event: name, Command: p.command, Time: time.Now().UTC().Format(time.RFC3339),
+		Bytes: p.done, Total: p.total, Elapsed: elapsed, Segment: p.current, Mismatches: p.mismatches, Warnings: p.warnings}
+	if elapsed > 0 {
+		e.Rate = float64(p.done) / elapsed
+	}
+	if p.total > 0 && e.Rate > 0 && name == "progress" {
+		eta := float64(p.total-p.done) / e.Rate
+		if eta < 0 {
+			eta = 0
+		}
+		e.ETA = &eta
+	}
+	return e
+}
+
+func (p *jsonProgress) write(e jsonProgressEvent) {
+	data, err := json.Marshal(e)
+	lnCheckErr(err)
+	// Progress consumer may go away, it must not stop the command. SIGPIPE
+	// is ignored with jsonl progress, so a write error is returned instead.
+	fmt.Fprintf(p.out, "%s\n", data)
+}
+
+func (p *jsonProgress) add(n int64) {
+	p.mutex.Lock()
+	p.done += n
+	p.mutex.Unlock()
+}
+
+func (p *jsonProgress) segment(startLba, endLba int64) {
+	p.mutex.Lock()
+	p.current = &jsonSegment{StartLba: startLba, EndLba: endLba}
+	p.mutex.Unlock()
+}
+
+func (p *jsonProgress) mismatch() {
+	p.mutex.Lock()
+	p.mismatches++
+	p.mutex.Unlock()
+}
+
+func (p *jsonProgress) warning(message string) {
+	p.mutex.Lock()
+	p.warnings++
+	e := p.event("warning")
+	e.Message = message
+	p.write(e)
+	p.mutex.Unlock()
+}
+
+func (p *jsonProgress) finish(finishStr string) {
+	if p.total > 0 && p.done != p.total {
+		finishStr = progressMismatch + "\n" + finishStr
+	}
+	p.summary(finishStr, "")
+	fmt.Println(finishStr)
+}
+
+// fail writes summary event of the command stopped by an error
+func (p *jsonProgress) fail(message string) {
+	p.summary("", message)
+}
+
+func (p *jsonProgress) summary(finishStr, errorMessage string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	close(p.stop)
+	e := p.event("summary")
+	e.Segment = nil
+	e.Message = finishStr
+	e.Error = errorMessage
+	p.write(e)
+}
+
+// trackSegments reports ranges as they are taken for reading
+func trackSegments(in <-chan readRange, progress progressReporter, sectorSize int64) <-chan readRange {
+	out := make(chan readRange)
+	go func() {
+		defer close(out)
+		for r := range in {
+			out <- r
+			startLba, endLba := bytesToSectors(r.start, r.length, sectorSize)
+			progress.segment(startLba, endLba)
+		}
+	}()
+	return out
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// QCOW2 virtual disk maps guest clusters to host clusters through
+// two-level L1/L2 tables. Unallocated clusters are read from the backing
+// file if there is one, otherwise they are zero.
+
+const (
+	qcow2HeaderSize          = 72
+	qcow2OffsetMask          = 0x00fffffffffffe00
+	qcow2CompressedFlag      = 1 << 62
+	qcow2ZeroFlag            = 1
+	qcow2IncompatibleDirty   = 1
+	qcow2IncompatibleCorrupt = 2
+)
+
+var qcow2Signature = []byte("QFI\xfb")
+
+type qcow2Image struct {
+	file        io.ReaderAt
+	clusterBits uint
+	clusterSize int64
+	size        int64
+	l1          []uint64
+	l2Entries   int64
+	backing     parentDisk
+
+	mutex          sync.Mutex
+	cachedL2Offset int64
+	cachedL2       []byte
+	cachedHost     int64
+	cachedCluster  []byte
+}
+
+func openQCOW2(f *os.File) (inputFile, error) {
+	img, closers, err := newQCOW2(f, f.Name(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFile{reader: img, size: img.size, file: f, format: "QCOW2", closers: closers}, nil
+}
+
+func newQCOW2(f io.ReaderAt, name string, depth int) (*qcow2Image, []io.Closer, error) {
+	header, err := readBytesAt(f, 0, qcow2HeaderSize+32)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(header, qcow2Signature) {
+		return nil, nil, errors.New("invalid QCOW2 signature")
+	}
+	version := binary.BigEndian.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, nil, fmt.Errorf("QCOW2 version %d is not supported", version)
+	}
+	if binary.BigEndian.Uint32(header[32:]) != 0 {
+		return nil, nil, errors.New("encrypted QCOW2 images are not supported")
+	}
+	if version == 3 {
+		incompatible := binary.BigEndian.Uint64(header[72:])
+		if incompatible&^(qcow2IncompatibleDirty|qcow2IncompatibleCorrupt) != 0 {
+			return nil, nil, fmt.Errorf("QCOW2 incompatible features 0x%x are not supported", incompatible)
+		}
+	}
+
+	img := &qcow2Image{
+		file:           f,
+		clusterBits:    uint(binary.BigEndian.Uint32(header[20:])),
+		size:           int64(binary.BigEndian.Uint64(header[24:])),
+		cachedL2Offset: -1,
+		cachedHost:     -1,
+	}
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return nil, nil, fmt.Errorf("invalid QCOW2 cluster bits %d", img.clusterBits)
+	}
+	img.clusterSize = 1 << img.clusterBits
+	img.l2Entries = img.clusterSize / 8
+
+	l1Size := int64(binary.BigEndian.Uint32(header[36:]))
+	l1Offset := int64(binary.BigEndian.Uint64(header[40:]))
+	l1, err := readBytesAt(f, l1Offset, l1Size*8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("QCOW2 L1 table: %v", err)
+	}
+	img.l1 = make([]uint64, l1Size)
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(l1[i*8:])
+	}
+
+	var closers []io.Closer
+	backingOffset := int64(binary.BigEndian.Uint64(header[8:]))
+	backingNameSize := int64(binary.BigEndian.Uint32(header[16:]))
+	if backingOffset != 0 && backingNameSize > 0 {
+		backingName, err := readBytesAt(f, backingOffset, backingNameSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("QCOW2 backing file name: %v", err)
+		}
+		img.backing, closers, err = openParentDisk(string(backingName), name, depth+1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("QCOW2 backing file: %v", err)
+		}
+	}
+	return img, closers, nil
+}
+
+// l2Entry returns L2 table entry of the guest cluster, zero if unallocated
+func (img *qcow2Image) l2Entry(cluster int64) (uint64, error) {
+	l1Index := cluster / img.l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return 0, nil
+	}
+	l2Offset := int64(img.l1[l1Index] & qcow2OffsetMask)
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	if l2Offset != img.cachedL2Offset {
+		l2, err := readBytesAt(img.file, l2Offset, img.clusterSize)
+		if err != nil {
+			return 0, fmt.Errorf("QCOW2 L2 table at %d: %v", l2Offset, err)
+		}
+		img.cachedL2Offset, img.cachedL2 = l2Offset, l2
+	}
+	return binary.BigEndian.Uint64(img.cachedL2[(cluster%img.l2Entries)*8:]), nil
+}
+
+func (img *qcow2Image) readCompressed(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (img.clusterBits - 8)
+	offset := int64(entry & (1<<offsetBits - 1))
+	if offset == img.cachedHost {
+		return img.cachedCluster, nil
+	}
+	sectors := int64(entry>>offsetBits&(1<<(img.clusterBits-8)-1)) + 1
+	compressedSize := sectors*512 - offset&511
+
+	compressed := make([]byte, compressedSize)
+	// Compressed data may end before the last sector which is end of file
+	n, err := img.file.ReadAt(compressed, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	cluster := make([]byte, img.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), cluster); err != nil {
+		return nil, fmt.Errorf("QCOW2 compressed cluster at %d: %v", offset, err)
+	}
+	img.cachedHost, img.cachedCluster = offset, cluster
+	return cluster, nil
+}
+
+func (img *qcow2Image) ReadAt(p []byte, off int64) (n int, err error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	for n < len(p) && off < img.size {
+		cluster := off >> img.clusterBits
+		within := off & (img.clusterSize - 1)
+		end := minInt64(int64(len(p)), int64(n)+minInt64(img.clusterSize-within, img.size-off))
+		part := p[n:end]
+
+		entry, err := img.l2Entry(cluster)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case entry&qcow2CompressedFlag != 0:
+			var data []byte
+			if data, err = img.readCompressed(entry); err == nil {
+				copy(part, data[within:])
+			}
+		case entry&qcow2ZeroFlag != 0:
+			zeroFill(part)
+		case entry&qcow2OffsetMask == 0:
+			err = img.backing.readAt(part, off)
+		default:
+			_, err = img.file.ReadAt(part, int64(entry&qcow2OffsetMask)+within)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
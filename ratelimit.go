@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const rateControlInterval = time.Second
+
+// ioLimits keeps reading from disturbing other users of the storage
+type ioLimits struct {
+	rate        int64 // bytes per second, 0 is unlimited
+	controlFile string
+	lowPriority bool
+}
+
+// apply lowers priority of the process if requested and returns
+// the limiter of read rate
+func (limits ioLimits) apply() *rateLimiter {
+	if limits.lowPriority {
+		if err := lowerPriority(); err != nil {
+			fmt.Printf("WARNING: priority cannot be lowered: %v\n", err)
+		}
+	}
+	return newRateLimiter(limits.rate, limits.controlFile)
+}
+
+// rateLimiter keeps the read rate under the limit, so hashing on shared
+// storage leaves bandwidth to others. The limit is re-read from the control
+// file while running if it is set. Methods of nil limiter do nothing.
+type rateLimiter struct {
+	rate        int64 // bytes per second, 0 is unlimited
+	controlFile string
+	checked     time.Time
+	start       time.Time
+	bytes       int64               // read since start
+	now         func() time.Time    // clock, replaced in tests
+	sleep       func(time.Duration) // advances the clock
+}
+
+func newRateLimiter(rate int64, controlFile string) *rateLimiter {
+	if rate == 0 && controlFile == "" {
+		return nil
+	}
+	l := &rateLimiter{rate: rate, controlFile: controlFile, now: time.Now, sleep: time.Sleep}
+	l.start = l.now()
+	l.control()
+	return l
+}
+
+// control reads the limit from the control file at most once per interval.
+// Missing file or invalid content leaves the limit unchanged.
+func (l *rateLimiter) control() {
+	if l.controlFile == "" || l.now().Sub(l.checked) < rateControlInterval {
+		return
+	}
+	l.checked = l.now()
+	data, err := ioutil.ReadFile(l.controlFile)
+	if err != nil {
+		return
+	}
+	var rate strictBytesValue
+	if rate.Set(strings.TrimSpace(string(data))) != nil || rate < 0 {
+		return
+	}
+	if int64(rate) != l.rate {
+		l.rate = int64(rate)
+		l.start, l.bytes = l.now(), 0
+	}
+}
+
+// wait blocks until n more bytes may be read under the limit
+func (l *rateLimiter) wait(n int64) {
+	if l == nil {
+		return
+	}
+	l.bytes += n
+	for {
+		l.control()
+		if l.rate == 0 {
+			return
+		}
+		due := l.start.Add(time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second)))
+		delay := due.Sub(l.now())
+		if delay <= 0 {
+			// Reading slower than the limit does not allow bursts later
+			if -delay > rateControlInterval {
+				l.start, l.bytes = l.now(), 0
+			}
+			return
+		}
+		if delay > rateControlInterval {
+			delay = rateControlInterval
+		}
+		l.sleep(delay)
+	}
+}
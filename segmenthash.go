@@ -1,7 +1,6 @@
 package main
 
 import (
-	"hash"
 	"io"
 	"os"
 )
@@ -17,46 +16,76 @@ const (
 	bufferSize = 2 * 1024 * 1024
 )
 
-func finalizeSegment(h hash.Hash, seg segment, out chan<- segment) segment {
-	seg.hash = h.Sum(nil)
-	out <- seg
-	h.Reset()
-	return segment{}
-}
-
 func calculateHash(hc hashContainer, in <-chan segmentChunk) <-chan segment {
 	out := make(chan segment)
 
 	go func() {
 		defer close(out)
+		// Zero data is written to the hash only when non-zero data follows,
+		// so digests of all-zero segments are calculated once per length
+		zeroDigests := make(map[int64][]byte)
 		var currentSegment segment
+		var hashed, zeros int64
+		finalizeSegment := func() {
+			if hashed == 0 && zeros > 0 {
+				digest, ok := zeroDigests[zeros]
+				if !ok {
+					writeZeros(hc.h, zeros)
+					digest = hc.h.Sum(nil)
+					hc.h.Reset()
+					zeroDigests[zeros] = digest
+				}
+				currentSegment.hash = digest
+			} else {
+				writeZeros(hc.h, zeros)
+				currentSegment.hash = hc.h.Sum(nil)
+				hc.h.Reset()
+			}
+			if hc.stats != nil {
+				currentSegment.content = hc.stats.finish()
+			}
+			out <- currentSegment
+			currentSegment, hashed, zeros = segment{}, 0, 0
+		}
+
 		for chunk := range in {
-			_, err := hc.h.Write(chunk.data)
-			lnCheckErr(err)
+			if isZero(chunk.data) {
+				zeros += int64(len(chunk.data))
+			} else {
+				writeZeros(hc.h, zeros)
+				_, err := hc.h.Write(chunk.data)
+				lnCheckErr(err)
+				hashed += zeros + int64(len(chunk.data))
+				zeros = 0
+			}
+			if hc.stats != nil {
+				hc.stats.add(chunk.data)
+			}
 
 			// Setting rigth start offset for new segment
 			if currentSegment.length == 0 {
 				currentSegment.start = chunk.baseSegmentStart
 			}
 
-			currentSegment.length += int64(len(chunk.data))
+			currentSegment.length += int64(len(chunk.data)) + chunk.skipped
+			currentSegment.unreadable += chunk.unreadable
 
 			if chunk.isLast {
-				currentSegment = finalizeSegment(hc.h, currentSegment, out)
+				finalizeSegment()
 			}
 		}
 		if currentSegment.length > 0 {
-			finalizeSegment(hc.h, currentSegment, out)
+			finalizeSegment()
 		}
 	}()
 
 	return out
 }
 
-func readFile(input io.ReadSeeker, bufSize int64, consumersCount int, in <-chan readRange, progress func(n int64)) []chan segmentChunk {
+func readFile(input io.ReadSeeker, bufSize int64, consumersCount int, in <-chan readRange, progress func(n int64), opts readOptions) []chan segmentChunk {
 	buffers := make([][]byte, 2)
-	buffers[0] = make([]byte, bufSize)
-	buffers[1] = make([]byte, bufSize)
+	buffers[0] = alignedBuffer(bufSize, directIOAlignment)
+	buffers[1] = alignedBuffer(bufSize, directIOAlignment)
 	curBuffer := 0
 
 	out := make([]chan segmentChunk, consumersCount)
@@ -71,66 +100,154 @@ func readFile(input io.ReadSeeker, bufSize int64, consumersCount int, in <-chan
 			}
 		}()
 
-		var err error
-		currentReadOffset := int64(0)
+		if opts.directIO {
+			opts.directIO = enableDirectIO(input)
+		}
+		if !opts.directIO {
+			adviseSequential(input)
+		}
+
+		var holes *holeMap
+		if !opts.readHoles {
+			holes = newHoleMap(input)
+		}
+		position := int64(0)
 		for readRange := range in {
-			if readRange.start != currentReadOffset {
-				_, err = input.Seek(readRange.start, 0)
+			if readRange.start != position {
+				_, err := input.Seek(readRange.start, io.SeekStart)
 				lnCheckErr(err)
 			}
 
+			offset := readRange.start
 			for left := readRange.length; left > 0; {
-				bufferToRead := buffers[curBuffer]
-				if left < bufSize {
-					bufferToRead = buffers[curBuffer][:left]
+				var chunk segmentChunk
+				var eof bool
+				if hole := holes.holeLength(offset); hole > 0 {
+					// Holes are not read, zeros are passed instead
+					chunk.data = zeroBuffer[:minInt64(minInt64(hole, left), int64(len(zeroBuffer)))]
+					_, err := input.Seek(offset+int64(len(chunk.data)), io.SeekStart)
+					lnCheckErr(err)
+				} else {
+					bufferToRead := buffers[curBuffer]
+					if left < bufSize {
+						bufferToRead = buffers[curBuffer][:opts.readLength(left)]
+					}
+					chunk, eof = readChunk(input, bufferToRead, offset, opts)
+					opts.limiter.wait(int64(len(chunk.data)) + chunk.skipped)
+				}
+				n := int64(len(chunk.data)) + chunk.skipped
+				position = offset + n
+				if eof && opts.eof != nil {
+					close(opts.eof)
+					opts.eof = nil
 				}
-				n, err := input.Read(bufferToRead)
 				if n == 0 {
+					// Finish the segment at the end of data, an empty segment
+					// is finished if no data was read for the range
+					for i := range out {
+						out[i] <- segmentChunk{isLast: true, baseSegmentStart: readRange.start}
+					}
 					break
 				}
 
+				// Direct reads are rounded up and may pass the end of range
+				if n > left {
+					chunk.data = chunk.data[:int64(len(chunk.data))-(n-left)]
+					n = left
+					eof = false
+				}
+
+				if !opts.directIO {
+					dropCache(input, offset, n)
+				}
+
 				// Check whether last part was read
-				if n < len(bufferToRead) {
-					left = int64(n)
+				if eof {
+					left = n
 				}
 
-				left -= int64(n)
-				progress(int64(n))
+				left -= n
+				offset += n
+				progress(n)
 
+				chunk.isLast = left <= 0
+				chunk.baseSegmentStart = readRange.start
 				for i := range out {
-					out[i] <- segmentChunk{data: bufferToRead[:n], isLast: left <= 0, baseSegmentStart: readRange.start}
+					out[i] <- chunk
 				}
 
 				// Switch buffer
 				curBuffer = curBuffer ^ 1
 
-				if err != nil {
+				if eof {
 					break
 				}
 			}
-			if err != nil && err != io.EOF {
-				lnfatal(err)
-			}
-
-			currentReadOffset = readRange.start + readRange.length
 		}
 	}()
 
 	return out
 }
 
+// readChunk fills buf with data starting at offset. Read errors are fatal
+// unless opts allow to tolerate bad sectors.
+func readChunk(input io.ReadSeeker, buf []byte, offset int64, opts readOptions) (chunk segmentChunk, eof bool) {
+	n, err := io.ReadFull(input, buf)
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return segmentChunk{data: buf[:n]}, err != nil
+	}
+	if opts.badSectors == badSectorsFail {
+		lnfatalf("read error at offset %d: %v", offset+int64(n), err)
+	}
+
+	// Bad areas are read by sectors which are smaller than direct I/O alignment
+	if opts.directIO {
+		lnCheckErr(setDirectIO(input, false))
+		defer setDirectIO(input, true)
+	}
+
+	var unreadable []readRange
+	n, eof = readTolerant(input, buf, offset, opts.retries, int(opts.sectorSize), &unreadable)
+	_, err = input.Seek(offset+int64(n), io.SeekStart)
+	lnCheckErr(err)
+	opts.errorMap.add(unreadable)
+	return unreadableChunk(buf[:n], offset, unreadable, opts.badSectors == badSectorsSkip), eof
+}
+
+func diffsExitCode(diffs int) int {
+	if diffs > 254 {
+		diffs = 254
+	}
+	return diffs
+}
+
 func main() {
-	calcArgs, verifyArgs := parseArgs()
-	defer finalizeArgs(calcArgs, verifyArgs)
-
-	if calcArgs != nil {
-		calc(calcArgs, true)
-	} else if verifyArgs != nil {
-		diffs := verify(verifyArgs, true)
-		if diffs > 254 {
-			diffs = 254
+	args := parseArgs()
+	defer finalizeArgs(args)
+
+	if args.calc != nil {
+		outputFilenames := calc(args.calc, true)
+		result := journalResult{Status: journalCompleted}
+		if args.calc.teeVerify {
+			diffs := verifyImage(args.calc, outputFilenames[0], true)
+			result.Differences, result.ExitCode = &diffs, diffsExitCode(diffs)
+		}
+		checkErr(args.journal.finish(result))
+		if result.ExitCode != 0 {
+			os.Exit(result.ExitCode)
 		}
-		os.Exit(diffs)
+	} else if args.verify != nil {
+		diffs := verify(args.verify, true)
+		checkErr(args.journal.finish(journalResult{Status: journalCompleted, ExitCode: diffsExitCode(diffs), Differences: &diffs}))
+		os.Exit(diffsExitCode(diffs))
+	} else if args.locate != nil {
+		locate(args.locate)
+	} else if args.compare != nil {
+		os.Exit(diffsExitCode(compare(args.compare)))
+	} else if args.bench != nil {
+		bench(args.bench)
+	} else if args.validate != nil {
+		os.Exit(validate(args.validate))
 	} else {
 		fatal("invalid command arguments")
 	}
@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
 	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf16"
+
+	"github.com/atola-technology/seghash/external/github.com/alecthomas/kingpin"
 )
 
 const (
@@ -86,7 +101,7 @@ func TestPredefined(t *testing.T) {
 	createPredefinedData(fs, t)
 
 	input, _ := fs.Open(inputFilename)
-	calcArgs := &calcArgs{segmentSize: predefinedSegmentSize, input: input, hashNames: []string{md5Name, sha1Name}, createOutputFile: func(name string) outputFile {
+	calcArgs := &calcArgs{segmentSize: predefinedSegmentSize, sectorSize: defaultSectorSize, input: input, hashNames: []string{md5Name, sha1Name}, createOutputFile: func(name string) outputFile {
 		out, _ := fs.Create(name)
 		return out
 	}}
@@ -132,7 +147,7 @@ func TestSelf(t *testing.T) {
 	input.Close()
 
 	input, _ = fs.Open(inputFilename)
-	calcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, input: input, hashNames: []string{md5Name, sha1Name}, createOutputFile: func(name string) outputFile {
+	calcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, sectorSize: defaultSectorSize, input: input, hashNames: []string{md5Name, sha1Name}, createOutputFile: func(name string) outputFile {
 		out, _ := fs.Create(name)
 		return out
 	}}
@@ -163,7 +178,7 @@ func speedTest(hashName string) {
 	benchInput, _ := benchFs.Create(inputFilename)
 	rand.Read(inputBuf)
 	benchInput.Write(inputBuf)
-	benchCalcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, input: benchInput, hashNames: []string{hashName}, createOutputFile: func(name string) outputFile {
+	benchCalcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, sectorSize: defaultSectorSize, input: benchInput, hashNames: []string{hashName}, createOutputFile: func(name string) outputFile {
 		out, _ := benchFs.Create(name)
 		return out
 	}}
@@ -193,3 +208,1219 @@ func TestSpeedMd5(t *testing.T) {
 func TestSpeedSha1(t *testing.T) {
 	speedTest(sha1Name)
 }
+
+func TestEWFSegmentName(t *testing.T) {
+	fmt.Printf("Test EWF segment names: ")
+	expected := map[int]string{
+		1:   "image.E01",
+		99:  "image.E99",
+		100: "image.EAA",
+		125: "image.EAZ",
+		126: "image.EBA",
+		775: "image.EZZ",
+		776: "image.FAA",
+	}
+	for number, name := range expected {
+		if actual := ewfSegmentName("image.E01", number); actual != name {
+			t.Errorf("Segment %d. Expected %s, actual: %s", number, name, actual)
+		}
+	}
+	if actual := ewfSegmentName("image.e01", 100); actual != "image.eaa" {
+		t.Errorf("Segment 100. Expected image.eaa, actual: %s", actual)
+	}
+	fmt.Println("OK")
+}
+
+func TestParseTurtle(t *testing.T) {
+	fmt.Printf("Test turtle parsing: ")
+	graph, err := parseTurtle(`@prefix aff4: <http://aff4.org/Schema#> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+# comment
+<aff4://image>
+    a aff4:Image, aff4:Map ;
+    aff4:size "1048576"^^xsd:long ;
+    aff4:hash "d41d8cd98f00b204e9800998ecf8427e"^^aff4:MD5 ;
+    aff4:mapGapDefaultStream aff4:Zero .
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !graph.hasType("aff4://image", aff4TypeImage) || !graph.hasType("aff4://image", aff4TypeMap) {
+		t.Error("Image types are not parsed")
+	}
+	if size, _ := graph.object("aff4://image", aff4Size); size.value != "1048576" || !size.literal {
+		t.Errorf("Expected size 1048576, actual: %v", size)
+	}
+	if hash, _ := graph.object("aff4://image", aff4Hash); hash.datatype != aff4Namespace+"MD5" {
+		t.Errorf("Expected MD5 hash datatype, actual: %s", hash.datatype)
+	}
+	if gap, _ := graph.object("aff4://image", aff4MapGapDefault); gap.value != aff4Zero {
+		t.Errorf("Expected %s, actual: %s", aff4Zero, gap.value)
+	}
+	fmt.Println("OK")
+}
+
+func TestSplitPartNames(t *testing.T) {
+	fmt.Printf("Test split image part names: ")
+	expected := map[string]string{
+		"image.001":    "image.002",
+		"image.009":    "image.010",
+		"image.999":    "",
+		"image.raw.aa": "image.raw.ab",
+		"image.az":     "image.ba",
+		"image.AZ":     "image.BA",
+		"image.zz":     "",
+	}
+	for name, next := range expected {
+		if actual := nextSplitPartName(name); actual != next {
+			t.Errorf("Part after %s. Expected %s, actual: %s", name, next, actual)
+		}
+	}
+	for name, first := range map[string]bool{"image.001": true, "image.000": true, "image.aa": true, "image.002": false, "image.img": false, "image.01": true, "image.1": false} {
+		if isFirstSplitPart(name) != first {
+			t.Errorf("Part %s is first: expected %v", name, first)
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestZstdReader(t *testing.T) {
+	fmt.Printf("Test zstd decompression: ")
+	const compressed = "28b52ffd64480c95020072c30a0fc0eb2620b2fe1d9352a6c4a1c0b9016775976775976775976775976755bfdd02868244090ce90c43060a28a831f4fd37e0a5610d11780488236cdfffff3bf2b25211415060a03c3b42194bc256035a939893"
+	data, _ := hex.DecodeString(compressed)
+	h := md5.New()
+	if _, err := io.Copy(h, newZstdReader(strings.NewReader(string(data)))); err != nil {
+		t.Fatalf("Decompression failed: %v", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != "f4651886f917657e8cfd1946d63f5a7c" {
+		t.Errorf("Decompressed data md5. Actual: %s", actual)
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := io.Copy(h, newZstdReader(strings.NewReader(string(data)))); err != errZstdChecksum {
+		t.Errorf("Corrupted data. Expected checksum mismatch, actual: %v", err)
+	}
+
+	// Frame header with 2G window
+	if _, err := io.Copy(h, newZstdReader(strings.NewReader("\x28\xb5\x2f\xfd\x00\xa8"))); err != errZstdWindow {
+		t.Errorf("Large window. Expected window error, actual: %v", err)
+	}
+
+	// Skippable frames before the first frame
+	data[len(data)-1] ^= 1
+	skippable := "\x50\x2a\x4d\x18\x03\x00\x00\x00abc\x5f\x2a\x4d\x18\x00\x00\x00\x00"
+	s, err := decompressStream(ioutil.NopCloser(strings.NewReader(skippable+string(data))), "test", formatAuto)
+	if err != nil || s.format != "zstd compressed" {
+		t.Fatalf("Skippable frames. Format: %v, error: %v", s, err)
+	}
+	h.Reset()
+	if _, err := io.Copy(h, s); err != nil || hex.EncodeToString(h.Sum(nil)) != "f4651886f917657e8cfd1946d63f5a7c" {
+		t.Errorf("Skippable frames. Decompressed data md5: %x, error: %v", h.Sum(nil), err)
+	}
+	for header, expected := range map[string]bool{skippable + "\x28\xb5\x2f\xfd": true, skippable + "data": false, "\x50\x2a\x4d\x18\xff\x00\x00\x00": true, "\x50\x2a\x4d": false} {
+		if isZstdHeader([]byte(header)) != expected {
+			t.Errorf("Header %x. Expected zstd: %v", header, expected)
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestPartitionAreas(t *testing.T) {
+	fmt.Printf("Test partition areas: ")
+	partitions := []partition{{number: 2, start: 8192, length: 4096}, {number: 1, start: 1024, length: 2048}}
+	areas, err := partitionAreas(partitions, 10240, 512)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []readRange{{0, 1024}, {1024, 2048}, {3072, 5120}, {8192, 2048}}
+	if fmt.Sprint(areas) != fmt.Sprint(expected) {
+		t.Errorf("Expected: %v. Actual: %v", expected, areas)
+	}
+
+	partitions = append(partitions, partition{number: 3, start: 2048, length: 512})
+	if _, err := partitionAreas(partitions, 10240, 512); err == nil {
+		t.Error("Overlapping partitions. Expected error")
+	}
+	fmt.Println("OK")
+}
+
+func TestFATTableChain(t *testing.T) {
+	fmt.Printf("Test FAT chains: ")
+	// FAT12 entries 2->3, 3->5, 5->end of chain, 6->7, 7->6
+	fat := fatTable{data: []byte{0xf8, 0xff, 0xff, 0x03, 0x50, 0x00, 0x00, 0xf0, 0xff, 0x07, 0x60, 0x00}, bits: 12, clusterCount: 6}
+	if chain := fat.chain(2, 0); fmt.Sprint(chain) != "[2 3 5]" {
+		t.Errorf("Expected chain [2 3 5]. Actual: %v", chain)
+	}
+	if chain := fat.chain(2, 2); fmt.Sprint(chain) != "[2 3]" {
+		t.Errorf("Limited chain. Expected [2 3]. Actual: %v", chain)
+	}
+	if chain := fat.chain(6, 0); len(chain) > 7 {
+		t.Errorf("Looped chain is not cut: %v", chain)
+	}
+	fmt.Println("OK")
+}
+
+func TestContentDefinedChunks(t *testing.T) {
+	fmt.Printf("Test content-defined chunks: ")
+	boundaries := func(data []byte) map[int]bool {
+		chunker := newCDCChunker(minCDCAverageSize)
+		found := make(map[int]bool)
+		for position := 0; position < len(data); {
+			n := chunker.boundary(data[position:])
+			if n < 0 {
+				break
+			}
+			if n < minCDCAverageSize/4 || n > minCDCAverageSize*8 {
+				t.Errorf("Chunk size %d is out of bounds", n)
+			}
+			position += n
+			found[position] = true
+		}
+		return found
+	}
+
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	original := boundaries(data)
+	shifted := boundaries(append([]byte("inserted"), data...))
+	matched := 0
+	for position := range original {
+		if shifted[position+len("inserted")] {
+			matched++
+		}
+	}
+	if matched < len(original)-2 {
+		t.Errorf("Boundaries after insertion. Expected: %d matched. Actual: %d", len(original), matched)
+	}
+
+	// Unreadable ranges are split between chunks
+	unreadable := []readRange{{1000, 512}, {200000, 100000}, {1024*1024 - 512, 512}}
+	in := make(chan segmentChunk, 1)
+	in <- unreadableChunk(data, 4096, []readRange{{5096, 512}, {204096, 100000}, {4096 + 1024*1024 - 512, 512}}, false)
+	close(in)
+	position, total := int64(0), int64(0)
+	for piece := range splitContentDefined(in, minCDCAverageSize) {
+		expected := int64(0)
+		for _, r := range unreadable {
+			if overlap := minInt64(position+int64(len(piece.data)), r.start+r.length) - maxInt64(position, r.start); overlap > 0 {
+				expected += overlap
+			}
+		}
+		if piece.unreadable != expected {
+			t.Errorf("Chunk piece at %d. Expected %d unreadable bytes. Actual: %d", position, expected, piece.unreadable)
+		}
+		position += int64(len(piece.data))
+		total += piece.unreadable
+	}
+	if total != 101024 {
+		t.Errorf("Expected 101024 unreadable bytes in chunks. Actual: %d", total)
+	}
+	fmt.Println("OK")
+}
+
+func TestContentStats(t *testing.T) {
+	fmt.Printf("Test content statistics: ")
+	stats := newContentStats()
+	stats.add(make([]byte, 3*statsSampleLength))
+	if content := stats.finish(); !content.zero || content.entropy != 0 || content.compressibility < 99 {
+		t.Errorf("Zero data. Actual: %+v", *content)
+	}
+
+	data := make([]byte, 3*statsSampleLength)
+	rand.New(rand.NewSource(1)).Read(data)
+	stats.add(data[:1000])
+	stats.add(data[1000:])
+	if content := stats.finish(); content.zero || !content.random() {
+		t.Errorf("Random data. Actual: %+v", *content)
+	}
+	fmt.Println("OK")
+}
+
+func TestZeroSegments(t *testing.T) {
+	fmt.Printf("Test zero segments: ")
+	in := make(chan segmentChunk)
+	go func() {
+		defer close(in)
+		data := []byte("data")
+		for i := 0; i < 2; i++ {
+			in <- segmentChunk{data: zeroBuffer[:1000]}
+			in <- segmentChunk{data: zeroBuffer[:24], isLast: true}
+		}
+		in <- segmentChunk{data: zeroBuffer[:1000]}
+		in <- segmentChunk{data: data}
+		in <- segmentChunk{data: zeroBuffer[:24], isLast: true}
+	}()
+
+	zeroHash := md5.Sum(make([]byte, 1024))
+	mixedHash := md5.Sum(append(append(make([]byte, 1000), "data"...), make([]byte, 24)...))
+	expected := []string{hex.EncodeToString(zeroHash[:]), hex.EncodeToString(zeroHash[:]), hex.EncodeToString(mixedHash[:])}
+	i := 0
+	for seg := range calculateHash(hashContainer{h: md5.New(), name: md5Name}, in) {
+		if i >= len(expected) || hex.EncodeToString(seg.hash) != expected[i] {
+			t.Errorf("Segment %d. Actual hash: %x", i, seg.hash)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d segments. Actual: %d", len(expected), i)
+	}
+	fmt.Println("OK")
+}
+
+func TestJournalChain(t *testing.T) {
+	fmt.Printf("Test journal chain: ")
+	var entries []journalEntry
+	previous := ""
+	for i := 1; i <= 3; i++ {
+		entry := journalEntry{Sequence: i, Previous: previous, Command: "calc", Arguments: []string{"calc"}, Outputs: []journalFile{}}
+		entry.Hash = entry.digest()
+		previous = entry.Hash
+		entries = append(entries, entry)
+	}
+	if broken, reason := validateJournal(entries); broken >= 0 {
+		t.Errorf("Valid chain. Broken at %d: %s", broken, reason)
+	}
+
+	entries[1].Operator = "changed"
+	if broken, _ := validateJournal(entries); broken != 1 {
+		t.Errorf("Changed entry. Expected broken at 1. Actual: %d", broken)
+	}
+	entries[1].Operator = ""
+	if broken, _ := validateJournal(append(entries[:1:1], entries[2])); broken != 1 {
+		t.Errorf("Removed entry. Expected broken at 1. Actual: %d", broken)
+	}
+
+	// A lock left by a run which is gone is removed
+	host, _ := os.Hostname()
+	expected := map[string]bool{
+		fmt.Sprintf("%s %d\n", host, os.Getpid()):      false,
+		fmt.Sprintf("%s %d\n", host, 0x7fffffff):       true,
+		fmt.Sprintf("other-%s %d\n", host, 0x7fffffff): false,
+		"": false,
+	}
+	for owner, stale := range expected {
+		if isStaleLock(owner, host) != stale {
+			t.Errorf("Lock of %q. Expected stale: %v", owner, stale)
+		}
+	}
+	dir, _ := ioutil.TempDir("", "seghash")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+	ioutil.WriteFile(path+".lock", []byte(fmt.Sprintf("%s %d\n", host, 0x7fffffff)), 0644)
+	unlock, err := lockJournal(path)
+	if err != nil {
+		t.Fatalf("Stale lock is not removed: %v", err)
+	}
+	if owner, _ := ioutil.ReadFile(path + ".lock"); string(owner) != fmt.Sprintf("%s %d\n", host, os.Getpid()) {
+		t.Errorf("Lock file content: %q", owner)
+	}
+	unlock()
+	fmt.Println("OK")
+}
+
+// failingReader reads data except chosen sectors. A sector failing forever
+// has -1 failures left. Reads of larger areas containing a failing sector
+// always fail, reads of the sector alone fail as many times as set.
+type failingReader struct {
+	data     []byte
+	failures map[int64]int
+	pos      int64
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.pos >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	end := r.pos + int64(len(p))
+	for start, left := range r.failures {
+		if left != 0 && start < end && start+defaultSectorSize > r.pos {
+			if len(p) <= defaultSectorSize && left > 0 {
+				r.failures[start]--
+			}
+			return 0, fmt.Errorf("unreadable sector at %d", start)
+		}
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *failingReader) Seek(offset int64, whence int) (int64, error) {
+	r.pos = offset
+	return offset, nil
+}
+
+func TestReadTolerant(t *testing.T) {
+	fmt.Printf("Test tolerant reading: ")
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	tests := []struct {
+		name       string
+		failures   map[int64]int
+		bufSize    int
+		retries    int
+		skip       bool
+		n          int
+		eof        bool
+		unreadable []readRange
+		errorMap   string
+		kept       []readRange // data ranges left in skip mode
+	}{
+		{name: "zero", failures: map[int64]int{1024: -1, 1536: -1, 3072: -1}, bufSize: 4096,
+			n: 4096, unreadable: []readRange{{1024, 512}, {1536, 512}, {3072, 512}}, errorMap: "2,3\n6,6\n"},
+		{name: "skip", failures: map[int64]int{1024: -1, 1536: -1, 3072: -1}, bufSize: 4096, skip: true,
+			n: 4096, unreadable: []readRange{{1024, 512}, {1536, 512}, {3072, 512}}, errorMap: "2,3\n6,6\n",
+			kept: []readRange{{0, 1024}, {2048, 1024}, {3584, 512}}},
+		{name: "EOF in bad area", failures: map[int64]int{3584: -1}, bufSize: 8192, skip: true,
+			n: 4096, eof: true, unreadable: []readRange{{3584, 512}}, errorMap: "7,7\n", kept: []readRange{{0, 3584}}},
+		{name: "retried sector", failures: map[int64]int{512: 2}, bufSize: 4096, retries: 2, n: 4096},
+		{name: "not enough retries", failures: map[int64]int{512: 2}, bufSize: 4096, retries: 1,
+			n: 4096, unreadable: []readRange{{512, 512}}, errorMap: "1,1\n"},
+	}
+
+	fs := memfs()
+	for _, test := range tests {
+		input := &failingReader{data: data, failures: test.failures}
+		buf := make([]byte, test.bufSize)
+		var unreadable []readRange
+		n, eof := readTolerant(input, buf, 0, test.retries, defaultSectorSize, &unreadable)
+		if n != test.n || eof != test.eof || fmt.Sprint(unreadable) != fmt.Sprint(test.unreadable) {
+			t.Errorf("%s. Expected n=%d eof=%v unreadable=%v. Actual: n=%d eof=%v unreadable=%v",
+				test.name, test.n, test.eof, test.unreadable, n, eof, unreadable)
+			continue
+		}
+
+		errorMap := &errorMap{sectorSize: defaultSectorSize, createOutput: func() outputFile {
+			out, _ := fs.Create(verifyOutputFilename)
+			return out
+		}}
+		errorMap.add(unreadable)
+		if name := errorMap.close(); name != "" {
+			f, _ := fs.Open(name)
+			lines, _ := ioutil.ReadAll(f)
+			f.Close()
+			fs.Remove(name)
+			if string(lines) != test.errorMap {
+				t.Errorf("%s. Expected error map %q. Actual: %q", test.name, test.errorMap, lines)
+			}
+		} else if test.errorMap != "" {
+			t.Errorf("%s. Error map is not written", test.name)
+		}
+
+		chunk := unreadableChunk(buf[:n], 0, unreadable, test.skip)
+		expected := make([]byte, n)
+		copy(expected, data)
+		for _, r := range unreadable {
+			copy(expected[r.start:r.start+r.length], make([]byte, r.length))
+		}
+		if test.skip {
+			expected = nil
+			for _, r := range test.kept {
+				expected = append(expected, data[r.start:r.start+r.length]...)
+			}
+		}
+		if string(chunk.data) != string(expected) {
+			t.Errorf("%s. Chunk data of %d bytes does not match expected %d bytes", test.name, len(chunk.data), len(expected))
+		}
+		if chunk.unreadable != int64(len(unreadable))*defaultSectorSize || (test.skip && chunk.skipped != chunk.unreadable) {
+			t.Errorf("%s. Unreadable bytes: %d, skipped: %d", test.name, chunk.unreadable, chunk.skipped)
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestExactLength(t *testing.T) {
+	fmt.Printf("Test exact segment length: ")
+	for _, sectorSize := range []int64{defaultSectorSize, 4096} {
+		fs := memfs()
+		inputBuf := make([]byte, 5*1024*1024+1000)
+		rand.Read(inputBuf)
+		input, _ := fs.Create(inputFilename)
+		input.Write(inputBuf)
+		input.Close()
+
+		input, _ = fs.Open(inputFilename)
+		calcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, sectorSize: sectorSize, input: input, hashNames: []string{md5Name}, createOutputFile: func(name string) outputFile {
+			out, _ := fs.Create(name)
+			return out
+		}}
+		outName := calc(calcArgs, false)[0]
+		input.Close()
+
+		hashes, _ := fs.Open(outName)
+		format, segments := readSegments(hashes)
+		hashes.Close()
+		if !format.exactLength || format.sectorSize != sectorSize || segments[len(segments)-1].length != 1024*1024+1000 {
+			t.Errorf("Sector size %d. Last segment length: %d, exact length: %v", sectorSize, segments[len(segments)-1].length, format.exactLength)
+		}
+
+		// A change in the last partial sector is found
+		for i, expected := range []int{0, 1} {
+			if i == 1 {
+				inputBuf[len(inputBuf)-1] ^= 1
+				f, _ := fs.Create(inputFilename)
+				f.Write(inputBuf)
+				f.Close()
+			}
+			input, _ = fs.Open(inputFilename)
+			hashes, _ = fs.Open(outName)
+			verifyArgs := &verifyArgs{input: input, segmentHashesInput: hashes, createOutputFile: func() outputFile {
+				f, _ := fs.Create(verifyOutputFilename)
+				return f
+			}}
+			if diffs := verify(verifyArgs, false); diffs != expected {
+				t.Errorf("Sector size %d. Expected %d diffs, actual: %d", sectorSize, expected, diffs)
+			}
+			input.Close()
+			hashes.Close()
+		}
+	}
+
+	format := hashFileFormat{sectorSize: defaultSectorSize, exactLength: true}
+	for length, valid := range map[string]bool{"2048": true, "1537": true, "1536": false, "2049": false, "-1": false, "x": false} {
+		csvReader := createCsvReader(strings.NewReader("00,0,3," + length + "\n"))
+		if _, _, _, _, err := readSegmentLine(csvReader, format); (err == nil) != valid {
+			t.Errorf("Length %s of LBA range (0, 3). Expected valid: %v, error: %v", length, valid, err)
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestReplaceStdinName(t *testing.T) {
+	fmt.Printf("Test stdin argument: ")
+	app := kingpin.New("seghash", "")
+	calc := app.Command("calc", "")
+	calc.Flag("opref", "").Short('o').String()
+	calc.Flag("case", "").String()
+	calc.Flag("yes", "").Short('y').Bool()
+	calc.Arg("inputfile", "").String()
+	calc.Arg("hashtype", "").Strings()
+	compare := app.Command("compare", "")
+	compare.Arg("firsthashfile", "").String()
+
+	expected := map[string]string{
+		"calc - md5":                    "calc <stdin> md5",
+		"calc -y - md5":                 "calc -y <stdin> md5",
+		"calc -o - - md5":               "calc -o - <stdin> md5",
+		"calc --case - --opref=x - md5": "calc --case - --opref=x <stdin> md5",
+		"calc -ox -- - md5":             "calc -ox -- <stdin> md5",
+		"calc file - md5":               "calc file - md5",
+		"compare - second":              "compare - second",
+	}
+	for args, replaced := range expected {
+		if actual := strings.Join(replaceStdinName(app, strings.Fields(args)), " "); actual != replaced {
+			t.Errorf("Arguments %q. Expected %q, actual: %q", args, replaced, actual)
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestTrailingHole(t *testing.T) {
+	fmt.Printf("Test trailing hole: ")
+	f, err := ioutil.TempFile("", "seghash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	inputBuf := make([]byte, 5000001)
+	rand.Read(inputBuf[:3000000])
+	f.Write(inputBuf[:3000000])
+	f.Truncate(int64(len(inputBuf)))
+
+	holes := newHoleMap(f)
+	if length := holes.holeLength(int64(len(inputBuf))); length != 0 {
+		t.Errorf("Hole length at end of file: %d", length)
+	}
+	if length := holes.holeLength(4000000); length > 1000001 {
+		t.Errorf("Hole length past end of file: %d", length)
+	}
+
+	fs := memfs()
+	memInput, _ := fs.Create(inputFilename)
+	memInput.Write(inputBuf)
+	memInput.Close()
+	var hashLines [][]string
+	var outName string
+	for _, input := range []inputFile{f, nil} {
+		if input == nil {
+			memInput, _ = fs.Open(inputFilename)
+			defer memInput.Close()
+			input = memInput
+		}
+		input.Seek(0, io.SeekStart)
+		calcArgs := &calcArgs{segmentSize: 2 * 1024 * 1024, sectorSize: defaultSectorSize, input: input, hashNames: []string{md5Name}, createOutputFile: func(name string) outputFile {
+			out, _ := fs.Create(name)
+			return out
+		}}
+		outName = calc(calcArgs, false)[0]
+		hashes, _ := fs.Open(outName)
+		lines, _ := createCsvReader(hashes).ReadAll()
+		hashes.Close()
+		hashLines = append(hashLines, lines...)
+	}
+	if len(hashLines) != 6 || fmt.Sprint(hashLines[:3]) != fmt.Sprint(hashLines[3:]) {
+		t.Errorf("Sparse and written file hashes differ: %v", hashLines)
+	}
+
+	f.Seek(0, io.SeekStart)
+	hashes, _ := fs.Open(outName)
+	defer hashes.Close()
+	verifyArgs := &verifyArgs{input: f, segmentHashesInput: hashes, createOutputFile: func() outputFile {
+		out, _ := fs.Create(verifyOutputFilename)
+		return out
+	}}
+	if diffs := verify(verifyArgs, false); diffs != 0 {
+		t.Errorf("Sparse file. Expected 0 diffs, actual: %d", diffs)
+	}
+	fmt.Println("OK")
+}
+
+func TestProgressEvents(t *testing.T) {
+	fmt.Printf("Test progress events: ")
+	defer func() { fatalHooks = nil }()
+	events := func(out *bytes.Buffer) []jsonProgressEvent {
+		var parsed []jsonProgressEvent
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var e jsonProgressEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Invalid event %q: %v", line, err)
+			}
+			parsed = append(parsed, e)
+		}
+		return parsed
+	}
+
+	// A command failing before its reporter is created
+	var out bytes.Buffer
+	opts := progressOptions{format: progressJSONL, output: &out}
+	writeFailureSummary(&opts, "verify")
+	runFatalHooks("missing hashes file")
+	if e := events(&out); len(e) != 1 || e[0].Event != "summary" || e[0].Command != "verify" || e[0].Error != "missing hashes file" {
+		t.Errorf("Failure before progress. Events: %+v", e)
+	}
+
+	// Summary of a failure is written once, by the reporter
+	fs := memfs()
+	input, _ := fs.Create(inputFilename)
+	input.Write(make([]byte, 3000))
+	defer input.Close()
+	out.Reset()
+	writeFailureSummary(&opts, "calc")
+	progress := getProgress(true, opts, input, "calc")
+	progress.add(1000)
+	progress.warning("unreadable LBA range (2, 3)")
+	progress.add(2000)
+	runFatalHooks("read error")
+	e := events(&out)
+	if len(e) != 2 || e[0].Event != "warning" || e[0].Message != "unreadable LBA range (2, 3)" || e[0].Bytes != 1000 || e[0].Warnings != 1 {
+		t.Fatalf("Events: %+v", e)
+	}
+	if e[1].Event != "summary" || e[1].Error != "read error" || e[1].Bytes != 3000 || e[1].Total != 3000 {
+		t.Errorf("Summary event: %+v", e[1])
+	}
+	fmt.Println("OK")
+}
+
+func TestRateLimiter(t *testing.T) {
+	fmt.Printf("Test read rate limit: ")
+	dir, _ := ioutil.TempDir("", "seghash")
+	defer os.RemoveAll(dir)
+	controlFile := filepath.Join(dir, "rate")
+	ioutil.WriteFile(controlFile, []byte("1K\n"), 0644)
+
+	clock := time.Unix(0, 0)
+	slept := time.Duration(0)
+	l := &rateLimiter{rate: 0, controlFile: controlFile, start: clock,
+		now:   func() time.Time { return clock },
+		sleep: func(d time.Duration) { clock = clock.Add(d); slept += d }}
+	l.control()
+	if l.rate != 1024 {
+		t.Fatalf("Rate from control file. Expected 1024, actual: %d", l.rate)
+	}
+	for i := 0; i < 4; i++ {
+		l.wait(512)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("2K at 1K/s. Expected 2s of waiting, actual: %v", slept)
+	}
+
+	// A changed limit starts counting anew, an invalid one is ignored
+	ioutil.WriteFile(controlFile, []byte("2K"), 0644)
+	clock = clock.Add(rateControlInterval)
+	l.control()
+	if l.rate != 2048 || l.bytes != 0 || !l.start.Equal(clock) {
+		t.Errorf("Changed limit. Rate: %d, bytes: %d, start: %v", l.rate, l.bytes, l.start)
+	}
+	slept = 0
+	l.wait(2048)
+	if slept != time.Second {
+		t.Errorf("2K at 2K/s. Expected 1s of waiting, actual: %v", slept)
+	}
+	for _, content := range []string{"fast", "-1K", ""} {
+		ioutil.WriteFile(controlFile, []byte(content), 0644)
+		clock = clock.Add(rateControlInterval)
+		l.control()
+		if l.rate != 2048 {
+			t.Errorf("Control file %q. Expected rate unchanged, actual: %d", content, l.rate)
+		}
+	}
+	os.Remove(controlFile)
+	clock = clock.Add(rateControlInterval)
+	l.control()
+	if l.rate != 2048 {
+		t.Errorf("Missing control file. Expected rate unchanged, actual: %d", l.rate)
+	}
+
+	// Reading slower than the limit does not allow a burst later
+	clock = clock.Add(10 * time.Second)
+	l.wait(1)
+	slept = 0
+	l.wait(2048)
+	if slept < time.Second-time.Millisecond {
+		t.Errorf("Burst after slow reading. Waiting: %v", slept)
+	}
+
+	ioutil.WriteFile(controlFile, []byte("0"), 0644)
+	clock = clock.Add(rateControlInterval)
+	slept = 0
+	l.wait(1 << 30)
+	if l.rate != 0 || slept != 0 {
+		t.Errorf("Limit removed. Rate: %d, waiting: %v", l.rate, slept)
+	}
+	fmt.Println("OK")
+}
+
+func TestLowerPriority(t *testing.T) {
+	// Priority of the process cannot be raised back, so it is lowered in
+	// a child process running this test
+	if os.Getenv("SEGHASH_TEST_PRIORITY") != "" {
+		if err := lowerPriority(); err != nil {
+			fmt.Println("unsupported:", err)
+			return
+		}
+		// Threads started later inherit the priority
+		done := make(chan struct{})
+		go func() {
+			runtime.LockOSThread()
+			<-done
+		}()
+		tasks, _ := ioutil.ReadDir("/proc/self/task")
+		for _, task := range tasks {
+			stat, _ := ioutil.ReadFile(filepath.Join("/proc/self/task", task.Name(), "stat"))
+			fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+			fmt.Println("nice", fields[16])
+		}
+		close(done)
+		return
+	}
+
+	fmt.Printf("Test lower priority: ")
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestLowerPriority$")
+	cmd.Env = append(os.Environ(), "SEGHASH_TEST_PRIORITY=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Child process failed: %v", err)
+	}
+	if strings.Contains(string(out), "unsupported:") {
+		fmt.Println("not supported")
+		return
+	}
+	nice := regexp.MustCompile(`nice (-?\d+)`).FindAllStringSubmatch(string(out), -1)
+	if len(nice) < 2 {
+		t.Fatalf("Threads of the child process are not found: %s", out)
+	}
+	for _, match := range nice {
+		if match[1] != "19" {
+			t.Errorf("Thread nice value. Expected 19, actual: %s", match[1])
+		}
+	}
+	fmt.Println("OK")
+}
+
+func TestBenchRecommendations(t *testing.T) {
+	fmt.Printf("Test bench recommendations: ")
+	const mb = 1024 * 1024
+	for rate, expected := range map[float64]int64{0: minSegmentSize, 100 * mb: 512 * mb, 105 * mb: 1024 * mb, 3000 * mb: defaultSegmentSize} {
+		if size := recommendSegmentSize(rate); size != expected {
+			t.Errorf("Segment size at %s. Expected %s, actual: %s", formatRate(rate), formatBytes(expected), formatBytes(size))
+		}
+	}
+	for n, expected := range map[int64]string{0: "0B", 1000: "1000B", 1024: "1K", 1536: "1.5K", 2 << 20: "2M", 4 << 30: "4G", 3 << 40: "3T", 5 << 50: "5120T"} {
+		if actual := formatBytes(n); actual != expected {
+			t.Errorf("Formatted %d. Expected %s, actual: %s", n, expected, actual)
+		}
+	}
+	fmt.Println("OK")
+}
+
+// fsImage is a file system image built in memory for walk tests
+type fsImage []byte
+
+func (img fsImage) put16(offset int64, values ...uint16) {
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(img[offset+int64(2*i):], v)
+	}
+}
+
+func (img fsImage) put32(offset int64, values ...uint32) {
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(img[offset+int64(4*i):], v)
+	}
+}
+
+// fat16Image has a file with long name in fragmented chain and a directory
+func fat16Image() fsImage {
+	const fatSize, dataStart = 17 * 512, 512 + 2*17*512 + 512
+	img := make(fsImage, 4200*512)
+	copy(img[3:], "MSDOS5.0")
+	img.put16(11, 512)
+	img[13] = 1
+	img.put16(14, 1)
+	img[16] = 2
+	img.put16(17, 16, 4200)
+	img.put16(22, 17)
+	img[510], img[511] = 0x55, 0xaa
+	for _, fat := range []int64{512, 512 + fatSize} {
+		// 3->4->10, 5, 6->8
+		img.put16(fat, 0xfff8, 0xffff, 0, 4, 10, 0xffff, 8, 0, 0xffff, 0, 0xffff)
+	}
+
+	root := int64(dataStart - 512)
+	name := utf16.Encode([]rune("A long file name.txt\x00￿￿￿￿￿"))
+	for i, seq := range []int{2, 1} {
+		entry := root + int64(32*i)
+		part := name[13*(seq-1):]
+		img[entry] = byte(seq)
+		if i == 0 {
+			img[entry] |= 0x40
+		}
+		img[entry+11] = fatAttrLongName
+		img.put16(entry+1, part[0:5]...)
+		img.put16(entry+14, part[5:11]...)
+		img.put16(entry+28, part[11:13]...)
+	}
+	copy(img[root+64:], "ALONGF~1TXT")
+	img.put16(root+64+26, 3)
+	img.put32(root+64+28, 3*512-100)
+	copy(img[root+96:], "DELETED TXT")
+	img[root+96] = fatDeletedEntry
+	copy(img[root+128:], "SUB        ")
+	img[root+128+11] = fatAttrDirectory
+	img.put16(root+128+26, 5)
+
+	sub := int64(dataStart + 3*512)
+	copy(img[sub:], ".          ")
+	img[sub+11] = fatAttrDirectory
+	img.put16(sub+26, 5)
+	copy(img[sub+32:], "B       BIN")
+	img[sub+32+12] = 0x08
+	img.put16(sub+32+26, 6)
+	img.put32(sub+32+28, 600)
+	return img
+}
+
+// exfatImage has allocation bitmap, up-case table, a contiguous directory
+// and a fragmented file with a name in two name entries
+func exfatImage() fsImage {
+	const heap = 32 * 512
+	img := make(fsImage, 52*512)
+	copy(img[3:], "EXFAT   ")
+	img.put32(80, 24, 1, 32, 20, 4)
+	img[108], img[109], img[110] = 9, 0, 1
+	// 2, 3, 4, 7->9->10
+	img.put32(24*512+8, 0xffffffff, 0xffffffff, 0xffffffff, 0, 0, 9, 0, 10, 0xffffffff)
+
+	fileSet := func(offset int64, name string, attributes uint16, flags byte, first uint32, length uint64) int64 {
+		chars := utf16.Encode([]rune(name))
+		nameEntries := (len(chars) + exfatNameCharsInName - 1) / exfatNameCharsInName
+		img[offset], img[offset+1] = exfatEntryFile, byte(1+nameEntries)
+		img.put16(offset+4, attributes)
+		stream := offset + 32
+		img[stream], img[stream+1], img[stream+3] = exfatEntryStream, flags, byte(len(chars))
+		img.put32(stream+20, first)
+		binary.LittleEndian.PutUint64(img[stream+24:], length)
+		for i := 0; i < nameEntries; i++ {
+			entry := stream + 32 + int64(32*i)
+			img[entry] = exfatEntryName
+			end := minInt64(int64(len(chars)), int64(exfatNameCharsInName*(i+1)))
+			img.put16(entry+2, chars[exfatNameCharsInName*i:end]...)
+		}
+		return offset + int64(32*(2+nameEntries))
+	}
+	root := int64(heap + 2*512)
+	img[root] = exfatEntryBitmap
+	img.put32(root+20, 2, 3)
+	img[root+32] = exfatEntryUpcase
+	img.put32(root+32+20, 3, 100)
+	next := fileSet(root+64, "Directory one", fatAttrDirectory, exfatAllocationFlag|exfatNoFatChain, 5, 1024)
+	fileSet(next, "A file with a long name.bin", 0, exfatAllocationFlag, 7, 1500)
+	fileSet(heap+3*512, "x.txt", 0, exfatAllocationFlag|exfatNoFatChain, 11, 10)
+	return img
+}
+
+// extImage makes a single group ext volume with root directory in the
+// block and a file named tree. Inode of the file is set by fill.
+func extImage(blockSize, blocks, inodeSize int64, incompat uint32, fill func(img fsImage, inode int64)) fsImage {
+	img := make(fsImage, blocks*blockSize)
+	sb := int64(extSuperblockOffset)
+	firstDataBlock := int64(0)
+	if blockSize == 1024 {
+		firstDataBlock = 1
+	}
+	log := uint32(0)
+	for 1024<<log < blockSize {
+		log++
+	}
+	img.put32(sb, 16, uint32(blocks))
+	img.put32(sb+20, uint32(firstDataBlock), log)
+	img.put32(sb+32, 8192)
+	img.put32(sb+40, 16)
+	img.put16(sb+56, extMagic)
+	if inodeSize != 128 {
+		img.put32(sb+76, 1)
+		img.put16(sb+88, uint16(inodeSize))
+	}
+	img.put32(sb+96, incompat)
+	// Bitmaps and inode table follow the group descriptors
+	img.put32((firstDataBlock+1)*blockSize, uint32(firstDataBlock+2), uint32(firstDataBlock+3), uint32(firstDataBlock+4))
+	inodeTable := (firstDataBlock + 4) * blockSize
+
+	rootInode, rootBlock := inodeTable+inodeSize, int64(10+firstDataBlock)
+	img.put16(rootInode, extModeDirectory|0755)
+	img.put32(rootInode+4, uint32(blockSize))
+	if incompat&extIncompatExtents != 0 {
+		img.put32(rootInode+32, extInodeFlagExtents)
+		img.put16(rootInode+40, extExtentMagic, 1, 4, 0)
+		img.put32(rootInode+52, 0)
+		img.put16(rootInode+56, 1, 0)
+		img.put32(rootInode+60, uint32(rootBlock))
+	} else {
+		img.put32(rootInode+40, uint32(rootBlock))
+	}
+	dir := rootBlock * blockSize
+	img.put32(dir, 2)
+	img.put16(dir+4, 12)
+	img[dir+6], img[dir+8] = 1, '.'
+	img.put32(dir+12, 12)
+	img.put16(dir+16, uint16(blockSize-12))
+	img[dir+18], img[dir+19] = 4, 1
+	copy(img[dir+20:], "tree")
+	fill(img, inodeTable+11*inodeSize)
+	return img
+}
+
+// ext2Image maps the file with direct, single and double indirect pointers
+func ext2Image() fsImage {
+	return extImage(1024, 400, 128, extIncompatFiletype, func(img fsImage, inode int64) {
+		img.put16(inode, extModeRegular|0644)
+		img.put32(inode+4, 20*1024)
+		for i := uint32(0); i < extDirectPointers; i++ {
+			img.put32(inode+40+int64(4*i), 30+i)
+		}
+		img.put32(inode+40+4*extDirectPointers, 50, 60)
+		img.put32(50*1024, 51, 52, 53)
+		img.put32(60*1024, 61)
+		img.put32(61*1024, 62)
+	})
+}
+
+// ext4Image maps the file with an extent tree of depth 1, one of the leaf
+// extents is uninitialized
+func ext4Image() fsImage {
+	return extImage(4096, 64, 256, extIncompatFiletype|extIncompatExtents, func(img fsImage, inode int64) {
+		img.put16(inode, extModeRegular|0644)
+		img.put32(inode+4, 7*4096)
+		img.put32(inode+32, extInodeFlagExtents)
+		img.put16(inode+40, extExtentMagic, 1, 4, 1)
+		img.put32(inode+52, 0, 20)
+		leaf := int64(20 * 4096)
+		img.put16(leaf, extExtentMagic, 3, 340, 0)
+		img.put32(leaf+12, 0)
+		img.put16(leaf+16, 3, 0)
+		img.put32(leaf+20, 30, 3)
+		img.put16(leaf+28, 2, 0)
+		img.put32(leaf+32, 40, 5)
+		img.put16(leaf+40, 32768+2, 0)
+		img.put32(leaf+44, 50)
+	})
+}
+
+func TestFileSystemWalk(t *testing.T) {
+	fmt.Printf("Test file system walk: ")
+	tests := []struct {
+		image    fsImage
+		name     string
+		expected []string
+	}{
+		{fat16Image(), "FAT16", []string{
+			"metadata [reserved sectors] 0 512",
+			"metadata [FAT 1] 512 8704",
+			"metadata [FAT 2] 9216 8704",
+			"directory / 17920 512",
+			"file /A long file name.txt 18944 1024",
+			"file /A long file name.txt 22528 512",
+			"directory /SUB 19968 512",
+			"file /SUB/b.BIN 20480 512",
+			"file /SUB/b.BIN 21504 512",
+		}},
+		{exfatImage(), "exFAT", []string{
+			"metadata [boot region] 0 6144",
+			"metadata [backup boot region] 6144 6144",
+			"metadata [FAT 1] 12288 512",
+			"directory / 17408 512",
+			"metadata [allocation bitmap] 16384 512",
+			"metadata [up-case table] 16896 512",
+			"directory /Directory one 17920 1024",
+			"file /Directory one/x.txt 20992 512",
+			"file /A file with a long name.bin 18944 512",
+			"file /A file with a long name.bin 19968 1024",
+		}},
+		{ext2Image(), "ext2", []string{
+			"metadata [boot block] 0 1024",
+			"metadata [superblock] 1024 1024",
+			"metadata [group descriptors] 2048 1024",
+			"metadata [block bitmap, group 0] 3072 1024",
+			"metadata [inode bitmap, group 0] 4096 1024",
+			"metadata [inode table, group 0] 5120 2048",
+			"directory / 11264 1024",
+			"file /tree 30720 12288",
+			"file /tree 51200 4096",
+			"file /tree 61440 3072",
+		}},
+		{ext4Image(), "ext4", []string{
+			"metadata [boot block] 0 1024",
+			"metadata [superblock] 1024 3072",
+			"metadata [group descriptors] 4096 4096",
+			"metadata [block bitmap, group 0] 8192 4096",
+			"metadata [inode bitmap, group 0] 12288 4096",
+			"metadata [inode table, group 0] 16384 4096",
+			"directory / 40960 4096",
+			"file /tree 81920 4096",
+			"file /tree 122880 12288",
+			"file /tree 163840 8192",
+			"file /tree 204800 8192",
+		}},
+	}
+	for _, test := range tests {
+		fs, err := openFileSystem(bytes.NewReader(test.image), int64(len(test.image)))
+		if err != nil {
+			t.Errorf("%s. Cannot open: %v", test.name, err)
+			continue
+		}
+		if fs.name() != test.name {
+			t.Errorf("%s. Detected as %s", test.name, fs.name())
+		}
+		var visited []string
+		err = fs.walk(func(kind, path string, start, length int64) {
+			visited = append(visited, fmt.Sprintf("%s %s %d %d", kind, path, start, length))
+		})
+		if err != nil || strings.Join(visited, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%s. Error: %v, walked:\n%s", test.name, err, strings.Join(visited, "\n"))
+		}
+	}
+	fmt.Println("OK")
+}
+
+// checkImageData reads the whole image and a range across the first
+// cluster boundary and compares them with expected data
+func checkImageData(t *testing.T, name string, img io.ReaderAt, expected []byte, clusterSize int) {
+	actual := make([]byte, len(expected))
+	if n, err := img.ReadAt(actual, 0); n != len(expected) || (err != nil && err != io.EOF) {
+		t.Errorf("%s. Read %d bytes: %v", name, n, err)
+	}
+	for i := 0; i < len(expected); i += clusterSize {
+		end := minInt64(int64(i+clusterSize), int64(len(expected)))
+		if !bytes.Equal(actual[i:end], expected[i:end]) {
+			t.Errorf("%s. Different data at offset %d", name, i)
+		}
+	}
+	part := make([]byte, clusterSize+100)
+	if _, err := img.ReadAt(part, int64(clusterSize-50)); err != nil || !bytes.Equal(part, expected[clusterSize-50:2*clusterSize+50]) {
+		t.Errorf("%s. Different data read across cluster boundary, error: %v", name, err)
+	}
+}
+
+func TestQCOW2Reader(t *testing.T) {
+	fmt.Printf("Test QCOW2 reading: ")
+	const clusterSize = 512
+	data := make([]byte, 8*clusterSize)
+	random := rand.New(rand.NewSource(1))
+	random.Read(data[:clusterSize])
+	copy(data[3*clusterSize:], bytes.Repeat([]byte("compressed"), 50))
+	random.Read(data[4*clusterSize : 5*clusterSize])
+
+	// Header, L1 table, L2 table, then host clusters
+	file := make([]byte, 7*clusterSize)
+	copy(file, qcow2Signature)
+	binary.BigEndian.PutUint32(file[4:], 3)
+	binary.BigEndian.PutUint32(file[20:], 9)
+	binary.BigEndian.PutUint64(file[24:], uint64(len(data)))
+	binary.BigEndian.PutUint32(file[36:], 1)
+	binary.BigEndian.PutUint64(file[40:], clusterSize)
+	binary.BigEndian.PutUint64(file[clusterSize:], 2*clusterSize)
+	l2 := file[2*clusterSize:]
+	copy(file[3*clusterSize:], data[:clusterSize])
+	binary.BigEndian.PutUint64(l2, 3*clusterSize)
+	// Zero cluster keeps its stale host cluster
+	random.Read(file[4*clusterSize : 5*clusterSize])
+	binary.BigEndian.PutUint64(l2[8:], 4*clusterSize|qcow2ZeroFlag)
+	// Cluster 2 is unallocated, cluster 3 is compressed into one sector
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(data[3*clusterSize : 4*clusterSize])
+	w.Close()
+	copy(file[5*clusterSize:], compressed.Bytes())
+	binary.BigEndian.PutUint64(l2[24:], qcow2CompressedFlag|5*clusterSize)
+	copy(file[6*clusterSize:], data[4*clusterSize:5*clusterSize])
+	binary.BigEndian.PutUint64(l2[32:], 6*clusterSize)
+
+	img, _, err := newQCOW2(bytes.NewReader(file), "test.qcow2", 0)
+	if err != nil {
+		t.Fatalf("Cannot open: %v", err)
+	}
+	checkImageData(t, "QCOW2", img, data, clusterSize)
+	fmt.Println("OK")
+}
+
+func TestVHDReader(t *testing.T) {
+	fmt.Printf("Test VHD reading: ")
+	const blockSize = 8 * vhdSectorSize
+	data := make([]byte, 3*blockSize)
+	random := rand.New(rand.NewSource(2))
+	random.Read(data[:blockSize])
+	random.Read(data[2*blockSize:])
+
+	// Footer copy, dynamic disk header, BAT, then blocks with their
+	// sector bitmaps. Block 1 is a hole.
+	file := make([]byte, 2048+2*(vhdSectorSize+blockSize)+vhdFooterSize)
+	header := file[512:]
+	copy(header, vhdDynamicSignature)
+	binary.BigEndian.PutUint64(header[16:], 1536)
+	binary.BigEndian.PutUint32(header[28:], 3)
+	binary.BigEndian.PutUint32(header[32:], blockSize)
+	for i, sector := range []uint32{4, vhdUnallocated, 4 + 1 + blockSize/vhdSectorSize} {
+		binary.BigEndian.PutUint32(file[1536+4*i:], sector)
+		if sector != vhdUnallocated {
+			file[sector*vhdSectorSize] = 0xff
+			copy(file[(sector+1)*vhdSectorSize:], data[i*blockSize:(i+1)*blockSize])
+		}
+	}
+
+	disk, err := newVHDDynamicDisk(bytes.NewReader(file), 512, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Cannot open: %v", err)
+	}
+	checkImageData(t, "VHD", disk, data, blockSize)
+	fmt.Println("OK")
+}
+
+func TestVMDKReader(t *testing.T) {
+	fmt.Printf("Test VMDK reading: ")
+	const grainSize = 8 * vmdkSectorSize
+	data := make([]byte, 6*grainSize)
+	random := rand.New(rand.NewSource(3))
+	random.Read(data[:grainSize])
+	random.Read(data[3*grainSize : 4*grainSize])
+
+	// Header, descriptor, grain directory and the first grain table, then
+	// grains. The second grain table is not allocated.
+	file := make([]byte, 24*vmdkSectorSize)
+	copy(file, vmdkSparseSignature)
+	binary.LittleEndian.PutUint32(file[4:], 1)
+	binary.LittleEndian.PutUint64(file[12:], uint64(len(data)/vmdkSectorSize))
+	binary.LittleEndian.PutUint64(file[20:], grainSize/vmdkSectorSize)
+	binary.LittleEndian.PutUint64(file[28:], 1)
+	binary.LittleEndian.PutUint64(file[36:], 1)
+	binary.LittleEndian.PutUint32(file[44:], 4)
+	binary.LittleEndian.PutUint64(file[56:], 2)
+	copy(file[vmdkSectorSize:], "# Disk DescriptorFile\ncreateType=\"monolithicSparse\"\nRW 48 SPARSE \"test.vmdk\"\n")
+	binary.LittleEndian.PutUint32(file[2*vmdkSectorSize:], 3)
+	// Grain 1 is not allocated, grain 2 is a zero grain
+	for i, sector := range []uint32{8, 0, vmdkGrainZero, 16} {
+		binary.LittleEndian.PutUint32(file[3*vmdkSectorSize+4*i:], sector)
+		if sector > vmdkGrainZero {
+			copy(file[sector*vmdkSectorSize:], data[i*grainSize:(i+1)*grainSize])
+		}
+	}
+
+	f, err := ioutil.TempFile("", "seghash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(file)
+	disk, _, err := newVMDK(f, file[:512], 0)
+	if err != nil {
+		t.Fatalf("Cannot open: %v", err)
+	}
+	if disk.size != int64(len(data)) {
+		t.Errorf("Disk size. Expected %d, actual: %d", len(data), disk.size)
+	}
+	checkImageData(t, "VMDK", disk, data, grainSize)
+	fmt.Println("OK")
+}
+
+func TestDMGReader(t *testing.T) {
+	fmt.Printf("Test DMG reading: ")
+	const runSize = 8 * dmgSectorSize
+	data := make([]byte, 5*runSize)
+	random := rand.New(rand.NewSource(4))
+	random.Read(data[:runSize])
+	random.Read(data[4*runSize:])
+	for i := runSize; i < 2*runSize; i++ {
+		data[i] = byte(i % 7)
+	}
+
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(data[runSize : 2*runSize])
+	w.Close()
+
+	// Data fork holds the raw and zlib runs. Run 2 is zero, run 3 is not
+	// described by the mish table.
+	fork := append(append([]byte{}, data[:runSize]...), compressed.Bytes()...)
+	fork = append(fork, data[4*runSize:]...)
+	runs := []struct {
+		kind           uint32
+		sector, offset int
+		length         int
+	}{
+		{dmgRunRaw, 0, 0, runSize},
+		{dmgRunZlib, 8, runSize, compressed.Len()},
+		{dmgRunZero, 16, 0, 0},
+		{dmgRunRaw, 32, runSize + compressed.Len(), runSize},
+		{dmgRunTerminator, 40, 0, 0},
+	}
+	table := make([]byte, dmgMishHeader+len(runs)*dmgMishChunkSize)
+	copy(table, dmgMishSignature)
+	binary.BigEndian.PutUint32(table[200:], uint32(len(runs)))
+	for i, run := range runs {
+		chunk := table[dmgMishHeader+i*dmgMishChunkSize:]
+		binary.BigEndian.PutUint32(chunk, run.kind)
+		binary.BigEndian.PutUint64(chunk[8:], uint64(run.sector))
+		if run.kind != dmgRunTerminator {
+			binary.BigEndian.PutUint64(chunk[16:], 8)
+		}
+		binary.BigEndian.PutUint64(chunk[24:], uint64(run.offset))
+		binary.BigEndian.PutUint64(chunk[32:], uint64(run.length))
+	}
+	plist := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<plist version=\"1.0\"><dict><key>resource-fork</key><dict>" +
+		"<key>blkx</key><array><dict><key>Data</key><data>" + base64.StdEncoding.EncodeToString(table) + "</data>" +
+		"<key>Name</key><string>disk</string></dict></array></dict></dict></plist>\n"
+
+	trailer := make([]byte, dmgTrailerSize)
+	copy(trailer, dmgSignature)
+	binary.BigEndian.PutUint64(trailer[216:], uint64(len(fork)))
+	binary.BigEndian.PutUint64(trailer[224:], uint64(len(plist)))
+	binary.BigEndian.PutUint64(trailer[492:], uint64(len(data)/dmgSectorSize))
+	file := append(append(fork, plist...), trailer...)
+
+	img, err := newDMG(bytes.NewReader(file), trailer)
+	if err != nil {
+		t.Fatalf("Cannot open: %v", err)
+	}
+	checkImageData(t, "DMG", img, data, runSize)
+	fmt.Println("OK")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Holes of sparse files are not read, and zero data is hashed lazily, so
+// sparse images and wiped drives are not slowed down by hashing zeros.
+
+// zeroBuffer is a shared source of zero data, it must not be written
+var zeroBuffer = make([]byte, bufferSize)
+
+func isZero(data []byte) bool {
+	for len(data) > 0 {
+		n := len(data)
+		if n > len(zeroBuffer) {
+			n = len(zeroBuffer)
+		}
+		if !bytes.Equal(data[:n], zeroBuffer[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+func writeZeros(w io.Writer, length int64) {
+	for length > 0 {
+		n := minInt64(length, int64(len(zeroBuffer)))
+		_, err := w.Write(zeroBuffer[:n])
+		lnCheckErr(err)
+		length -= n
+	}
+}
+
+// holeMap finds holes of a regular file. The last found region of data
+// or hole is cached, so extents are looked up once.
+type holeMap struct {
+	file       *os.File
+	size       int64
+	start, end int64
+	hole       bool
+}
+
+// newHoleMap returns nil if input is not a regular file or holes
+// cannot be found on this platform.
+func newHoleMap(input io.ReadSeeker) *holeMap {
+	f, ok := input.(*os.File)
+	if !ok || !holesSupported {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return &holeMap{file: f, size: fi.Size(), start: -1, end: -1}
+}
+
+// holeLength returns the number of hole bytes starting at offset,
+// 0 if there is data at offset. End of file is left to the reader.
+func (m *holeMap) holeLength(offset int64) int64 {
+	if m == nil || offset >= m.size {
+		return 0
+	}
+	if offset < m.start || offset >= m.end {
+		m.find(offset)
+	}
+	if !m.hole {
+		return 0
+	}
+	return m.end - offset
+}
+
+// find looks up the region at offset. File position is restored, since
+// offset is where the file is read next.
+func (m *holeMap) find(offset int64) {
+	// Errors other than hole at the end of file are treated as data.
+	// A trailing hole ends at the file size, not at the next data.
+	m.start, m.end, m.hole = offset, m.size, false
+	dataStart, err := m.file.Seek(offset, seekData)
+	switch {
+	case err != nil:
+		m.hole = isNoDataError(err)
+	case dataStart > offset:
+		m.end, m.hole = dataStart, true
+	default:
+		if holeStart, err := m.file.Seek(offset, seekHole); err == nil && holeStart > offset {
+			m.end = holeStart
+		}
+	}
+	_, err = m.file.Seek(offset, io.SeekStart)
+	lnCheckErr(err)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	holesSupported = true
+	seekData       = 3
+	seekHole       = 4
+)
+
+// isNoDataError tells that there is no data after the offset looked up
+func isNoDataError(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.ENXIO
+}
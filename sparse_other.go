@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+const (
+	holesSupported = false
+	seekData       = 3
+	seekHole       = 4
+)
+
+func isNoDataError(err error) bool {
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// splitImage concatenates parts of a raw image split into several files
+// such as image.001, image.002 or image.aa, image.ab.
+type splitImage struct {
+	parts   []*os.File
+	offsets []int64 // start offset of each part
+	size    int64
+}
+
+// openSplitImage opens all parts of a split image if f is its first part.
+// Nil is returned if f is not a first part or there are no other parts.
+func openSplitImage(f *os.File) (inputFile, error) {
+	if !isFirstSplitPart(f.Name()) {
+		return nil, nil
+	}
+	nextName := nextSplitPartName(f.Name())
+	if _, err := os.Stat(nextName); err != nil {
+		return nil, nil
+	}
+
+	img := &splitImage{}
+	result := &imageFile{reader: img, file: f, format: "split raw"}
+	for part, name := f, f.Name(); ; {
+		fi, err := part.Stat()
+		if err != nil {
+			return nil, err
+		}
+		img.parts = append(img.parts, part)
+		img.offsets = append(img.offsets, img.size)
+		img.size += fi.Size()
+
+		if name = nextSplitPartName(name); name == "" {
+			break
+		}
+		if part, err = os.Open(name); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		result.closers = append(result.closers, part)
+	}
+
+	result.size = img.size
+	return result, nil
+}
+
+func (img *splitImage) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < img.size {
+		// The last part which starts at or before the offset
+		i := sort.Search(len(img.offsets), func(i int) bool { return img.offsets[i] > off }) - 1
+		m, err := img.parts[i].ReadAt(p[n:], off-img.offsets[i])
+		n += m
+		off += int64(m)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m == 0 {
+			return n, fmt.Errorf("part %s is shorter than expected", img.parts[i].Name())
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func splitPartSuffix(name string) string {
+	ext := filepath.Ext(name)
+	if len(ext) < 3 {
+		return ""
+	}
+	return ext[1:]
+}
+
+func isFirstSplitPart(name string) bool {
+	suffix := splitPartSuffix(name)
+	if suffix == "" {
+		return false
+	}
+	if number, err := strconv.Atoi(suffix); err == nil {
+		return len(suffix) >= 2 && (number == 0 || number == 1)
+	}
+	return strings.Trim(suffix, "a") == "" || strings.Trim(suffix, "A") == ""
+}
+
+// nextSplitPartName returns the name of the part which follows the part
+// with specified name. Empty string is returned if there is no next name.
+func nextSplitPartName(name string) string {
+	suffix := splitPartSuffix(name)
+	if suffix == "" {
+		return ""
+	}
+	base := name[:len(name)-len(suffix)]
+
+	if number, err := strconv.Atoi(suffix); err == nil {
+		next := fmt.Sprintf("%0*d", len(suffix), number+1)
+		if len(next) > len(suffix) {
+			return ""
+		}
+		return base + next
+	}
+
+	letters := []byte(suffix)
+	for i := len(letters) - 1; i >= 0; i-- {
+		switch c := letters[i]; {
+		case c == 'z':
+			letters[i] = 'a'
+		case c == 'Z':
+			letters[i] = 'A'
+		case (c >= 'a' && c < 'z') || (c >= 'A' && c < 'Z'):
+			letters[i]++
+			return base + string(letters)
+		default:
+			return ""
+		}
+	}
+	return ""
+}
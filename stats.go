@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"math"
+)
+
+// Content statistics help to triage segments without reading the image:
+// wiped areas are all-zero, encrypted or compressed data has entropy close
+// to 8 bits per byte and does not compress.
+
+const (
+	statsSamplePeriod = 1024 * 1024 // compressibility is estimated by samples
+	statsSampleLength = 64 * 1024   // at the beginning of each period
+
+	randomMinEntropy         = 7.9 // bits per byte
+	randomMaxCompressibility = 1   // percent
+)
+
+// contentStats accumulates statistics of segment data
+type contentStats struct {
+	histogram  [256]int64
+	total      int64
+	sampled    int64
+	compressed byteCounter
+	compressor *flate.Writer
+}
+
+// segmentContent is statistics of a finished segment
+type segmentContent struct {
+	zero            bool
+	entropy         float64 // bits per byte
+	compressibility float64 // percent of sampled data saved by compression
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+func newContentStats() *contentStats {
+	s := &contentStats{}
+	compressor, err := flate.NewWriter(&s.compressed, flate.BestSpeed)
+	lnCheckErr(err)
+	s.compressor = compressor
+	return s
+}
+
+func (s *contentStats) add(data []byte) {
+	for _, b := range data {
+		s.histogram[b]++
+	}
+	for len(data) > 0 {
+		inPeriod := s.total % statsSamplePeriod
+		n := int64(len(data))
+		if inPeriod < statsSampleLength {
+			n = minInt64(n, statsSampleLength-inPeriod)
+			_, err := s.compressor.Write(data[:n])
+			lnCheckErr(err)
+			s.sampled += n
+		} else {
+			n = minInt64(n, statsSamplePeriod-inPeriod)
+		}
+		s.total += n
+		data = data[n:]
+	}
+}
+
+// finish returns statistics of data added since the last call
+func (s *contentStats) finish() *segmentContent {
+	lnCheckErr(s.compressor.Close())
+	content := &segmentContent{zero: s.total > 0 && s.histogram[0] == s.total}
+	for _, count := range s.histogram {
+		if count > 0 {
+			p := float64(count) / float64(s.total)
+			content.entropy -= p * math.Log2(p)
+		}
+	}
+	if s.sampled > 0 {
+		content.compressibility = math.Max(0, 100*(1-float64(s.compressed)/float64(s.sampled)))
+	}
+
+	s.histogram = [256]int64{}
+	s.total, s.sampled, s.compressed = 0, 0, 0
+	s.compressor.Reset(&s.compressed)
+	return content
+}
+
+func (c *segmentContent) random() bool {
+	return c.entropy >= randomMinEntropy && c.compressibility < randomMaxCompressibility
+}
+
+func (c *segmentContent) values() []string {
+	zero := "0"
+	if c.zero {
+		zero = "1"
+	}
+	return []string{zero, fmt.Sprintf("%.3f", c.entropy), fmt.Sprintf("%.1f", c.compressibility)}
+}
+
+// contentSummary totals segment statistics for the final report
+type contentSummary struct {
+	segments       int
+	bytes          int64
+	zeroSegments   int
+	zeroBytes      int64
+	randomSegments int
+	randomBytes    int64
+	entropyBytes   float64 // entropy weighted by segment length
+}
+
+func (s *contentSummary) add(seg segment) {
+	s.segments++
+	s.bytes += seg.length
+	s.entropyBytes += seg.content.entropy * float64(seg.length)
+	if seg.content.zero {
+		s.zeroSegments++
+		s.zeroBytes += seg.length
+	} else if seg.content.random() {
+		s.randomSegments++
+		s.randomBytes += seg.length
+	}
+}
+
+func (s *contentSummary) String() string {
+	if s.bytes == 0 {
+		return "No segment content statistics collected."
+	}
+	return fmt.Sprintf("All-zero segments: %d (%.1f%% of data). Random-looking (encrypted or compressed) segments: %d (%.1f%% of data). Mean entropy: %.3f bits per byte.",
+		s.zeroSegments, 100*float64(s.zeroBytes)/float64(s.bytes),
+		s.randomSegments, 100*float64(s.randomBytes)/float64(s.bytes),
+		s.entropyBytes/float64(s.bytes))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// unknownSize is the size of inputs which length is not known until
+// all data is read
+const unknownSize = -1
+
+var errStreamSeekBackwards = errors.New("cannot seek backwards in a stream")
+
+// streamFile is a non-seekable input such as stdin or a pipe. Seeking
+// forward skips data, seeking backwards is not possible.
+type streamFile struct {
+	io.ReadCloser
+	name     string
+	position int64
+	format   string // compression format of the stream, if any
+}
+
+func newStreamFile(r io.ReadCloser, name string) *streamFile {
+	return &streamFile{ReadCloser: r, name: name}
+}
+
+func (s *streamFile) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.position += int64(n)
+	return n, err
+}
+
+func (s *streamFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.position
+	case io.SeekEnd:
+		return s.position, errors.New("cannot seek from the end of a stream")
+	}
+	if offset < s.position {
+		return s.position, errStreamSeekBackwards
+	}
+
+	// Skipping past the end of stream is not an error, like for regular files
+	_, err := io.CopyN(ioutil.Discard, s, offset-s.position)
+	if err == io.EOF {
+		err = nil
+	}
+	return s.position, err
+}
+
+func (s *streamFile) Name() string {
+	return s.name
+}
+
+func (s *streamFile) Stat() (os.FileInfo, error) {
+	return streamFileInfo{name: s.name}, nil
+}
+
+type streamFileInfo struct {
+	name string
+}
+
+func (fi streamFileInfo) Name() string       { return fi.name }
+func (fi streamFileInfo) Size() int64        { return 0 }
+func (fi streamFileInfo) Mode() os.FileMode  { return os.ModeNamedPipe }
+func (fi streamFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi streamFileInfo) IsDir() bool        { return false }
+func (fi streamFileInfo) Sys() interface{}   { return nil }
+
+func isStream(input inputFile) bool {
+	_, ok := input.(*streamFile)
+	return ok
+}
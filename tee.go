@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// writeImage writes data read from input to the image copy. Segments of
+// calc are read sequentially, so chunks are written one after another.
+func writeImage(output outputFile, in <-chan segmentChunk, wg *sync.WaitGroup) {
+	go func() {
+		defer wg.Done()
+
+		for chunk := range in {
+			_, err := output.Write(chunk.data)
+			lnCheckErr(err)
+		}
+		if f, ok := output.(*os.File); ok {
+			lnCheckErr(f.Sync())
+		}
+	}()
+}
+
+// verifyImage re-reads written image copy and verifies it against
+// the hashes file produced while the copy was written.
+func verifyImage(args *calcArgs, hashesFname string, showProgress bool) int {
+	input := openInputFile(args.tee.Name(), inputOptions{format: formatRaw})
+	defer input.Close()
+	hashes, err := os.Open(hashesFname)
+	checkErr(err)
+	defer hashes.Close()
+
+	return verify(&verifyArgs{
+		input:              input,
+		segmentHashesInput: hashes,
+		directIO:           args.directIO,
+		progress:           args.progress,
+		limits:             args.limits,
+		createOutputFile: func() outputFile {
+			return args.createTeeDiffs(filepath.Join(filepath.Dir(hashesFname), "Diffs-"+filepath.Base(filenameWithoutExtension(hashes))+".csv"))
+		},
+	}, showProgress)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Minimal parser of RDF Turtle used for AFF4 metadata. It understands
+// prefixes, predicate and object lists, IRIs, prefixed names and literals,
+// which is what AFF4 implementations write to information.turtle.
+
+const rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+
+type rdfTerm struct {
+	value    string
+	datatype string
+	literal  bool
+}
+
+// rdfGraph maps subject to predicate to objects
+type rdfGraph map[string]map[string][]rdfTerm
+
+func (g rdfGraph) objects(subject, predicate string) []rdfTerm {
+	return g[subject][predicate]
+}
+
+func (g rdfGraph) object(subject, predicate string) (rdfTerm, bool) {
+	objects := g[subject][predicate]
+	if len(objects) == 0 {
+		return rdfTerm{}, false
+	}
+	return objects[0], true
+}
+
+func (g rdfGraph) hasType(subject, typeIRI string) bool {
+	for _, t := range g[subject][rdfType] {
+		if t.value == typeIRI {
+			return true
+		}
+	}
+	return false
+}
+
+type turtleParser struct {
+	input    string
+	pos      int
+	prefixes map[string]string
+	graph    rdfGraph
+}
+
+func parseTurtle(input string) (rdfGraph, error) {
+	p := &turtleParser{input: input, prefixes: map[string]string{}, graph: rdfGraph{}}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return p.graph, nil
+		}
+		if err := p.statement(); err != nil {
+			return nil, fmt.Errorf("turtle: %v at offset %d", err, p.pos)
+		}
+	}
+}
+
+func (p *turtleParser) skipSpace() {
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '#' {
+			for p.pos < len(p.input) && p.input[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			p.pos++
+		} else {
+			return
+		}
+	}
+}
+
+func (p *turtleParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != c {
+		return fmt.Errorf("expected '%c'", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *turtleParser) statement() error {
+	if p.input[p.pos] == '@' || strings.HasPrefix(strings.ToUpper(p.input[p.pos:]), "PREFIX") {
+		return p.prefix()
+	}
+
+	subject, err := p.term()
+	if err != nil {
+		return err
+	}
+	if subject.literal {
+		return errors.New("literal subject")
+	}
+	for {
+		p.skipSpace()
+		predicate, err := p.term()
+		if err != nil {
+			return err
+		}
+		for {
+			object, err := p.term()
+			if err != nil {
+				return err
+			}
+			p.add(subject.value, predicate.value, object)
+			p.skipSpace()
+			if p.pos < len(p.input) && p.input[p.pos] == ',' {
+				p.pos++
+				continue
+			}
+			break
+		}
+		p.skipSpace()
+		if p.pos < len(p.input) && p.input[p.pos] == ';' {
+			// Trailing semicolons are allowed before the dot
+			for p.pos < len(p.input) && p.input[p.pos] == ';' {
+				p.pos++
+				p.skipSpace()
+			}
+			if p.pos < len(p.input) && p.input[p.pos] == '.' {
+				p.pos++
+				return nil
+			}
+			continue
+		}
+		return p.expect('.')
+	}
+}
+
+func (p *turtleParser) add(subject, predicate string, object rdfTerm) {
+	if p.graph[subject] == nil {
+		p.graph[subject] = map[string][]rdfTerm{}
+	}
+	p.graph[subject][predicate] = append(p.graph[subject][predicate], object)
+}
+
+func (p *turtleParser) prefix() error {
+	sparql := p.input[p.pos] != '@'
+	if sparql {
+		p.pos += len("PREFIX")
+	} else if strings.HasPrefix(p.input[p.pos:], "@prefix") {
+		p.pos += len("@prefix")
+	} else if strings.HasPrefix(p.input[p.pos:], "@base") {
+		return errors.New("@base is not supported")
+	} else {
+		return errors.New("unknown directive")
+	}
+	p.skipSpace()
+	end := strings.IndexByte(p.input[p.pos:], ':')
+	if end < 0 {
+		return errors.New("invalid prefix")
+	}
+	name := strings.TrimSpace(p.input[p.pos : p.pos+end])
+	p.pos += end + 1
+	p.skipSpace()
+	iri, err := p.iri()
+	if err != nil {
+		return err
+	}
+	p.prefixes[name] = iri
+	if sparql {
+		return nil
+	}
+	return p.expect('.')
+}
+
+func (p *turtleParser) iri() (string, error) {
+	if p.pos >= len(p.input) || p.input[p.pos] != '<' {
+		return "", errors.New("expected IRI")
+	}
+	end := strings.IndexByte(p.input[p.pos:], '>')
+	if end < 0 {
+		return "", errors.New("unterminated IRI")
+	}
+	iri := p.input[p.pos+1 : p.pos+end]
+	p.pos += end + 1
+	return iri, nil
+}
+
+func (p *turtleParser) term() (rdfTerm, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return rdfTerm{}, errors.New("unexpected end of input")
+	}
+	switch c := p.input[p.pos]; {
+	case c == '<':
+		iri, err := p.iri()
+		return rdfTerm{value: iri}, err
+	case c == '"' || c == '\'':
+		return p.literal()
+	case c == '[':
+		return rdfTerm{}, errors.New("blank node property lists are not supported")
+	case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.input) && strings.IndexByte("+-.eE0123456789", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		return rdfTerm{value: p.input[start:p.pos], literal: true}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) {
+		r := rune(p.input[p.pos])
+		if unicode.IsSpace(r) || strings.ContainsRune(",;<\"", r) {
+			break
+		}
+		// Dot ends the statement unless it is inside the name
+		if r == '.' && (p.pos+1 >= len(p.input) || unicode.IsSpace(rune(p.input[p.pos+1]))) {
+			break
+		}
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	switch name {
+	case "a":
+		return rdfTerm{value: rdfType}, nil
+	case "true", "false":
+		return rdfTerm{value: name, literal: true}, nil
+	}
+	iri, err := p.expand(name)
+	return rdfTerm{value: iri}, err
+}
+
+func (p *turtleParser) expand(name string) (string, error) {
+	colon := strings.IndexByte(name, ':')
+	if colon < 0 {
+		return "", fmt.Errorf("invalid name '%s'", name)
+	}
+	if strings.HasPrefix(name, "_:") {
+		return name, nil
+	}
+	namespace, ok := p.prefixes[name[:colon]]
+	if !ok {
+		return "", fmt.Errorf("unknown prefix '%s'", name[:colon])
+	}
+	return namespace + name[colon+1:], nil
+}
+
+func (p *turtleParser) literal() (rdfTerm, error) {
+	quote := p.input[p.pos : p.pos+1]
+	if strings.HasPrefix(p.input[p.pos:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	p.pos += len(quote)
+
+	var value strings.Builder
+	for {
+		if p.pos >= len(p.input) {
+			return rdfTerm{}, errors.New("unterminated literal")
+		}
+		if strings.HasPrefix(p.input[p.pos:], quote) {
+			p.pos += len(quote)
+			break
+		}
+		c := p.input[p.pos]
+		if c == '\\' && p.pos+1 < len(p.input) {
+			p.pos++
+			switch p.input[p.pos] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			default:
+				c = p.input[p.pos]
+			}
+		}
+		value.WriteByte(c)
+		p.pos++
+	}
+
+	term := rdfTerm{value: value.String(), literal: true}
+	if strings.HasPrefix(p.input[p.pos:], "^^") {
+		p.pos += 2
+		datatype, err := p.term()
+		if err != nil {
+			return rdfTerm{}, err
+		}
+		term.datatype = datatype.value
+	} else if p.pos < len(p.input) && p.input[p.pos] == '@' {
+		for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) && !strings.ContainsRune(",;.", rune(p.input[p.pos])) {
+			p.pos++
+		}
+	}
+	return term, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -14,6 +15,7 @@ import (
 	"math"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,11 +23,15 @@ import (
 	"github.com/atola-technology/seghash/external/github.com/cheggaaa/pb"
 )
 
-const csvDelimiter = ','
+const (
+	csvDelimiter = ','
+	csvComment   = '#'
+)
 
 type hashContainer struct {
-	h    hash.Hash
-	name string
+	h     hash.Hash
+	name  string
+	stats *contentStats // collected along with the hash if set
 }
 
 type readRange struct {
@@ -37,26 +43,118 @@ type segmentChunk struct {
 	data             []byte
 	isLast           bool
 	baseSegmentStart int64
+	unreadable       int64       // bytes which could not be read
+	skipped          int64       // unreadable bytes cut out of data
+	unreadableRanges []readRange // zero-filled ranges, offsets in data
 }
 
 type segment struct {
-	start  int64
-	length int64
-	hash   []byte
-	err    error
+	start      int64
+	length     int64
+	hash       []byte
+	err        error
+	unreadable int64
+	content    *segmentContent
+}
+
+// hashFileFormat describes optional columns and metadata of segment hashes file
+type hashFileFormat struct {
+	sectorSize         int64
+	exactLength        bool // segment length in bytes follows LBA range
+	unreadable         bool
+	partitionScheme    string // segments are aligned to partitions if set
+	partitions         []partition
+	cdcAverageSize     int64 // segments are content-defined chunks if set
+	content            bool  // segment lines have content statistics columns
+	logicalSectorSize  int64
+	physicalSectorSize int64
+}
+
+// metadata returns key-value pairs written as comment lines
+// at the beginning of segment hashes file
+func (format hashFileFormat) metadata() [][2]string {
+	var metadata [][2]string
+	if format.sectorSize != defaultSectorSize {
+		metadata = append(metadata, [2]string{"sectorsize", fmt.Sprintf("%d", format.sectorSize)})
+	}
+	if format.exactLength || format.unreadable || format.partitionScheme != "" || format.content {
+		metadata = append(metadata, [2]string{"columns", strings.Join(format.columns(), ",")})
+	}
+	if format.partitionScheme != "" {
+		metadata = append(metadata, [2]string{"partitiontable", format.partitionScheme})
+	}
+	for _, p := range format.partitions {
+		startLba, endLba := bytesToSectors(p.start, p.length, format.sectorSize)
+		value := fmt.Sprintf("%d,%d,%s", startLba, endLba, p.typeCode)
+		if p.name != "" {
+			value += "," + p.name
+		}
+		metadata = append(metadata, [2]string{fmt.Sprintf("partition%d", p.number), value})
+	}
+	if format.cdcAverageSize > 0 {
+		minSize, maxSize := cdcSizes(format.cdcAverageSize)
+		metadata = append(metadata, [2]string{"segmentation", segmentationCDC})
+		metadata = append(metadata, [2]string{"chunksizes", fmt.Sprintf("%d,%d,%d", minSize, format.cdcAverageSize, maxSize)})
+	}
+	if format.logicalSectorSize > 0 {
+		metadata = append(metadata, [2]string{"logicalsectorsize", fmt.Sprintf("%d", format.logicalSectorSize)})
+	}
+	if format.physicalSectorSize > 0 {
+		metadata = append(metadata, [2]string{"physicalsectorsize", fmt.Sprintf("%d", format.physicalSectorSize)})
+	}
+	return metadata
 }
 
-func (seg segment) ToStringSlice() []string {
-	startLba, endLba := bytesToSectors(seg.start, seg.length)
+// columns returns names of segment line values
+func (format hashFileFormat) columns() []string {
+	columns := []string{"hash", "startlba", "endlba"}
+	if format.exactLength {
+		columns = append(columns, "length")
+	}
+	if format.unreadable {
+		columns = append(columns, "unreadable")
+	}
+	if format.partitionScheme != "" {
+		columns = append(columns, "partition")
+	}
+	if format.content {
+		columns = append(columns, "zero", "entropy", "compressibility")
+	}
+	return columns
+}
+
+func (seg segment) ToStringSlice(format hashFileFormat) []string {
+	startLba, endLba := bytesToSectors(seg.start, seg.length, format.sectorSize)
 	values := make([]string, 3)
 	values[0] = fmt.Sprintf("%x", seg.hash)
 	values[1] = fmt.Sprintf("%d", startLba)
 	values[2] = fmt.Sprintf("%d", endLba)
+	if format.exactLength {
+		values = append(values, fmt.Sprintf("%d", seg.length))
+	}
+	if format.unreadable {
+		unreadableSectors := int64(0)
+		if seg.unreadable > 0 {
+			_, lastLba := bytesToSectors(0, seg.unreadable, format.sectorSize)
+			unreadableSectors = lastLba + 1
+		}
+		values = append(values, fmt.Sprintf("%d", unreadableSectors))
+	}
+	if format.partitionScheme != "" {
+		label := ""
+		if p, ok := partitionAt(format.partitions, seg.start); ok {
+			label = fmt.Sprintf("%d", p.number)
+		}
+		values = append(values, label)
+	}
+	if format.content && seg.content != nil {
+		values = append(values, seg.content.values()...)
+	}
 	return values
 }
 
-func (seg segment) ToCsvString(delimiter rune) string {
-	return strings.Join(seg.ToStringSlice(), string(delimiter))
+func (seg segment) ToCsvString(delimiter rune, format hashFileFormat) string {
+	return strings.Join(seg.ToStringSlice(format), string(delimiter))
 }
 
 type inputFile interface {
@@ -73,8 +171,21 @@ type outputFile interface {
 	Name() string
 }
 
+// fatalHooks are called with the error message before exit
+var fatalHooks []func(message string)
+
+func runFatalHooks(message string) {
+	// Hooks are run once, an error in a hook exits at once
+	hooks := fatalHooks
+	fatalHooks = nil
+	for _, hook := range hooks {
+		hook(message)
+	}
+}
+
 func fatal(a interface{}) {
 	fmt.Print(os.Args[0], ": error: ", a, "\n")
+	runFatalHooks(fmt.Sprint(a))
 	os.Exit(255)
 }
 
@@ -84,6 +195,7 @@ func fatalf(s string, a ...interface{}) {
 
 func lnfatal(a interface{}) {
 	fmt.Print("\n", os.Args[0], ": error: ", a, "\n")
+	runFatalHooks(fmt.Sprint(a))
 	os.Exit(255)
 }
 
@@ -103,12 +215,17 @@ func lnCheckErr(err error) {
 	}
 }
 
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func askForConfirmation(question string) bool {
 	fmt.Printf("%s (y/n): ", question)
 	var response string
 	_, err := fmt.Scanln(&response)
 	if err != nil {
-		fatal("expected confirmation")
+		fatal("expected confirmation, use --yes to confirm in advance")
 	}
 	response = strings.ToLower(response)
 	if response == "y" || response == "yes" {
@@ -121,40 +238,39 @@ func askForConfirmation(question string) bool {
 	}
 }
 
-func getProgress(showProgress bool, fileForProgress inputFile) (progress func(int64), finishProgress func(string)) {
-	if showProgress {
-		progress, finishProgress = createProgress(fileSize(fileForProgress))
-	} else {
-		// Empty function not to show the progress
-		progress = func(int64) {}
-		finishProgress = func(str string) {}
+func getProgress(showProgress bool, opts progressOptions, fileForProgress inputFile, command string) progressReporter {
+	if !showProgress {
+		return noProgress{}
 	}
-	return
+	if opts.format == progressNone {
+		return resultProgress{}
+	}
+	total := fileSize(fileForProgress)
+	if total == unknownSize {
+		// Progress shows processed bytes only
+		total = 0
+	}
+	if opts.format == progressJSONL {
+		if opts.reporting != nil {
+			*opts.reporting = true
+		}
+		return createJSONProgress(total, opts.output, command)
+	}
+	return createProgress(total)
 }
 
-func createProgress(total int64) (progress func(int64), finishProgress func(string)) {
+func createProgress(total int64) *barProgress {
 	bar := pb.New64(total)
 	bar.SetMaxWidth(120)
 	bar.SetRefreshRate(100 * time.Millisecond)
 	bar.SetUnits(pb.U_BYTES)
-	started := false
-	return func(n int64) {
-			if !started {
-				started = true
-				bar.Start()
-			}
-			bar.Add64(n)
-		}, func(finishStr string) {
-			if bar.Get() != bar.Total {
-				finishStr = "Progress percentage is different from 100 due to overlapping or lack of segments in hashes file (different data size was expected to be processed).\n" + finishStr
-			}
-
-			bar.FinishPrint(finishStr)
-
-		}
+	return &barProgress{bar: bar}
 }
 
 func fileSize(input inputFile) int64 {
+	if isStream(input) {
+		return unknownSize
+	}
 	fi, err := input.Stat()
 	checkErr(err)
 	return fi.Size()
@@ -205,7 +321,7 @@ func getHashContainersByNames(hashNames []string) []hashContainer {
 	return hashContainers
 }
 
-func bytesToSectors(start, length int64) (startLba, endLba int64) {
+func bytesToSectors(start, length, sectorSize int64) (startLba, endLba int64) {
 	if start != 0 && start%sectorSize != 0 {
 		lnfatalf("segment start is not sector aligned. start=%v", start)
 	}
@@ -214,37 +330,142 @@ func bytesToSectors(start, length int64) (startLba, endLba int64) {
 	return
 }
 
-func sectorToBytes(startLba, endLba int64) (startOffset, length int64) {
+func sectorToBytes(startLba, endLba, sectorSize int64) (startOffset, length int64) {
 	startOffset = startLba * sectorSize
 	length = (endLba - startLba + 1) * sectorSize
 	return
 }
 
-func readSegmentLine(csvReader *csv.Reader) (startLba, endLba int64, hash []byte, err error) {
+// readSegmentLine reads a line of segment hashes file. Segment length in bytes
+// is taken from the length column if the file has one, otherwise it spans
+// whole sectors of LBA range.
+func readSegmentLine(csvReader *csv.Reader, format hashFileFormat) (startLba, endLba, length int64, hash []byte, err error) {
 	record, err := csvReader.Read()
 	if err != nil {
 		return
 	}
+	minColumns := 3
+	if format.exactLength {
+		minColumns = 4
+	}
+	if len(record) < minColumns {
+		err = errors.New(strings.Join(record, string(csvDelimiter)))
+		return
+	}
 
 	hash, hashErr := hex.DecodeString(record[0])
 	startLba, startErr := strconv.ParseInt(record[1], 10, 64)
 	endLba, endErr := strconv.ParseInt(record[2], 10, 64)
+	_, length = sectorToBytes(startLba, endLba, format.sectorSize)
+	var lengthErr error
+	if format.exactLength {
+		exactLength, parseErr := strconv.ParseInt(record[3], 10, 64)
+		if parseErr != nil || exactLength <= length-format.sectorSize || exactLength > length {
+			lengthErr = errors.New("segment length does not match LBA range")
+		}
+		length = exactLength
+	}
 
-	if hashErr != nil || startErr != nil || endErr != nil || endLba < startLba {
+	if hashErr != nil || startErr != nil || endErr != nil || lengthErr != nil || endLba < startLba {
 		err = errors.New(strings.Join(record, string(csvDelimiter)))
 	}
 
 	return
 }
 
-func writeSegmentLine(csvWriter *csv.Writer, seg segment) {
-	err := csvWriter.Write(seg.ToStringSlice())
+func writeSegmentLine(csvWriter *csv.Writer, seg segment, format hashFileFormat) {
+	err := csvWriter.Write(seg.ToStringSlice(format))
 	lnCheckErr(err)
 	csvWriter.Flush()
 	err = csvWriter.Error()
 	lnCheckErr(err)
 }
 
+func writeMetadata(output io.Writer, metadata [][2]string) {
+	lineEnd := "\n"
+	if runtime.GOOS == "windows" {
+		lineEnd = "\r\n"
+	}
+	for _, kv := range metadata {
+		_, err := fmt.Fprintf(output, "%c %s: %s%s", csvComment, kv[0], kv[1], lineEnd)
+		lnCheckErr(err)
+	}
+}
+
+// readMetadata reads key-value pairs from comment lines at the beginning
+// of segment hashes file. The file is rewound afterwards.
+func readMetadata(input io.ReadSeeker) map[string]string {
+	metadata := make(map[string]string)
+	reader := bufio.NewReader(input)
+	for {
+		line, err := reader.ReadString('\n')
+		if !strings.HasPrefix(line, string(csvComment)) {
+			break
+		}
+		kv := strings.SplitN(strings.TrimSpace(line[1:]), ":", 2)
+		if len(kv) == 2 {
+			metadata[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		if err != nil {
+			break
+		}
+	}
+	_, err := input.Seek(0, io.SeekStart)
+	checkErr(err)
+	return metadata
+}
+
+// readHashFileFormat restores format of segment hashes file from its metadata
+func readHashFileFormat(input io.ReadSeeker) hashFileFormat {
+	metadata := readMetadata(input)
+	format := hashFileFormat{sectorSize: defaultSectorSize}
+	if value, ok := metadata["sectorsize"]; ok {
+		sectorSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || sectorSize <= 0 || sectorSize&(sectorSize-1) != 0 {
+			fatalf("invalid sector size '%s' in segment hashes file.", value)
+		}
+		format.sectorSize = sectorSize
+	}
+	columns := strings.Split(metadata["columns"], ",")
+	format.exactLength = contains(columns, "length")
+	format.unreadable = contains(columns, "unreadable")
+	format.content = contains(columns, "entropy")
+	format.partitionScheme = metadata["partitiontable"]
+	for key, value := range metadata {
+		number, err := strconv.Atoi(strings.TrimPrefix(key, "partition"))
+		if !strings.HasPrefix(key, "partition") || err != nil {
+			continue
+		}
+		fields := strings.SplitN(value, ",", 4)
+		if len(fields) < 3 {
+			fatalf("invalid partition %d description '%s' in segment hashes file.", number, value)
+		}
+		startLba, startErr := strconv.ParseInt(fields[0], 10, 64)
+		endLba, endErr := strconv.ParseInt(fields[1], 10, 64)
+		if startErr != nil || endErr != nil || endLba < startLba {
+			fatalf("invalid partition %d description '%s' in segment hashes file.", number, value)
+		}
+		p := partition{number: number, typeCode: fields[2]}
+		p.start, p.length = sectorToBytes(startLba, endLba, format.sectorSize)
+		if len(fields) == 4 {
+			p.name = fields[3]
+		}
+		format.partitions = append(format.partitions, p)
+	}
+	sort.Slice(format.partitions, func(i, j int) bool { return format.partitions[i].number < format.partitions[j].number })
+	if metadata["segmentation"] == segmentationCDC {
+		sizes := strings.Split(metadata["chunksizes"], ",")
+		averageSize, err := strconv.ParseInt(sizes[len(sizes)/2], 10, 64)
+		if len(sizes) != 3 || err != nil || averageSize <= 0 {
+			fatalf("invalid chunk sizes '%s' in segment hashes file.", metadata["chunksizes"])
+		}
+		format.cdcAverageSize = averageSize
+	}
+	format.logicalSectorSize, _ = strconv.ParseInt(metadata["logicalsectorsize"], 10, 64)
+	format.physicalSectorSize, _ = strconv.ParseInt(metadata["physicalsectorsize"], 10, 64)
+	return format
+}
+
 func writeDiffLine(csvWriter *csv.Writer, startLba, endLba int64) {
 	values := make([]string, 2)
 	values[0] = fmt.Sprintf("%d", startLba)
@@ -271,7 +492,9 @@ func writeErrorLine(csvWriter *csv.Writer, errorString string) {
 func createCsvReader(f io.Reader) *csv.Reader {
 	csvReader := csv.NewReader(f)
 	csvReader.Comma = csvDelimiter
-	csvReader.FieldsPerRecord = 3
+	csvReader.Comment = csvComment
+	// Optional columns may follow hash and LBA range
+	csvReader.FieldsPerRecord = -1
 
 	return csvReader
 }
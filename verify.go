@@ -2,59 +2,88 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"io"
 )
 
 func verify(args *verifyArgs, showProgress bool) int {
-	_, _, firstHash, err := readSegmentLine(createCsvReader(args.segmentHashesInput))
+	format := readHashFileFormat(args.segmentHashesInput)
+	if args.sectorSize != 0 && args.sectorSize != format.sectorSize {
+		fatalf("segment hashes file LBAs are in %d-byte sectors, but sector size %d is specified.", format.sectorSize, args.sectorSize)
+	}
+	_, _, _, firstHash, err := readSegmentLine(createCsvReader(args.segmentHashesInput), format)
 	checkErr(err)
 
-	progress, finishProgress := getProgress(showProgress, args.input)
+	progress := getProgress(showProgress, args.progress, args.input, "verify")
 
 	hcontainer := getHashContainerByHash(firstHash)
 	args.segmentHashesInput.Seek(0, 0)
 
-	readRanges, fileSegments := readHashesFromFile(args.segmentHashesInput, fileSize(args.input))
-	segmentChunks := readFile(args.input, bufferSize, 1, readRanges, progress)
+	annotation := diffAnnotation{partitions: format.partitions, sectorSize: format.sectorSize}
+	if !annotation.enabled() && !isStream(args.input) {
+		// Diffs are located in partitions of the verified image
+		tableSectorSize := format.sectorSize
+		if format.cdcAverageSize > 0 {
+			tableSectorSize = defaultSectorSize
+		}
+		if _, partitions, err := readPartitionTable(args.input, tableSectorSize); err == nil {
+			annotation.partitions = partitions
+		}
+		_, err = args.input.Seek(0, io.SeekStart)
+		checkErr(err)
+	}
+	createDiffWriter := func() diffWriter {
+		return &progressDiffWriter{diffWriter: newDiffWriter(args.diffFormat, args.createOutputFile(), annotation), progress: progress}
+	}
+
+	readRanges, fileSegments := readHashesFromFile(args.segmentHashesInput, fileSize(args.input), format)
+	readRanges = trackSegments(readRanges, progress, format.sectorSize)
+	segmentChunks := readFile(args.input, bufferSize, 1, readRanges, progress.add, readOptions{directIO: args.directIO, limiter: args.limits.apply()})
 
 	calculatedSegments := calculateHash(hcontainer, segmentChunks[0])
 
-	diffs, diffsFname, errors := verifySegments(args.createOutputFile, calculatedSegments, fileSegments)
+	diffs, diffsFname, errors := verifySegments(createDiffWriter, calculatedSegments, fileSegments, format.sectorSize)
 
 	finishStr := fmt.Sprintf("Segment hashes verified. \nInput data file: %s. Input hashes file: %s. \nNumber of different segments: %d. ",
-		args.input.Name(), args.segmentHashesInput.Name(), diffs)
+		describeInput(args.input), args.segmentHashesInput.Name(), diffs)
 	if diffs > 0 {
 		finishStr += fmt.Sprintf("Different segments written to %s.", diffsFname)
 	}
 	if errors > 0 {
 		finishStr += fmt.Sprintf("\nErrors during verify: %d.", errors)
 	}
-	finishProgress(finishStr)
+	progress.finish(finishStr)
 	return diffs
 }
 
-func readHashesFromFile(hashes io.Reader, dataSize int64) (<-chan readRange, <-chan segment) {
+func readHashesFromFile(hashes io.Reader, dataSize int64, format hashFileFormat) (<-chan readRange, <-chan segment) {
 	rangeChan := make(chan readRange)
 	segmentChan := make(chan segment)
 
-	_, dataEndSector := bytesToSectors(0, dataSize)
+	_, dataEndSector := bytesToSectors(0, dataSize, format.sectorSize)
 
 	csvReader := createCsvReader(hashes)
 	go func() {
 		defer close(rangeChan)
 		defer close(segmentChan)
 
+		streamPosition := int64(0)
 		for line := 1; ; line++ {
-			startLba, endLba, hash, err := readSegmentLine(csvReader)
+			startLba, endLba, length, hash, err := readSegmentLine(csvReader, format)
 			if err == io.EOF {
 				break
 			}
-			if endLba > dataEndSector {
+			start, _ := sectorToBytes(startLba, endLba, format.sectorSize)
+			if dataSize == unknownSize {
+				// Streams are verified in a single pass
+				if err == nil && start < streamPosition {
+					err = fmt.Errorf("segment with range (%d, %d) is out of order, hashes file must be sorted to verify a stream", startLba, endLba)
+				} else if err == nil {
+					streamPosition = start + length
+				}
+			} else if endLba > dataEndSector || format.exactLength && start+length > dataSize {
 				err = fmt.Errorf("segment with range (%d, %d) exceeds input file range", startLba, endLba)
 			}
-			start, length := sectorToBytes(startLba, endLba)
 			segment := segment{start: start, length: length, hash: hash}
 
 			if err != nil {
@@ -71,37 +100,47 @@ func readHashesFromFile(hashes io.Reader, dataSize int64) (<-chan readRange, <-c
 	return rangeChan, segmentChan
 }
 
-func verifySegments(createOutput func() outputFile, calculatorChan, fileChan <-chan segment) (diffs int, diffsFname string, errors int) {
-	var csvWriter *csv.Writer
+func verifySegments(createDiffWriter func() diffWriter, calculatorChan, fileChan <-chan segment, sectorSize int64) (diffs int, diffsFname string, errors int) {
+	var writer diffWriter
 	for fileSegment := range fileChan {
 		if fileSegment.err != nil {
-			if csvWriter == nil {
-				outFile := createOutput()
-				defer outFile.Close()
-				diffsFname = outFile.Name()
-				csvWriter = createCsvWriter(outFile)
+			if writer == nil {
+				writer = createDiffWriter()
+				defer writer.Close()
+				diffsFname = writer.Name()
 			}
 			errors++
-			writeErrorLine(csvWriter, fileSegment.err.Error())
+			writer.writeError(fileSegment.err.Error())
 			continue
 		}
 
 		calculatedSegment := <-calculatorChan
+		if calculatedSegment.length == 0 {
+			// Stream ended before the segment
+			if writer == nil {
+				writer = createDiffWriter()
+				defer writer.Close()
+				diffsFname = writer.Name()
+			}
+			errors++
+			startLba, endLba := bytesToSectors(fileSegment.start, fileSegment.length, sectorSize)
+			writer.writeError(fmt.Sprintf("segment with range (%d, %d) exceeds input data", startLba, endLba))
+			continue
+		}
 
 		if fileSegment.start != calculatedSegment.start {
 			lnfatalf("Internal error: fileSegment start(%d) is different from calculatedSegment start(%d)", fileSegment.start, calculatedSegment.start)
 		}
 
 		if !bytes.Equal(fileSegment.hash, calculatedSegment.hash) {
-			if csvWriter == nil {
-				outFile := createOutput()
-				defer outFile.Close()
-				diffsFname = outFile.Name()
-				csvWriter = createCsvWriter(outFile)
+			if writer == nil {
+				writer = createDiffWriter()
+				defer writer.Close()
+				diffsFname = writer.Name()
 			}
 			diffs++
-			startLba, endLba := bytesToSectors(fileSegment.start, fileSegment.length)
-			writeDiffLine(csvWriter, startLba, endLba)
+			startLba, endLba := bytesToSectors(fileSegment.start, fileSegment.length, sectorSize)
+			writer.writeDiff(startLba, endLba)
 		}
 	}
 
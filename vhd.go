@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// VHD ends with a footer. Fixed disks keep raw data before it, dynamic
+// disks have a copy of the footer at the start followed by the dynamic
+// disk header which points to the block allocation table (BAT).
+
+const (
+	vhdFooterSize       = 512
+	vhdSectorSize       = 512
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+	vhdUnallocated      = 0xffffffff
+)
+
+var (
+	vhdSignature        = []byte("conectix")
+	vhdDynamicSignature = []byte("cxsparse")
+)
+
+type vhdDynamicDisk struct {
+	file       io.ReaderAt
+	size       int64
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+}
+
+func openVHD(f *os.File, footer []byte) (inputFile, error) {
+	size := int64(binary.BigEndian.Uint64(footer[48:]))
+	switch diskType := binary.BigEndian.Uint32(footer[60:]); diskType {
+	case vhdTypeFixed:
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if size > fi.Size()-vhdFooterSize {
+			return nil, fmt.Errorf("VHD disk size %d exceeds file size", size)
+		}
+		return &imageFile{reader: f, size: size, file: f, format: "VHD fixed"}, nil
+	case vhdTypeDynamic:
+		disk, err := newVHDDynamicDisk(f, int64(binary.BigEndian.Uint64(footer[16:])), size)
+		if err != nil {
+			return nil, err
+		}
+		return &imageFile{reader: disk, size: size, file: f, format: "VHD dynamic"}, nil
+	case vhdTypeDifferencing:
+		return nil, errors.New("differencing VHD images are not supported")
+	default:
+		return nil, fmt.Errorf("VHD disk type %d is not supported", diskType)
+	}
+}
+
+func newVHDDynamicDisk(f io.ReaderAt, headerOffset, size int64) (*vhdDynamicDisk, error) {
+	header, err := readBytesAt(f, headerOffset, 1024)
+	if err != nil {
+		return nil, fmt.Errorf("VHD dynamic disk header: %v", err)
+	}
+	if !bytes.HasPrefix(header, vhdDynamicSignature) {
+		return nil, errors.New("invalid VHD dynamic disk header signature")
+	}
+
+	disk := &vhdDynamicDisk{
+		file:      f,
+		size:      size,
+		blockSize: int64(binary.BigEndian.Uint32(header[32:])),
+	}
+	if disk.blockSize == 0 || disk.blockSize%vhdSectorSize != 0 {
+		return nil, fmt.Errorf("invalid VHD block size %d", disk.blockSize)
+	}
+	// Sector bitmap precedes data of each block, padded to a sector
+	disk.bitmapSize = ((disk.blockSize/vhdSectorSize+7)/8 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+
+	entries := int64(binary.BigEndian.Uint32(header[28:]))
+	if entries*disk.blockSize < size {
+		return nil, errors.New("VHD block allocation table does not cover the disk")
+	}
+	bat, err := readBytesAt(f, int64(binary.BigEndian.Uint64(header[16:])), entries*4)
+	if err != nil {
+		return nil, fmt.Errorf("VHD block allocation table: %v", err)
+	}
+	disk.bat = make([]uint32, entries)
+	for i := range disk.bat {
+		disk.bat[i] = binary.BigEndian.Uint32(bat[i*4:])
+	}
+	return disk, nil
+}
+
+func (disk *vhdDynamicDisk) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < disk.size {
+		within := off % disk.blockSize
+		end := minInt64(int64(len(p)), int64(n)+minInt64(disk.blockSize-within, disk.size-off))
+		part := p[n:end]
+
+		if sector := disk.bat[off/disk.blockSize]; sector == vhdUnallocated {
+			zeroFill(part)
+		} else if _, err := disk.file.ReadAt(part, int64(sector)*vhdSectorSize+disk.bitmapSize+within); err != nil {
+			return n, err
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
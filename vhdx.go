@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// VHDX keeps two copies of the header and of the region table. Regions
+// point to the metadata, which holds disk parameters, and to the block
+// allocation table (BAT) where every chunk of payload blocks is followed by
+// a sector bitmap entry.
+
+const (
+	vhdxHeaderOffset      = 64 << 10
+	vhdxHeaderSize        = 4 << 10
+	vhdxRegionTableOffset = 192 << 10
+	vhdxRegionTableSize   = 64 << 10
+	vhdxMB                = 1 << 20
+
+	vhdxBlockNotPresent  = 0
+	vhdxBlockUndefined   = 1
+	vhdxBlockZero        = 2
+	vhdxBlockUnmapped    = 3
+	vhdxBlockFullPresent = 6
+	vhdxBlockStateMask   = 7
+
+	vhdxHasParent = 2
+)
+
+var (
+	vhdxSignature         = []byte("vhdxfile")
+	vhdxHeaderSignature   = []byte("head")
+	vhdxRegionSignature   = []byte("regi")
+	vhdxMetadataSignature = []byte("metadata")
+	vhdxBATRegion         = guidBytes("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion    = guidBytes("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters    = guidBytes("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize   = guidBytes("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxLogicalSectorSize = guidBytes("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxCRC32C            = crc32.MakeTable(crc32.Castagnoli)
+	vhdxZeroGUID          = make([]byte, 16)
+)
+
+type vhdxDisk struct {
+	file       io.ReaderAt
+	size       int64
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+func openVHDX(f *os.File) (inputFile, error) {
+	disk, err := newVHDXDisk(f)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFile{reader: disk, size: disk.size, file: f, format: "VHDX"}, nil
+}
+
+// guidBytes converts GUID text to its on-disk form where the first three
+// fields are little-endian.
+func guidBytes(guid string) []byte {
+	b, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + guid)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// vhdxChecksumValid checks CRC-32C of the structure which is calculated with
+// the checksum field zeroed.
+func vhdxChecksumValid(data []byte) bool {
+	stored := binary.LittleEndian.Uint32(data[4:])
+	zeroed := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(zeroed[4:], 0)
+	return crc32.Checksum(zeroed, vhdxCRC32C) == stored
+}
+
+// readVHDXStructure returns the first of two copies of a structure which
+// has valid signature and checksum. If both are valid, the one with greater
+// sequence number is current.
+func readVHDXStructure(f io.ReaderAt, offsets []int64, size int64, signature []byte, sequenced bool) ([]byte, error) {
+	var current []byte
+	for _, offset := range offsets {
+		data, err := readBytesAt(f, offset, size)
+		if err != nil || !bytes.HasPrefix(data, signature) || !vhdxChecksumValid(data) {
+			continue
+		}
+		if current == nil || (sequenced && binary.LittleEndian.Uint64(data[8:]) > binary.LittleEndian.Uint64(current[8:])) {
+			current = data
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("no valid VHDX %s structure", signature)
+	}
+	return current, nil
+}
+
+func newVHDXDisk(f io.ReaderAt) (*vhdxDisk, error) {
+	header, err := readVHDXStructure(f, []int64{vhdxHeaderOffset, 2 * vhdxHeaderOffset}, vhdxHeaderSize, vhdxHeaderSignature, true)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[48:64], vhdxZeroGUID) {
+		return nil, errors.New("VHDX log is not replayed, the image was not closed cleanly")
+	}
+
+	regions, err := readVHDXStructure(f, []int64{vhdxRegionTableOffset, vhdxRegionTableOffset + vhdxRegionTableSize}, vhdxRegionTableSize, vhdxRegionSignature, false)
+	if err != nil {
+		return nil, err
+	}
+	var batOffset, metadataOffset int64
+	var batLength int64
+	for i, count := int64(0), int64(binary.LittleEndian.Uint32(regions[8:])); i < count && 16+(i+1)*32 <= int64(len(regions)); i++ {
+		entry := regions[16+i*32:]
+		switch {
+		case bytes.Equal(entry[:16], vhdxBATRegion):
+			batOffset, batLength = int64(binary.LittleEndian.Uint64(entry[16:])), int64(binary.LittleEndian.Uint32(entry[24:]))
+		case bytes.Equal(entry[:16], vhdxMetadataRegion):
+			metadataOffset = int64(binary.LittleEndian.Uint64(entry[16:]))
+		}
+	}
+	if batOffset == 0 || metadataOffset == 0 {
+		return nil, errors.New("VHDX region table has no BAT or metadata region")
+	}
+
+	metadata, err := readVHDXMetadata(f, metadataOffset)
+	if err != nil {
+		return nil, err
+	}
+	parameters, size, sectorSize := metadata[string(vhdxFileParameters)], metadata[string(vhdxVirtualDiskSize)], metadata[string(vhdxLogicalSectorSize)]
+	if len(parameters) < 8 || len(size) < 8 || len(sectorSize) < 4 {
+		return nil, errors.New("VHDX metadata lacks required items")
+	}
+	if binary.LittleEndian.Uint32(parameters[4:])&vhdxHasParent != 0 {
+		return nil, errors.New("differencing VHDX images are not supported")
+	}
+
+	disk := &vhdxDisk{
+		file:      f,
+		size:      int64(binary.LittleEndian.Uint64(size)),
+		blockSize: int64(binary.LittleEndian.Uint32(parameters)),
+	}
+	if disk.blockSize == 0 || binary.LittleEndian.Uint32(sectorSize) == 0 {
+		return nil, errors.New("invalid VHDX disk parameters")
+	}
+	disk.chunkRatio = (1 << 23) * int64(binary.LittleEndian.Uint32(sectorSize)) / disk.blockSize
+
+	blocks := (disk.size + disk.blockSize - 1) / disk.blockSize
+	entries := blocks + (blocks-1)/disk.chunkRatio
+	if entries*8 > batLength {
+		return nil, errors.New("VHDX BAT does not cover the disk")
+	}
+	bat, err := readBytesAt(f, batOffset, entries*8)
+	if err != nil {
+		return nil, fmt.Errorf("VHDX BAT: %v", err)
+	}
+	disk.bat = make([]uint64, entries)
+	for i := range disk.bat {
+		disk.bat[i] = binary.LittleEndian.Uint64(bat[i*8:])
+	}
+	return disk, nil
+}
+
+// readVHDXMetadata returns metadata items keyed by their GUIDs
+func readVHDXMetadata(f io.ReaderAt, offset int64) (map[string][]byte, error) {
+	table, err := readBytesAt(f, offset, 64<<10)
+	if err != nil {
+		return nil, fmt.Errorf("VHDX metadata: %v", err)
+	}
+	if !bytes.HasPrefix(table, vhdxMetadataSignature) {
+		return nil, errors.New("invalid VHDX metadata signature")
+	}
+	items := make(map[string][]byte)
+	for i, count := 0, int(binary.LittleEndian.Uint16(table[10:])); i < count && 32+(i+1)*32 <= len(table); i++ {
+		entry := table[32+i*32:]
+		item, err := readBytesAt(f, offset+int64(binary.LittleEndian.Uint32(entry[16:])), int64(binary.LittleEndian.Uint32(entry[20:])))
+		if err != nil {
+			return nil, fmt.Errorf("VHDX metadata item: %v", err)
+		}
+		items[string(entry[:16])] = item
+	}
+	return items, nil
+}
+
+func (disk *vhdxDisk) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < disk.size {
+		block := off / disk.blockSize
+		within := off % disk.blockSize
+		end := minInt64(int64(len(p)), int64(n)+minInt64(disk.blockSize-within, disk.size-off))
+		part := p[n:end]
+
+		entry := disk.bat[block+block/disk.chunkRatio]
+		switch state := entry & vhdxBlockStateMask; state {
+		case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero, vhdxBlockUnmapped:
+			zeroFill(part)
+		case vhdxBlockFullPresent:
+			if _, err := disk.file.ReadAt(part, int64(entry>>20)*vhdxMB+within); err != nil {
+				return n, err
+			}
+		default:
+			return n, fmt.Errorf("VHDX block state %d is not supported", state)
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VMDK virtual disk is described by a text descriptor which lists extents.
+// Monolithic sparse disks embed the descriptor in the single sparse extent,
+// split disks have a separate descriptor file and several extent files.
+
+const (
+	vmdkSectorSize      = 512
+	vmdkMaxDescriptor   = 1 << 20
+	vmdkGDAtEnd         = 0xffffffffffffffff
+	vmdkFlagCompressed  = 1 << 16
+	vmdkGrainZero       = 1
+	vmdkNoParentCID     = "ffffffff"
+	vmdkGrainMarkerSize = 12
+)
+
+var (
+	vmdkSparseSignature     = []byte("KDMV")
+	vmdkDescriptorSignature = []byte("# Disk DescriptorFile")
+)
+
+type vmdkExtent struct {
+	start  int64
+	size   int64
+	reader io.ReaderAt // nil for zero extents
+}
+
+type vmdkDisk struct {
+	extents []vmdkExtent
+	size    int64
+}
+
+func openVMDK(f *os.File, header []byte) (inputFile, error) {
+	disk, closers, err := newVMDK(f, header, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFile{reader: disk, size: disk.size, file: f, format: "VMDK", closers: closers}, nil
+}
+
+func newVMDK(f *os.File, header []byte, depth int) (disk *vmdkDisk, closers []io.Closer, err error) {
+	defer func() {
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+		}
+	}()
+
+	var descriptor []byte
+	var sparse *vmdkSparseExtent
+	if bytes.HasPrefix(header, vmdkSparseSignature) {
+		if sparse, descriptor, err = newVMDKSparseExtent(f); err != nil {
+			return nil, closers, err
+		}
+	} else {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, closers, err
+		}
+		if fi.Size() > vmdkMaxDescriptor {
+			return nil, closers, errors.New("VMDK descriptor file is too large")
+		}
+		if descriptor, err = readBytesAt(f, 0, fi.Size()); err != nil {
+			return nil, closers, err
+		}
+	}
+
+	values, extentLines := parseVMDKDescriptor(descriptor)
+	if createType := values["createType"]; strings.HasPrefix(createType, "vmfs") && createType != "vmfs" {
+		return nil, closers, fmt.Errorf("VMDK create type %s is not supported", createType)
+	}
+
+	disk = &vmdkDisk{}
+	if sparse != nil {
+		// Monolithic disk, the descriptor refers to the file itself
+		disk.extents = []vmdkExtent{{size: sparse.capacity, reader: sparse}}
+		disk.size = sparse.capacity
+	} else {
+		for _, line := range extentLines {
+			extent, extentCloser, err := openVMDKExtent(line, f.Name())
+			if extentCloser != nil {
+				closers = append(closers, extentCloser)
+			}
+			if err != nil {
+				return nil, closers, err
+			}
+			extent.start = disk.size
+			disk.extents = append(disk.extents, extent)
+			disk.size += extent.size
+		}
+		if len(disk.extents) == 0 {
+			return nil, closers, errors.New("VMDK descriptor has no extents")
+		}
+	}
+
+	parentName := values["parentFileNameHint"]
+	if parentCID := values["parentCID"]; parentName == "" || parentCID == "" || strings.ToLower(parentCID) == vmdkNoParentCID {
+		return disk, closers, nil
+	}
+	parent, parentClosers, err := openParentDisk(parentName, f.Name(), depth+1)
+	closers = append(closers, parentClosers...)
+	if err != nil {
+		return nil, closers, fmt.Errorf("VMDK parent: %v", err)
+	}
+	for _, extent := range disk.extents {
+		if sparse, ok := extent.reader.(*vmdkSparseExtent); ok {
+			sparse.parent, sparse.start = parent, extent.start
+		}
+	}
+	return disk, closers, nil
+}
+
+// parseVMDKDescriptor returns key/value pairs and extent lines of a descriptor
+func parseVMDKDescriptor(descriptor []byte) (values map[string]string, extents []string) {
+	values = make(map[string]string)
+	if i := bytes.IndexByte(descriptor, 0); i >= 0 {
+		descriptor = descriptor[:i]
+	}
+	for _, line := range strings.Split(string(descriptor), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) >= 3 && (fields[0] == "RW" || fields[0] == "RDONLY" || fields[0] == "NOACCESS") {
+			extents = append(extents, line)
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i > 0 {
+			values[strings.TrimSpace(line[:i])] = strings.Trim(strings.TrimSpace(line[i+1:]), `"`)
+		}
+	}
+	return values, extents
+}
+
+// openVMDKExtent opens extent described by a line such as
+// RW 4192256 SPARSE "disk-s001.vmdk" or RW 2048 FLAT "disk-flat.vmdk" 0
+func openVMDKExtent(line, descriptorName string) (vmdkExtent, io.Closer, error) {
+	fields := strings.Fields(line)
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return vmdkExtent{}, nil, fmt.Errorf("invalid VMDK extent %q", line)
+	}
+	extent := vmdkExtent{size: sectors * vmdkSectorSize}
+	extentType := fields[2]
+	if extentType == "ZERO" {
+		return extent, nil, nil
+	}
+
+	first, last := strings.IndexByte(line, '"'), strings.LastIndexByte(line, '"')
+	if first < 0 || last <= first {
+		return vmdkExtent{}, nil, fmt.Errorf("invalid VMDK extent %q", line)
+	}
+	name := line[first+1 : last]
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(descriptorName), name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return vmdkExtent{}, nil, err
+	}
+
+	switch extentType {
+	case "FLAT", "VMFS":
+		var offset int64
+		if rest := strings.Fields(line[last+1:]); len(rest) > 0 {
+			if offset, err = strconv.ParseInt(rest[0], 10, 64); err != nil {
+				return vmdkExtent{}, f, fmt.Errorf("invalid VMDK extent %q", line)
+			}
+		}
+		extent.reader = io.NewSectionReader(f, offset*vmdkSectorSize, extent.size)
+	case "SPARSE":
+		sparse, _, err := newVMDKSparseExtent(f)
+		if err != nil {
+			return vmdkExtent{}, f, fmt.Errorf("%s: %v", name, err)
+		}
+		extent.reader = sparse
+	default:
+		return vmdkExtent{}, f, fmt.Errorf("VMDK extent type %s is not supported", extentType)
+	}
+	return extent, f, nil
+}
+
+// vmdkSparseExtent maps grains of the extent through grain directory and
+// grain tables. Grains of stream-optimized extents are compressed.
+type vmdkSparseExtent struct {
+	file        *os.File
+	capacity    int64
+	grainSize   int64
+	gtEntries   int64
+	gd          []uint32
+	compressed  bool
+	parent      parentDisk
+	start       int64 // offset of the extent in the disk, for parent reads
+	mutex       sync.Mutex
+	cachedGTAt  uint32
+	cachedGT    []byte
+	cachedGrain uint32
+	cachedData  []byte
+}
+
+func newVMDKSparseExtent(f *os.File) (*vmdkSparseExtent, []byte, error) {
+	header, err := readBytesAt(f, 0, 512)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(header, vmdkSparseSignature) {
+		return nil, nil, errors.New("invalid VMDK sparse extent signature")
+	}
+	gdOffset := binary.LittleEndian.Uint64(header[56:])
+	if gdOffset == vmdkGDAtEnd {
+		// Stream-optimized extent has the actual header in the footer
+		// followed by the end-of-stream marker
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		if header, err = readBytesAt(f, fi.Size()-1024, 512); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.HasPrefix(header, vmdkSparseSignature) {
+			return nil, nil, errors.New("invalid VMDK footer")
+		}
+		gdOffset = binary.LittleEndian.Uint64(header[56:])
+	}
+
+	flags := binary.LittleEndian.Uint32(header[8:])
+	s := &vmdkSparseExtent{
+		file:       f,
+		capacity:   int64(binary.LittleEndian.Uint64(header[12:])) * vmdkSectorSize,
+		grainSize:  int64(binary.LittleEndian.Uint64(header[20:])) * vmdkSectorSize,
+		gtEntries:  int64(binary.LittleEndian.Uint32(header[44:])),
+		compressed: flags&vmdkFlagCompressed != 0,
+	}
+	if s.grainSize == 0 || s.gtEntries == 0 {
+		return nil, nil, errors.New("invalid VMDK sparse extent header")
+	}
+	if s.compressed && binary.LittleEndian.Uint16(header[77:]) != 1 {
+		return nil, nil, errors.New("VMDK compression algorithm is not supported")
+	}
+
+	gtCoverage := s.grainSize * s.gtEntries
+	gd, err := readBytesAt(f, int64(gdOffset)*vmdkSectorSize, (s.capacity+gtCoverage-1)/gtCoverage*4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("VMDK grain directory: %v", err)
+	}
+	s.gd = make([]uint32, len(gd)/4)
+	for i := range s.gd {
+		s.gd[i] = binary.LittleEndian.Uint32(gd[i*4:])
+	}
+
+	var descriptor []byte
+	if offset, size := int64(binary.LittleEndian.Uint64(header[28:])), int64(binary.LittleEndian.Uint64(header[36:])); offset != 0 && size != 0 {
+		if descriptor, err = readBytesAt(f, offset*vmdkSectorSize, size*vmdkSectorSize); err != nil {
+			return nil, nil, fmt.Errorf("VMDK descriptor: %v", err)
+		}
+	}
+	return s, descriptor, nil
+}
+
+// grainEntry returns the sector of the grain, zero if unallocated
+func (s *vmdkSparseExtent) grainEntry(grain int64) (uint32, error) {
+	gtAt := s.gd[grain/s.gtEntries]
+	if gtAt == 0 {
+		return 0, nil
+	}
+	if gtAt != s.cachedGTAt || s.cachedGT == nil {
+		gt, err := readBytesAt(s.file, int64(gtAt)*vmdkSectorSize, s.gtEntries*4)
+		if err != nil {
+			return 0, fmt.Errorf("VMDK grain table at sector %d: %v", gtAt, err)
+		}
+		s.cachedGTAt, s.cachedGT = gtAt, gt
+	}
+	return binary.LittleEndian.Uint32(s.cachedGT[(grain%s.gtEntries)*4:]), nil
+}
+
+// readCompressedGrain decompresses grain stored after the grain marker
+// which holds LBA and the size of compressed data.
+func (s *vmdkSparseExtent) readCompressedGrain(sector uint32) ([]byte, error) {
+	if sector == s.cachedGrain && s.cachedData != nil {
+		return s.cachedData, nil
+	}
+	marker, err := readBytesAt(s.file, int64(sector)*vmdkSectorSize, vmdkGrainMarkerSize)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := readBytesAt(s.file, int64(sector)*vmdkSectorSize+vmdkGrainMarkerSize, int64(binary.LittleEndian.Uint32(marker[8:])))
+	if err != nil {
+		return nil, err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("VMDK grain at sector %d: %v", sector, err)
+	}
+	// The last grain of the extent may be shorter
+	data := make([]byte, s.grainSize)
+	if _, err := io.ReadFull(r, data); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("VMDK grain at sector %d: %v", sector, err)
+	}
+	s.cachedGrain, s.cachedData = sector, data
+	return data, nil
+}
+
+func (s *vmdkSparseExtent) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for n < len(p) && off < s.capacity {
+		grain := off / s.grainSize
+		within := off % s.grainSize
+		end := minInt64(int64(len(p)), int64(n)+minInt64(s.grainSize-within, s.capacity-off))
+		part := p[n:end]
+
+		sector, err := s.grainEntry(grain)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case sector == 0:
+			err = s.parent.readAt(part, s.start+off)
+		case sector == vmdkGrainZero:
+			zeroFill(part)
+		case s.compressed:
+			var data []byte
+			if data, err = s.readCompressedGrain(sector); err == nil {
+				copy(part, data[within:])
+			}
+		default:
+			_, err = s.file.ReadAt(part, int64(sector)*vmdkSectorSize+within)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (disk *vmdkDisk) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < disk.size {
+		i := sort.Search(len(disk.extents), func(i int) bool { return disk.extents[i].start > off }) - 1
+		extent := disk.extents[i]
+		end := minInt64(int64(len(p)), int64(n)+extent.start+extent.size-off)
+		part := p[n:end]
+
+		if extent.reader == nil {
+			zeroFill(part)
+		} else if m, err := extent.reader.ReadAt(part, off-extent.start); err != nil && !(err == io.EOF && m == len(part)) {
+			return n + m, err
+		}
+		n += len(part)
+		off += int64(len(part))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
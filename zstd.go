@@ -0,0 +1,972 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/bits"
+)
+
+// Zstandard (RFC 8878) stream is a sequence of frames. Each frame holds
+// blocks which are raw, RLE or compressed. Compressed block consists of
+// literals, Huffman coded or not, and sequences coded with FSE which copy
+// literals and matches from the previously decoded data within the window.
+
+const (
+	zstdMagic            = 0xfd2fb528
+	zstdSkippableMagic   = 0x184d2a50
+	zstdSkippableMask    = 0xfffffff0
+	zstdMaxBlockSize     = 128 << 10
+	zstdMaxWindowSize    = 128 << 20 // the default limit of the reference decoder
+	zstdMaxHuffmanBits   = 11
+	zstdMaxLiteralLength = 35
+	zstdMaxOffsetCode    = 31
+	zstdMaxMatchLength   = 52
+
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+
+	zstdModePredefined = 0
+	zstdModeRLE        = 1
+	zstdModeFSE        = 2
+	zstdModeRepeat     = 3
+)
+
+var (
+	zstdSignature   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	errZstdCorrupt  = errors.New("corrupt zstd data")
+	errZstdChecksum = errors.New("zstd frame checksum mismatch")
+	errZstdWindow   = errors.New("zstd window size is larger than 128M")
+)
+
+// Predefined FSE distributions and baselines of literal and match length codes
+var (
+	zstdLiteralLengthNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	zstdMatchLengthNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	zstdOffsetNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	zstdPredefinedTables = [3]*zstdFSETable{
+		buildZstdFSETable(zstdLiteralLengthNorm, 6),
+		buildZstdFSETable(zstdOffsetNorm, 5),
+		buildZstdFSETable(zstdMatchLengthNorm, 6),
+	}
+
+	zstdLiteralLengthBase = [zstdMaxLiteralLength + 1]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLiteralLengthBits = [zstdMaxLiteralLength + 1]uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMatchLengthBase = [zstdMaxMatchLength + 1]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMatchLengthBits = [zstdMaxMatchLength + 1]uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Indexes of sequence tables in the order they are described in a block
+const (
+	zstdLiteralLengths = iota
+	zstdOffsets
+	zstdMatchLengths
+)
+
+type zstdFSEEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+type zstdFSETable struct {
+	entries     []zstdFSEEntry
+	accuracyLog uint
+}
+
+type zstdHuffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+type zstdHuffmanTable struct {
+	entries []zstdHuffmanEntry
+	maxBits uint
+}
+
+// zstdReader decompresses Zstandard stream. Decoded data is kept in history
+// so that matches can refer to it.
+type zstdReader struct {
+	r        io.Reader
+	history  []byte
+	position int // start of decoded data not read yet
+	window   int
+	err      error
+
+	inFrame   bool
+	checksum  bool
+	hash      xxhash64
+	offsets   [3]int
+	huffman   *zstdHuffmanTable
+	tables    [3]*zstdFSETable
+	block     []byte
+	literals  []byte
+	header    [8]byte
+	hashCheck [4]byte
+}
+
+// isZstdHeader reports whether header starts a zstd stream. Skippable
+// frames may come before the first frame, they are passed over. If they
+// run past the header, their magic number is taken as the signature.
+func isZstdHeader(header []byte) bool {
+	for len(header) >= 8 {
+		if binary.LittleEndian.Uint32(header)&zstdSkippableMask != zstdSkippableMagic {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		if size >= int64(len(header))-8 {
+			return true
+		}
+		header = header[8+size:]
+	}
+	return bytes.HasPrefix(header, zstdSignature)
+}
+
+func newZstdReader(r io.Reader) *zstdReader {
+	return &zstdReader{r: r}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.position == len(z.history) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.decodeBlock()
+	}
+	n := copy(p, z.history[z.position:])
+	z.position += n
+	return n, nil
+}
+
+// readFull reads exactly len(p) bytes, the end of data is unexpected
+func (z *zstdReader) readFull(p []byte) error {
+	_, err := io.ReadFull(z.r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readFrameHeader reads frame header skipping skippable frames. It returns
+// io.EOF if there are no more frames.
+func (z *zstdReader) readFrameHeader() error {
+	for {
+		if _, err := io.ReadFull(z.r, z.header[:4]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errZstdCorrupt
+			}
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(z.header[:])
+		if magic&zstdSkippableMask == zstdSkippableMagic {
+			if err := z.readFull(z.header[:4]); err != nil {
+				return err
+			}
+			size := int64(binary.LittleEndian.Uint32(z.header[:]))
+			if n, err := io.CopyN(ioutil.Discard, z.r, size); n < size {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			continue
+		}
+		if magic != zstdMagic {
+			return errors.New("invalid zstd frame magic number")
+		}
+		break
+	}
+
+	if err := z.readFull(z.header[:1]); err != nil {
+		return err
+	}
+	descriptor := z.header[0]
+	if descriptor&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	singleSegment := descriptor&0x20 != 0
+	z.checksum = descriptor&0x04 != 0
+
+	// Window size is checked before the history is allocated, since it comes
+	// from untrusted frame header
+	var window int64
+	if !singleSegment {
+		if err := z.readFull(z.header[:1]); err != nil {
+			return err
+		}
+		windowLog := 10 + uint(z.header[0]>>3)
+		window = int64(1)<<windowLog + (int64(1)<<windowLog)/8*int64(z.header[0]&7)
+	}
+
+	dictionarySize := [4]int{0, 1, 2, 4}[descriptor&3]
+	if err := z.readFull(z.header[:dictionarySize]); err != nil {
+		return err
+	}
+	for _, b := range z.header[:dictionarySize] {
+		if b != 0 {
+			return errors.New("zstd frames with dictionaries are not supported")
+		}
+	}
+
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	if err := z.readFull(z.header[:contentSizeSize]); err != nil {
+		return err
+	}
+	if singleSegment {
+		var contentSize uint64
+		for i := contentSizeSize - 1; i >= 0; i-- {
+			contentSize = contentSize<<8 | uint64(z.header[i])
+		}
+		if contentSizeSize == 2 {
+			contentSize += 256
+		}
+		if contentSize > zstdMaxWindowSize {
+			return errZstdWindow
+		}
+		window = int64(contentSize)
+	}
+	if window > zstdMaxWindowSize {
+		return errZstdWindow
+	}
+	z.window = int(window)
+
+	z.history = z.history[:0]
+	z.position = 0
+	z.offsets = [3]int{1, 4, 8}
+	z.huffman = nil
+	z.tables = [3]*zstdFSETable{}
+	z.hash.reset()
+	z.inFrame = true
+	return nil
+}
+
+func (z *zstdReader) decodeBlock() error {
+	if !z.inFrame {
+		if err := z.readFrameHeader(); err != nil {
+			return err
+		}
+	}
+
+	// Keep only the window of already read data
+	if len(z.history) > 2*z.window+zstdMaxBlockSize {
+		kept := copy(z.history, z.history[len(z.history)-z.window:])
+		z.history = z.history[:kept]
+		z.position = kept
+	}
+
+	if err := z.readFull(z.header[:3]); err != nil {
+		return err
+	}
+	header := uint32(z.header[0]) | uint32(z.header[1])<<8 | uint32(z.header[2])<<16
+	last := header&1 != 0
+	size := int(header >> 3)
+	start := len(z.history)
+
+	maxSize := zstdMaxBlockSize
+	if z.window < maxSize {
+		maxSize = z.window
+	}
+	switch header >> 1 & 3 {
+	case zstdBlockRaw:
+		if size > maxSize {
+			return errZstdCorrupt
+		}
+		z.history = append(z.history, make([]byte, size)...)
+		if err := z.readFull(z.history[start:]); err != nil {
+			return err
+		}
+	case zstdBlockRLE:
+		if size > maxSize {
+			return errZstdCorrupt
+		}
+		if err := z.readFull(z.header[:1]); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			z.history = append(z.history, z.header[0])
+		}
+	case zstdBlockCompressed:
+		if size > maxSize {
+			return errZstdCorrupt
+		}
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if err := z.readFull(z.block); err != nil {
+			return err
+		}
+		if err := z.decodeCompressedBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.history)-start > zstdMaxBlockSize {
+			return errZstdCorrupt
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	if z.checksum {
+		z.hash.write(z.history[start:])
+	}
+	if last {
+		z.inFrame = false
+		if z.checksum {
+			if err := z.readFull(z.hashCheck[:]); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(z.hashCheck[:]) != uint32(z.hash.sum()) {
+				return errZstdChecksum
+			}
+		}
+	}
+	return nil
+}
+
+func (z *zstdReader) decodeCompressedBlock(src []byte) error {
+	literals, n, err := z.decodeLiterals(src)
+	if err != nil {
+		return err
+	}
+	return z.decodeSequences(src[n:], literals)
+}
+
+// decodeLiterals returns literals of the block and the size of the literals section
+func (z *zstdReader) decodeLiterals(src []byte) ([]byte, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	literalsType := src[0] & 3
+	sizeFormat := src[0] >> 2 & 3
+
+	if literalsType == 0 || literalsType == 1 {
+		// Raw or RLE literals
+		var size, headerSize int
+		switch sizeFormat {
+		case 0, 2:
+			size, headerSize = int(src[0]>>3), 1
+		case 1:
+			if len(src) < 2 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, headerSize = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, headerSize = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+		if size > zstdMaxBlockSize {
+			return nil, 0, errZstdCorrupt
+		}
+		if literalsType == 0 {
+			if len(src) < headerSize+size {
+				return nil, 0, errZstdCorrupt
+			}
+			return src[headerSize : headerSize+size], headerSize + size, nil
+		}
+		if len(src) < headerSize+1 {
+			return nil, 0, errZstdCorrupt
+		}
+		z.literals = z.literals[:0]
+		for i := 0; i < size; i++ {
+			z.literals = append(z.literals, src[headerSize])
+		}
+		return z.literals, headerSize + 1, nil
+	}
+
+	// Huffman coded literals, with new tree or with the previous one
+	var size, compressedSize, headerSize int
+	streams := 4
+	switch sizeFormat {
+	case 0, 1:
+		if len(src) < 3 {
+			return nil, 0, errZstdCorrupt
+		}
+		if sizeFormat == 0 {
+			streams = 1
+		}
+		v := uint32(src[0]) | uint32(src[1])<<8 | uint32(src[2])<<16
+		size, compressedSize, headerSize = int(v>>4&0x3ff), int(v>>14&0x3ff), 3
+	case 2:
+		if len(src) < 4 {
+			return nil, 0, errZstdCorrupt
+		}
+		v := binary.LittleEndian.Uint32(src)
+		size, compressedSize, headerSize = int(v>>4&0x3fff), int(v>>18&0x3fff), 4
+	case 3:
+		if len(src) < 5 {
+			return nil, 0, errZstdCorrupt
+		}
+		v := uint64(binary.LittleEndian.Uint32(src)) | uint64(src[4])<<32
+		size, compressedSize, headerSize = int(v>>4&0x3ffff), int(v>>22&0x3ffff), 5
+	}
+	if size > zstdMaxBlockSize || len(src) < headerSize+compressedSize {
+		return nil, 0, errZstdCorrupt
+	}
+	data := src[headerSize : headerSize+compressedSize]
+
+	if literalsType == 2 {
+		table, n, err := readZstdHuffmanTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huffman = table
+		data = data[n:]
+	} else if z.huffman == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	if cap(z.literals) < size {
+		z.literals = make([]byte, size)
+	}
+	z.literals = z.literals[:size]
+	if streams == 1 {
+		if err := z.huffman.decode(z.literals, data); err != nil {
+			return nil, 0, err
+		}
+		return z.literals, headerSize + compressedSize, nil
+	}
+
+	if len(data) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	sizes := [4]int{int(binary.LittleEndian.Uint16(data)), int(binary.LittleEndian.Uint16(data[2:])), int(binary.LittleEndian.Uint16(data[4:]))}
+	sizes[3] = len(data) - 6 - sizes[0] - sizes[1] - sizes[2]
+	segment := (size + 3) / 4
+	if sizes[3] < 0 || 3*segment > size {
+		return nil, 0, errZstdCorrupt
+	}
+	data = data[6:]
+	for i, streamSize := range sizes {
+		out := z.literals[i*segment:]
+		if i < 3 {
+			out = out[:segment]
+		}
+		if err := z.huffman.decode(out, data[:streamSize]); err != nil {
+			return nil, 0, err
+		}
+		data = data[streamSize:]
+	}
+	return z.literals, headerSize + compressedSize, nil
+}
+
+func (z *zstdReader) decodeSequences(src []byte, literals []byte) error {
+	if len(src) == 0 {
+		return errZstdCorrupt
+	}
+	var count int
+	switch b := int(src[0]); {
+	case b < 128:
+		count, src = b, src[1:]
+	case b < 255:
+		if len(src) < 2 {
+			return errZstdCorrupt
+		}
+		count, src = (b-128)<<8|int(src[1]), src[2:]
+	default:
+		if len(src) < 3 {
+			return errZstdCorrupt
+		}
+		count, src = int(src[1])|int(src[2])<<8+0x7f00, src[3:]
+	}
+	if count == 0 {
+		z.history = append(z.history, literals...)
+		return nil
+	}
+
+	if len(src) == 0 || src[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := [3]byte{src[0] >> 6, src[0] >> 4 & 3, src[0] >> 2 & 3}
+	src = src[1:]
+	maxSymbols := [3]int{zstdMaxLiteralLength, zstdMaxOffsetCode, zstdMaxMatchLength}
+	maxLogs := [3]uint{9, 8, 9}
+	for i, mode := range modes {
+		switch mode {
+		case zstdModePredefined:
+			z.tables[i] = zstdPredefinedTables[i]
+		case zstdModeRLE:
+			if len(src) == 0 || int(src[0]) > maxSymbols[i] {
+				return errZstdCorrupt
+			}
+			z.tables[i] = &zstdFSETable{entries: []zstdFSEEntry{{symbol: src[0]}}}
+			src = src[1:]
+		case zstdModeFSE:
+			norm, accuracyLog, n, err := readZstdFSECounts(src, maxSymbols[i], maxLogs[i])
+			if err != nil {
+				return err
+			}
+			z.tables[i] = buildZstdFSETable(norm, accuracyLog)
+			src = src[n:]
+		case zstdModeRepeat:
+			if z.tables[i] == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+
+	br, err := newZstdBackwardBits(src)
+	if err != nil {
+		return err
+	}
+	llTable, ofTable, mlTable := z.tables[zstdLiteralLengths], z.tables[zstdOffsets], z.tables[zstdMatchLengths]
+	llState := br.read(llTable.accuracyLog)
+	ofState := br.read(ofTable.accuracyLog)
+	mlState := br.read(mlTable.accuracyLog)
+
+	for i := 0; i < count; i++ {
+		ll, of, ml := llTable.entries[llState], ofTable.entries[ofState], mlTable.entries[mlState]
+		if of.symbol > zstdMaxOffsetCode || ll.symbol > zstdMaxLiteralLength || ml.symbol > zstdMaxMatchLength {
+			return errZstdCorrupt
+		}
+		offsetValue := 1<<of.symbol + int(br.read(uint(of.symbol)))
+		matchLength := int(zstdMatchLengthBase[ml.symbol]) + int(br.read(zstdMatchLengthBits[ml.symbol]))
+		literalLength := int(zstdLiteralLengthBase[ll.symbol]) + int(br.read(zstdLiteralLengthBits[ll.symbol]))
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			z.offsets = [3]int{offset, z.offsets[0], z.offsets[1]}
+		} else {
+			repeat := offsetValue - 1
+			if literalLength == 0 {
+				repeat++
+			}
+			if repeat == 0 {
+				offset = z.offsets[0]
+			} else {
+				if repeat == 3 {
+					offset = z.offsets[0] - 1
+				} else {
+					offset = z.offsets[repeat]
+				}
+				if repeat != 1 {
+					z.offsets[2] = z.offsets[1]
+				}
+				z.offsets[1] = z.offsets[0]
+				z.offsets[0] = offset
+			}
+		}
+
+		if i < count-1 {
+			llState = uint64(ll.newState) + br.read(uint(ll.nbBits))
+			mlState = uint64(ml.newState) + br.read(uint(ml.nbBits))
+			ofState = uint64(of.newState) + br.read(uint(of.nbBits))
+		}
+
+		if literalLength > len(literals) {
+			return errZstdCorrupt
+		}
+		z.history = append(z.history, literals[:literalLength]...)
+		literals = literals[literalLength:]
+
+		if offset <= 0 || offset > len(z.history) {
+			return errZstdCorrupt
+		}
+		if start := len(z.history) - offset; matchLength <= offset {
+			z.history = append(z.history, z.history[start:start+matchLength]...)
+		} else {
+			z.history = appendMatch(z.history, offset, matchLength)
+		}
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+	z.history = append(z.history, literals...)
+	return nil
+}
+
+// readZstdFSECounts reads normalized symbol probabilities of FSE table. It
+// returns them with the accuracy log and the number of bytes read.
+func readZstdFSECounts(src []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	bitPos := 0
+	peek := func(n uint) int {
+		v := 0
+		for i := uint(0); i < n; i++ {
+			if p := bitPos + int(i); p>>3 < len(src) && src[p>>3]>>(uint(p)&7)&1 != 0 {
+				v |= 1 << i
+			}
+		}
+		return v
+	}
+
+	accuracyLog := uint(peek(4)) + 5
+	bitPos = 4
+	if accuracyLog > maxLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	remaining := 1<<accuracyLog + 1
+	threshold := 1 << accuracyLog
+	nbBits := accuracyLog + 1
+
+	var norm []int16
+	previousZero := false
+	for remaining > 1 && len(norm) <= maxSymbol {
+		if previousZero {
+			zeros := 0
+			for peek(2) == 3 {
+				zeros += 3
+				bitPos += 2
+			}
+			zeros += peek(2)
+			bitPos += 2
+			if len(norm)+zeros > maxSymbol {
+				return nil, 0, 0, errZstdCorrupt
+			}
+			for ; zeros > 0; zeros-- {
+				norm = append(norm, 0)
+			}
+		}
+
+		max := 2*threshold - 1 - remaining
+		count := peek(nbBits)
+		if count&(threshold-1) < max {
+			count &= threshold - 1
+			bitPos += int(nbBits) - 1
+		} else {
+			count &= 2*threshold - 1
+			if count >= threshold {
+				count -= max
+			}
+			bitPos += int(nbBits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, 0, errZstdCorrupt
+		}
+		norm = append(norm, int16(count))
+		previousZero = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	consumed := (bitPos + 7) / 8
+	if remaining != 1 || consumed > len(src) {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	return norm, accuracyLog, consumed, nil
+}
+
+// buildZstdFSETable spreads symbols over decoding table according to their
+// normalized probabilities, symbols with probability "less than 1" (-1)
+// take the last cells.
+func buildZstdFSETable(norm []int16, accuracyLog uint) *zstdFSETable {
+	size := 1 << accuracyLog
+	table := &zstdFSETable{entries: make([]zstdFSEEntry, size), accuracyLog: accuracyLog}
+	next := make([]int, len(norm))
+	high := size - 1
+	for symbol, count := range norm {
+		if count == -1 {
+			table.entries[high].symbol = uint8(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = int(count)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for symbol, count := range norm {
+		for i := 0; i < int(count); i++ {
+			table.entries[position].symbol = uint8(symbol)
+			for position = (position + step) & (size - 1); position > high; position = (position + step) & (size - 1) {
+			}
+		}
+	}
+
+	for i := range table.entries {
+		e := &table.entries[i]
+		state := next[e.symbol]
+		next[e.symbol]++
+		e.nbBits = uint8(accuracyLog - uint(bits.Len(uint(state))-1))
+		e.newState = uint16(state<<e.nbBits - size)
+	}
+	return table
+}
+
+// readZstdHuffmanTable reads Huffman tree description. It returns decoding
+// table and the number of bytes read.
+func readZstdHuffmanTable(src []byte) (*zstdHuffmanTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	var weights []byte
+	var consumed int
+	if header := int(src[0]); header >= 128 {
+		// Weights are stored directly as 4-bit values
+		count := header - 127
+		consumed = 1 + (count+1)/2
+		if len(src) < consumed {
+			return nil, 0, errZstdCorrupt
+		}
+		weights = make([]byte, count)
+		for i := range weights {
+			weights[i] = src[1+i/2] >> (4 * uint(1-i%2)) & 15
+		}
+	} else {
+		consumed = 1 + header
+		if len(src) < consumed {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = decodeZstdHuffmanWeights(src[1:consumed]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// The weight of the last symbol is implied by the rest
+	total := 0
+	for _, w := range weights {
+		if w > zstdMaxHuffmanBits {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	maxBits := uint(bits.Len(uint(total)))
+	left := 1<<maxBits - total
+	if maxBits > zstdMaxHuffmanBits || left&(left-1) != 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, byte(bits.Len(uint(left))))
+
+	table := &zstdHuffmanTable{entries: make([]zstdHuffmanEntry, 1<<maxBits), maxBits: maxBits}
+	position := 0
+	for w := uint(1); w <= maxBits; w++ {
+		for symbol, weight := range weights {
+			if uint(weight) != w {
+				continue
+			}
+			entry := zstdHuffmanEntry{symbol: uint8(symbol), nbBits: uint8(maxBits + 1 - w)}
+			for i := 0; i < 1<<(w-1); i++ {
+				table.entries[position] = entry
+				position++
+			}
+		}
+	}
+	return table, consumed, nil
+}
+
+// decodeZstdHuffmanWeights decodes FSE compressed Huffman weights which
+// are interleaved between two decoding states.
+func decodeZstdHuffmanWeights(src []byte) ([]byte, error) {
+	norm, accuracyLog, n, err := readZstdFSECounts(src, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	table := buildZstdFSETable(norm, accuracyLog)
+	br, err := newZstdBackwardBits(src[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	states := [2]uint64{br.read(accuracyLog), br.read(accuracyLog)}
+	var weights []byte
+	for i := 0; ; i ^= 1 {
+		if len(weights) >= 255 {
+			return nil, errZstdCorrupt
+		}
+		e := table.entries[states[i]]
+		weights = append(weights, e.symbol)
+		states[i] = uint64(e.newState) + br.read(uint(e.nbBits))
+		if br.pos < 0 {
+			weights = append(weights, table.entries[states[i^1]].symbol)
+			return weights, nil
+		}
+	}
+}
+
+// decode decodes Huffman coded stream filling dst
+func (t *zstdHuffmanTable) decode(dst []byte, src []byte) error {
+	br, err := newZstdBackwardBits(src)
+	if err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.entries[br.peek(t.maxBits)]
+		dst[i] = e.symbol
+		br.pos -= int(e.nbBits)
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+// zstdBackwardBits reads bit stream from its end to its start. The stream
+// ends with the highest set bit of the last byte.
+type zstdBackwardBits struct {
+	data []byte
+	pos  int // number of bits left
+}
+
+func newZstdBackwardBits(data []byte) (*zstdBackwardBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &zstdBackwardBits{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// peek returns n bits preceding the position, bits before the start of the
+// stream are zeros.
+func (b *zstdBackwardBits) peek(n uint) uint64 {
+	start := b.pos - int(n)
+	shift := uint(0)
+	if start < 0 {
+		if int(n) <= -start {
+			return 0
+		}
+		shift = uint(-start)
+		n -= shift
+		start = 0
+	}
+	i := start >> 3
+	var v uint64
+	if i+8 <= len(b.data) {
+		v = binary.LittleEndian.Uint64(b.data[i:])
+	} else {
+		for j := len(b.data) - 1; j >= i; j-- {
+			v = v<<8 | uint64(b.data[j])
+		}
+	}
+	return (v >> (uint(start) & 7) & (1<<n - 1)) << shift
+}
+
+func (b *zstdBackwardBits) read(n uint) uint64 {
+	v := b.peek(n)
+	b.pos -= int(n)
+	return v
+}
+
+// xxhash64 is XXH64 hash with zero seed which checksums zstd frames
+type xxhash64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	n     int
+	total uint64
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+func (h *xxhash64) reset() {
+	// Unsigned arithmetic wraps around only for variables
+	prime1, prime2 := xxhPrime1, xxhPrime2
+	h.v = [4]uint64{prime1 + prime2, prime2, 0, -prime1}
+	h.n = 0
+	h.total = 0
+}
+
+func xxhRound(acc, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*xxhPrime2, 31) * xxhPrime1
+}
+
+func (h *xxhash64) write(p []byte) {
+	h.total += uint64(len(p))
+	if h.n > 0 {
+		copied := copy(h.buf[h.n:], p)
+		h.n += copied
+		p = p[copied:]
+		if h.n < len(h.buf) {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxhRound(h.v[i], binary.LittleEndian.Uint64(p[i*8:]))
+	}
+}
+
+func (h *xxhash64) sum() uint64 {
+	var sum uint64
+	if h.total >= 32 {
+		sum = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			sum = (sum^xxhRound(0, v))*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		sum = xxhPrime5
+	}
+	sum += h.total
+
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		sum = bits.RotateLeft64(sum^xxhRound(0, binary.LittleEndian.Uint64(p)), 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		sum = bits.RotateLeft64(sum^uint64(binary.LittleEndian.Uint32(p))*xxhPrime1, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		sum = bits.RotateLeft64(sum^uint64(b)*xxhPrime5, 11) * xxhPrime1
+	}
+
+	sum ^= sum >> 33
+	sum *= xxhPrime2
+	sum ^= sum >> 29
+	sum *= xxhPrime3
+	sum ^= sum >> 32
+	return sum
+}